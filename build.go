@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mydocker/builder"
+	"mydocker/container"
+	"mydocker/image"
+	"mydocker/utils"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BuildOptions mydocker build的参数
+type BuildOptions struct {
+	Tag           string   //构建出的镜像名
+	Dockerfile    string   //Dockerfile路径，默认是构建上下文中的Dockerfile
+	Context       string   //构建上下文目录，COPY/ADD的源文件都相对于它
+	BuildArgs     []string //--build-arg k=v
+	NoCache       bool     //不使用构建缓存
+	StorageDriver string   //构建容器使用的存储驱动，为空时自动选择
+}
+
+// buildStage 构建过程中一个阶段的当前状态
+type buildStage struct {
+	config   *image.Config
+	layers   []image.Descriptor
+	args     map[string]string //本阶段声明过的ARG
+	cacheKey string            //到当前步骤为止的缓存key
+}
+
+type imageBuilder struct {
+	opts       *BuildOptions
+	cache      *builder.Cache
+	buildArgs  map[string]string
+	globalArgs map[string]string       //第一个FROM之前声明的ARG
+	stages     map[string]*image.Image //已经构建完成的阶段，按名字和序号索引
+}
+
+// buildImage 按照Dockerfile构建镜像
+// RUN在基于当前状态启动的容器中执行，结束后把容器的可写层提交为新的镜像层
+// COPY/ADD直接把文件组织成一个镜像层，其他指令只修改镜像配置
+func buildImage(opts *BuildOptions) error {
+	if opts.Dockerfile == "" {
+		opts.Dockerfile = filepath.Join(opts.Context, "Dockerfile")
+	}
+	file, err := os.Open(opts.Dockerfile)
+	if err != nil {
+		return err
+	}
+	dockerfile, err := builder.Parse(file)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("parse %s error %v", opts.Dockerfile, err)
+	}
+	if opts.Context, err = filepath.Abs(opts.Context); err != nil {
+		return err
+	}
+
+	//构建过程中产生的中间镜像没有名字，持有共享锁防止被垃圾回收
+	storeLock, err := image.LockStore(false)
+	if err != nil {
+		return err
+	}
+	defer storeLock.Unlock()
+	cache, err := builder.LoadCache()
+	if err != nil {
+		return err
+	}
+	b := &imageBuilder{
+		opts:       opts,
+		cache:      cache,
+		buildArgs:  map[string]string{},
+		globalArgs: map[string]string{},
+		stages:     map[string]*image.Image{},
+	}
+	for _, arg := range opts.BuildArgs {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) == 2 {
+			b.buildArgs[kv[0]] = kv[1]
+		} else if value, ok := os.LookupEnv(kv[0]); ok {
+			b.buildArgs[kv[0]] = value
+		}
+	}
+	for _, arg := range dockerfile.Args {
+		name, value := b.argValue(arg.Args, nil)
+		b.globalArgs[name] = value
+	}
+
+	var img *image.Image
+	for i, stage := range dockerfile.Stages {
+		if img, err = b.buildStage(i, stage); err != nil {
+			return err
+		}
+		b.stages[strconv.Itoa(i)] = img
+		if stage.Name != "" {
+			b.stages[stage.Name] = img
+		}
+	}
+
+	if opts.Tag != "" {
+		if err := image.Tag(opts.Tag, img.Digest); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Successfully built %s\n", img.ID())
+	return nil
+}
+
+func (b *imageBuilder) buildStage(index int, stage *builder.Stage) (*image.Image, error) {
+	baseName := builder.Expand(stage.Base, func(name string) (string, bool) {
+		value, ok := b.globalArgs[name]
+		return value, ok
+	})
+	fmt.Printf("Stage %d : FROM %s\n", index, baseName)
+
+	state := &buildStage{args: map[string]string{}}
+	if base, ok := b.stages[strings.ToLower(baseName)]; ok {
+		state.useImage(base)
+	} else if baseName == "scratch" {
+		state.config = image.NewConfig()
+		state.cacheKey = "scratch"
+	} else {
+		base, err := image.Get(baseName)
+		if err != nil {
+			return nil, err
+		}
+		state.useImage(base)
+	}
+
+	for i, instruction := range stage.Instructions {
+		fmt.Printf("Step %d/%d : %s\n", i+1, len(stage.Instructions), instruction.Original)
+		if err := b.dispatch(state, instruction); err != nil {
+			return nil, fmt.Errorf("line %d: %s error %v", instruction.Line, instruction.Command, err)
+		}
+	}
+	state.config.Created = time.Now().UTC().Format(time.RFC3339Nano)
+	return image.Create(state.config, state.layers)
+}
+
+// useImage 以一个镜像作为当前状态，配置需要深拷贝，避免修改到原镜像
+func (s *buildStage) useImage(img *image.Image) {
+	content, _ := json.Marshal(img.Config)
+	s.config = &image.Config{}
+	json.Unmarshal(content, s.config)
+	s.layers = append([]image.Descriptor{}, img.Manifest.Layers...)
+	s.cacheKey = img.Digest
+}
+
+func (b *imageBuilder) dispatch(state *buildStage, instruction *builder.Instruction) error {
+	lookup := func(name string) (string, bool) {
+		for _, env := range state.config.Config.Env {
+			if strings.HasPrefix(env, name+"=") {
+				return strings.TrimPrefix(env, name+"="), true
+			}
+		}
+		value, ok := state.args[name]
+		return value, ok
+	}
+
+	switch instruction.Command {
+	case "ARG":
+		name, value := b.argValue(instruction.Args, state)
+		state.args[name] = value
+		state.cacheKey = builder.CacheKey(state.cacheKey, "ARG "+name+"="+value, "")
+		return nil
+	case "RUN":
+		return b.runStep(state, instruction)
+	case "COPY", "ADD":
+		return b.copyStep(state, instruction, builder.Expand(instruction.Args, lookup))
+	}
+
+	//其余指令只修改镜像配置，CMD和ENTRYPOINT中的变量由运行时的shell处理
+	args := instruction.Args
+	if instruction.Command != "CMD" && instruction.Command != "ENTRYPOINT" {
+		args = builder.Expand(args, lookup)
+	}
+	if instruction.Command == "WORKDIR" && !path.IsAbs(args) {
+		args = path.Join("/", state.config.Config.WorkingDir, args)
+	}
+	change := instruction.Command + " " + args
+	if err := image.ApplyChange(&state.config.Config, change); err != nil {
+		return err
+	}
+	state.config.History = append(state.config.History, image.History{
+		Created:    time.Now().UTC().Format(time.RFC3339Nano),
+		CreatedBy:  "#(nop) " + change,
+		EmptyLayer: true,
+	})
+	state.cacheKey = builder.CacheKey(state.cacheKey, change, "")
+	return nil
+}
+
+// argValue 解析 ARG name[=default]，--build-arg优先于默认值
+func (b *imageBuilder) argValue(args string, state *buildStage) (string, string) {
+	kv := strings.SplitN(args, "=", 2)
+	name := kv[0]
+	if value, ok := b.buildArgs[name]; ok {
+		return name, value
+	}
+	if len(kv) == 2 {
+		return name, strings.Trim(kv[1], `"'`)
+	}
+	//阶段内只声明名字的ARG继承全局ARG的默认值
+	if state != nil {
+		return name, b.globalArgs[name]
+	}
+	return name, ""
+}
+
+// tryCache 命中缓存时直接使用缓存的镜像作为当前状态
+func (b *imageBuilder) tryCache(state *buildStage, key string) bool {
+	if b.opts.NoCache {
+		return false
+	}
+	img, ok := b.cache.Get(key)
+	if !ok {
+		return false
+	}
+	fmt.Printf(" ---> Using cache %s\n", img.ID())
+	state.useImage(img)
+	state.cacheKey = key
+	return true
+}
+
+// addLayer 把新的镜像层加入当前状态，保存中间镜像并记录缓存
+func (b *imageBuilder) addLayer(state *buildStage, key, createdBy string, layer image.Descriptor, diffID string) error {
+	state.layers = append(state.layers, layer)
+	state.config.RootFS.DiffIDs = append(state.config.RootFS.DiffIDs, diffID)
+	state.config.History = append(state.config.History, image.History{
+		Created:   time.Now().UTC().Format(time.RFC3339Nano),
+		CreatedBy: createdBy,
+	})
+	img, err := image.Create(state.config, state.layers)
+	if err != nil {
+		return err
+	}
+	state.cacheKey = key
+	fmt.Printf(" ---> %s\n", img.ID())
+	return b.cache.Put(key, img.Digest)
+}
+
+// runStep 启动一个使用当前状态作为rootfs的容器执行命令，提交它的可写层
+func (b *imageBuilder) runStep(state *buildStage, instruction *builder.Instruction) error {
+	//ARG以环境变量的形式对RUN可见，所以也要参与缓存key的计算
+	var argEnv []string
+	for name, value := range state.args {
+		argEnv = append(argEnv, name+"="+value)
+	}
+	sort.Strings(argEnv)
+	key := builder.CacheKey(state.cacheKey, "RUN "+instruction.Args, strings.Join(argEnv, "\n"))
+	if b.tryCache(state, key) {
+		return nil
+	}
+
+	current, err := image.Create(state.config, state.layers)
+	if err != nil {
+		return err
+	}
+	containerName := "build-" + utils.RanStringBytes(10)
+	env := append(argEnv, state.config.Config.Env...)
+	parent, writePipe := container.NewParentProcess(true, nil, containerName, current.Digest, container.StorageOpts{Driver: b.opts.StorageDriver}, &env)
+	if parent == nil {
+		return fmt.Errorf("create build container error")
+	}
+	defer removeBuildContainer(containerName)
+
+	if err := parent.Start(); err != nil {
+		return err
+	}
+	sendInitCommand(&container.InitConfig{
+		Args:       image.ParseCommand(instruction.Args),
+		WorkingDir: state.config.Config.WorkingDir,
+		User:       state.config.Config.User,
+	}, writePipe)
+	if err := parent.Wait(); err != nil {
+		return fmt.Errorf("command %q returned error %v", instruction.Args, err)
+	}
+
+	layer, diffID, err := container.LookupSnapshotter(containerName).Commit(containerName)
+	if err != nil {
+		return err
+	}
+	return b.addLayer(state, key, instruction.Original, layer, diffID)
+}
+
+// copyStep 把构建上下文或者其他阶段中的文件组织成一个镜像层
+// ADD与COPY相同，只是本地的tar包会被解压到目标目录
+func (b *imageBuilder) copyStep(state *buildStage, instruction *builder.Instruction, args string) error {
+	var words []string
+	if err := json.Unmarshal([]byte(args), &words); err != nil {
+		words = image.SplitWords(args)
+	}
+	if len(words) < 2 {
+		return fmt.Errorf("requires at least one source and a destination")
+	}
+	sources, dest := words[:len(words)-1], words[len(words)-1]
+
+	srcRoot := b.opts.Context
+	if from := instruction.Flags["from"]; from != "" {
+		if instruction.Command != "COPY" {
+			return fmt.Errorf("--from is only supported by COPY")
+		}
+		fromImage, ok := b.stages[strings.ToLower(from)]
+		if !ok {
+			var err error
+			if fromImage, err = image.Get(from); err != nil {
+				return err
+			}
+		}
+		//把其他阶段的镜像临时挂载出来作为源目录
+		mountName := "build-" + utils.RanStringBytes(10)
+		rootfs, err := container.NewWorkSpace(nil, fromImage.Digest, mountName, container.StorageOpts{Driver: b.opts.StorageDriver})
+		if err != nil {
+			return err
+		}
+		defer removeBuildContainer(mountName)
+		srcRoot = rootfs
+	}
+
+	var matches []string
+	for _, source := range sources {
+		if rel, err := filepath.Rel(srcRoot, filepath.Join(srcRoot, source)); err != nil || strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("source %s is outside of the build context", source)
+		}
+		//目录中的符号链接以srcRoot为根解析，构建上下文或者其他阶段镜像中指向/etc的链接不会读到宿主机的文件
+		dir, err := utils.SecureJoin(srcRoot, path.Dir(path.Join("/", source)))
+		if err != nil {
+			return fmt.Errorf("source %s: %v", source, err)
+		}
+		found, err := filepath.Glob(filepath.Join(dir, path.Base(path.Join("/", source))))
+		if err != nil {
+			return err
+		}
+		if len(found) == 0 {
+			return fmt.Errorf("no source files were specified by %s", source)
+		}
+		//目录部分的通配符匹配到的符号链接也要重新在srcRoot之内解析，源文件自身是符号链接时复制链接
+		for _, match := range found {
+			rel, err := filepath.Rel(srcRoot, match)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				return fmt.Errorf("source %s is outside of the build context", source)
+			}
+			parent, err := utils.SecureJoin(srcRoot, filepath.Dir(rel))
+			if err != nil {
+				return fmt.Errorf("source %s: %v", source, err)
+			}
+			matches = append(matches, filepath.Join(parent, filepath.Base(rel)))
+		}
+	}
+
+	contentHash, err := builder.HashPaths(matches)
+	if err != nil {
+		return err
+	}
+	key := builder.CacheKey(state.cacheKey, instruction.Command+" "+args, contentHash)
+	if b.tryCache(state, key) {
+		return nil
+	}
+
+	//相对路径基于WORKDIR，保留结尾的/以区分目标是否为目录
+	if !path.IsAbs(dest) {
+		isDir := strings.HasSuffix(dest, "/")
+		dest = path.Join("/", state.config.Config.WorkingDir, dest)
+		if isDir {
+			dest += "/"
+		}
+	}
+	if err := os.MkdirAll(container.RootPath, 0755); err != nil {
+		return err
+	}
+	layerDir, err := ioutil.TempDir(container.RootPath, "build-copy-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(layerDir)
+
+	for _, match := range matches {
+		if err := copyToLayer(instruction.Command, match, layerDir, dest, len(matches) > 1); err != nil {
+			return err
+		}
+	}
+	layer, diffID, err := image.CreateLayer(layerDir)
+	if err != nil {
+		return err
+	}
+	return b.addLayer(state, key, instruction.Command+" "+args, layer, diffID)
+}
+
+// copyToLayer 目录复制其中的内容，文件在目标以/结尾或者有多个源时复制到目标目录下
+func copyToLayer(command, src, layerDir, dest string, multiple bool) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	//目标在层目录之内解析，/../../etc这样的目标不会写到宿主机上
+	target, err := utils.SecureJoin(layerDir, path.Clean("/"+dest))
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.IsDir():
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return utils.CopyPath(src, target)
+	case command == "ADD" && isArchive(src):
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		return extractArchive(src, target)
+	default:
+		if multiple || strings.HasSuffix(dest, "/") {
+			if target, err = utils.SecureJoin(layerDir, path.Join("/", dest, filepath.Base(src))); err != nil {
+				return err
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return utils.CopyPath(src, target)
+	}
+}
+
+// extractArchive ADD的tar包(可以是gzip、bzip2、xz或zstd压缩的)在进程内解包到目标目录
+func extractArchive(src, target string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader, _, err := image.Decompress(file)
+	if err != nil {
+		return fmt.Errorf("untar %s error %v", src, err)
+	}
+	defer reader.Close()
+	if err := image.Unpack(reader, target, image.ArchiveOptions{Progress: image.LogProgress("Extracting", src)}); err != nil {
+		return fmt.Errorf("untar %s error %v", src, err)
+	}
+	return nil
+}
+
+// isArchive 和image.Decompress一样按内容而不是后缀判断，解压之后是tar(头部的ustar标记)的才解包
+// 其他文件，包括压缩过但不是tar的文件，原样复制
+func isArchive(filePath string) bool {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	reader, _, err := image.Decompress(file)
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+	header := make([]byte, 512)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return false
+	}
+	return bytes.HasPrefix(header[257:], []byte("ustar"))
+}
+
+// removeBuildContainer 清理构建时使用的容器文件系统
+func removeBuildContainer(containerName string) {
+	container.DeleteWorkSpace(nil, containerName)
+}
@@ -0,0 +1,162 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mydocker/image"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	cacheFile = "buildcache.json"
+	// buildcache.json会被rename替换，不能直接对它加锁，使用单独的锁文件
+	cacheLockFile = "buildcache.lock"
+)
+
+// Cache 构建缓存，记录每个会产生镜像层的构建步骤对应的镜像(manifest摘要)
+// key由上一步的key、指令以及COPY/ADD的文件内容计算得到，任何一步变化都会让之后的缓存失效
+type Cache struct {
+	entries map[string]string
+}
+
+// LoadCache 加载构建缓存
+func LoadCache() (*Cache, error) {
+	entries, err := loadEntries()
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{entries: entries}, nil
+}
+
+func loadEntries() (map[string]string, error) {
+	entries := map[string]string{}
+	content, err := ioutil.ReadFile(path.Join(image.ImagePath, cacheFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return nil, fmt.Errorf("unmarshal %s error %v", cacheFile, err)
+	}
+	return entries, nil
+}
+
+// Get 查找缓存，镜像已经被删除的缓存视为不存在
+func (c *Cache) Get(key string) (*image.Image, bool) {
+	digest, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	img, err := image.Get(digest)
+	if err != nil {
+		return nil, false
+	}
+	return img, true
+}
+
+// Put 记录缓存并保存到文件
+func (c *Cache) Put(key, manifestDigest string) error {
+	c.entries[key] = manifestDigest
+	return update(func(entries map[string]string) {
+		entries[key] = manifestDigest
+	})
+}
+
+// update 在构建缓存专用的排他锁之内重新读取、修改并保存缓存文件
+// 同时进行的构建各自只持有加载时的缓存，直接保存会覆盖其他构建在这期间记录的缓存
+func update(modify func(entries map[string]string)) error {
+	lock, err := image.LockFile(cacheLockFile, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	entries, err := loadEntries()
+	if err != nil {
+		return err
+	}
+	modify(entries)
+	content, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return image.WriteFileAtomic(path.Join(image.ImagePath, cacheFile), content)
+}
+
+// CacheKey 根据上一步的key、指令和内容摘要计算这一步的key
+func CacheKey(parent, instruction, contentHash string) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s\n%s", parent, instruction, contentHash)
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil))
+}
+
+// HashPaths 计算一组文件或目录的内容摘要，包括相对路径、权限和文件内容
+func HashPaths(paths []string) (string, error) {
+	hash := sha256.New()
+	for _, root := range paths {
+		var files []string
+		err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			files = append(files, filePath)
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		sort.Strings(files)
+
+		for _, filePath := range files {
+			info, err := os.Lstat(filePath)
+			if err != nil {
+				return "", err
+			}
+			relPath, _ := filepath.Rel(root, filePath)
+			fmt.Fprintf(hash, "%s %s %v\n", filepath.Base(root), relPath, info.Mode())
+			switch {
+			case info.Mode()&os.ModeSymlink != 0:
+				link, err := os.Readlink(filePath)
+				if err != nil {
+					return "", err
+				}
+				io.WriteString(hash, link)
+			case info.Mode().IsRegular():
+				if err := hashFile(hash, filePath); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func hashFile(w io.Writer, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// Prune 删除镜像已经不存在的缓存记录，在镜像垃圾回收之后调用
+func (c *Cache) Prune() error {
+	return update(func(entries map[string]string) {
+		for key, digest := range entries {
+			if _, err := os.Stat(image.BlobPath(digest)); err != nil {
+				delete(entries, key)
+				delete(c.entries, key)
+			}
+		}
+	})
+}
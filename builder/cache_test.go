@@ -0,0 +1,47 @@
+package builder
+
+import (
+	"fmt"
+	"mydocker/image"
+	"sync"
+	"testing"
+)
+
+func TestCacheConcurrentPut(t *testing.T) {
+	image.ImagePath = t.TempDir()
+	//每个构建在开始时加载缓存，之后同时记录各自的缓存
+	var caches []*Cache
+	for i := 0; i < 10; i++ {
+		cache, err := LoadCache()
+		if err != nil {
+			t.Fatal(err)
+		}
+		caches = append(caches, cache)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, len(caches))
+	for i, cache := range caches {
+		wg.Add(1)
+		go func(i int, cache *Cache) {
+			defer wg.Done()
+			errs <- cache.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("digest%d", i))
+		}(i, cache)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("put %v", err)
+		}
+	}
+
+	cache, err := LoadCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range caches {
+		if cache.entries[fmt.Sprintf("key%d", i)] != fmt.Sprintf("digest%d", i) {
+			t.Errorf("lost cache entry key%d", i)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package builder
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// 支持的Dockerfile指令
+var supportedInstructions = map[string]bool{
+	"FROM": true, "RUN": true, "COPY": true, "ADD": true, "ENV": true, "WORKDIR": true,
+	"USER": true, "EXPOSE": true, "LABEL": true, "ENTRYPOINT": true, "CMD": true, "ARG": true,
+}
+
+// Instruction Dockerfile中的一条指令
+type Instruction struct {
+	Command  string            //大写的指令名
+	Flags    map[string]string //指令参数前的 --from=xxx 之类的选项
+	Args     string            //去掉选项之后的参数
+	Original string            //合并续行之后的原文
+	Line     int               //指令开始的行号
+}
+
+// Stage 多阶段构建中的一个阶段，从一个FROM开始
+type Stage struct {
+	Name         string //FROM ... AS name 中的name，没有的话为空
+	Base         string //FROM的镜像，可能包含ARG变量
+	Instructions []*Instruction
+}
+
+// Dockerfile 解析后的Dockerfile
+type Dockerfile struct {
+	Args   []*Instruction //第一个FROM之前的ARG，只能在FROM中使用
+	Stages []*Stage
+}
+
+// Parse 解析Dockerfile，处理注释和以\结尾的续行
+func Parse(r io.Reader) (*Dockerfile, error) {
+	dockerfile := &Dockerfile{}
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	var current strings.Builder
+	startLine := 0
+
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		//注释行和空行直接跳过，续行中间的注释也一样
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if current.Len() == 0 {
+			startLine = lineNo
+		}
+		if strings.HasSuffix(line, "\\") {
+			current.WriteString(strings.TrimSuffix(line, "\\"))
+			current.WriteString(" ")
+			continue
+		}
+		current.WriteString(line)
+		if err := dockerfile.add(current.String(), startLine); err != nil {
+			return nil, err
+		}
+		current.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current.Len() > 0 {
+		if err := dockerfile.add(current.String(), startLine); err != nil {
+			return nil, err
+		}
+	}
+	if len(dockerfile.Stages) == 0 {
+		return nil, fmt.Errorf("no FROM instruction in Dockerfile")
+	}
+	return dockerfile, nil
+}
+
+func (d *Dockerfile) add(line string, lineNo int) error {
+	instruction, err := parseInstruction(line, lineNo)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case instruction.Command == "FROM":
+		stage, err := parseFrom(instruction)
+		if err != nil {
+			return err
+		}
+		d.Stages = append(d.Stages, stage)
+	case len(d.Stages) == 0:
+		if instruction.Command != "ARG" {
+			return fmt.Errorf("line %d: %s before FROM", lineNo, instruction.Command)
+		}
+		d.Args = append(d.Args, instruction)
+	default:
+		stage := d.Stages[len(d.Stages)-1]
+		stage.Instructions = append(stage.Instructions, instruction)
+	}
+	return nil
+}
+
+func parseInstruction(line string, lineNo int) (*Instruction, error) {
+	fields := strings.SplitN(line, " ", 2)
+	instruction := &Instruction{
+		Command:  strings.ToUpper(fields[0]),
+		Flags:    map[string]string{},
+		Original: line,
+		Line:     lineNo,
+	}
+	if !supportedInstructions[instruction.Command] {
+		return nil, fmt.Errorf("line %d: unsupported instruction %s", lineNo, fields[0])
+	}
+	if len(fields) < 2 || strings.TrimSpace(fields[1]) == "" {
+		return nil, fmt.Errorf("line %d: %s requires arguments", lineNo, instruction.Command)
+	}
+
+	//RUN/CMD/ENTRYPOINT的参数是命令本身，不解析选项
+	args := strings.TrimSpace(fields[1])
+	if instruction.Command != "RUN" && instruction.Command != "CMD" && instruction.Command != "ENTRYPOINT" {
+		for strings.HasPrefix(args, "--") {
+			parts := strings.SplitN(args, " ", 2)
+			kv := strings.SplitN(strings.TrimPrefix(parts[0], "--"), "=", 2)
+			if len(kv) == 2 {
+				instruction.Flags[kv[0]] = kv[1]
+			} else {
+				instruction.Flags[kv[0]] = "true"
+			}
+			args = ""
+			if len(parts) == 2 {
+				args = strings.TrimSpace(parts[1])
+			}
+		}
+	}
+	instruction.Args = args
+	return instruction, nil
+}
+
+// parseFrom 解析 FROM image [AS name]
+func parseFrom(instruction *Instruction) (*Stage, error) {
+	fields := strings.Fields(instruction.Args)
+	switch {
+	case len(fields) == 1:
+		return &Stage{Base: fields[0]}, nil
+	case len(fields) == 3 && strings.EqualFold(fields[1], "AS"):
+		return &Stage{Base: fields[0], Name: strings.ToLower(fields[2])}, nil
+	default:
+		return nil, fmt.Errorf("line %d: invalid FROM %s", instruction.Line, instruction.Args)
+	}
+}
+
+// Expand 替换参数中的$VAR、${VAR}、${VAR:-default}和${VAR:+value}
+func Expand(s string, lookup func(string) (string, bool)) string {
+	return os.Expand(s, func(name string) string {
+		if i := strings.Index(name, ":-"); i >= 0 {
+			if value, ok := lookup(name[:i]); ok && value != "" {
+				return value
+			}
+			return name[i+2:]
+		}
+		if i := strings.Index(name, ":+"); i >= 0 {
+			if value, ok := lookup(name[:i]); ok && value != "" {
+				return name[i+2:]
+			}
+			return ""
+		}
+		value, _ := lookup(name)
+		return value
+	})
+}
@@ -0,0 +1,69 @@
+package builder
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	dockerfile := `
+ARG BASE=busybox
+# 构建阶段
+FROM ${BASE} AS build
+RUN echo hello \
+    # 续行中的注释
+    > /hello
+FROM scratch
+COPY --from=build /hello /hello
+CMD ["/hello"]
+`
+	d, err := Parse(strings.NewReader(dockerfile))
+	if err != nil {
+		t.Fatalf("parse %v", err)
+	}
+	if len(d.Args) != 1 || d.Args[0].Args != "BASE=busybox" {
+		t.Fatalf("global args %+v", d.Args)
+	}
+	if len(d.Stages) != 2 || d.Stages[0].Name != "build" || d.Stages[0].Base != "${BASE}" {
+		t.Fatalf("stages %+v", d.Stages)
+	}
+	run := d.Stages[0].Instructions[0]
+	if run.Command != "RUN" || run.Args != "echo hello  > /hello" || run.Line != 5 {
+		t.Fatalf("run %+v", run)
+	}
+	copyInstruction := d.Stages[1].Instructions[0]
+	if copyInstruction.Flags["from"] != "build" || copyInstruction.Args != "/hello /hello" {
+		t.Fatalf("copy %+v", copyInstruction)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, dockerfile := range []string{
+		"RUN ls",
+		"FROM busybox\nHEALTHCHECK NONE",
+		"FROM busybox\nRUN",
+	} {
+		if _, err := Parse(strings.NewReader(dockerfile)); err == nil {
+			t.Fatalf("parse %q should fail", dockerfile)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	vars := map[string]string{"A": "1", "EMPTY": ""}
+	lookup := func(name string) (string, bool) {
+		value, ok := vars[name]
+		return value, ok
+	}
+	cases := map[string]string{
+		"$A/${A}":         "1/1",
+		"${EMPTY:-x}":     "x",
+		"${A:+set}":       "set",
+		"${MISSING:+set}": "",
+	}
+	for s, want := range cases {
+		if got := Expand(s, lookup); got != want {
+			t.Fatalf("expand %s got %s want %s", s, got, want)
+		}
+	}
+}
@@ -1,10 +1,29 @@
 package cgroups
 
 import (
-	"github.com/sirupsen/logrus"
+	"fmt"
+	"io/ioutil"
 	"mydocker/cgroups/subsystems"
+	"mydocker/utils"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 )
 
+const (
+	// CgroupParent 每个容器的cgroup都创建在这个cgroup之下
+	CgroupParent = "mydocker"
+	// LegacyCgroupPath 旧版本所有容器共用的cgroup
+	LegacyCgroupPath = "mydocker-cgroup"
+)
+
+// ContainerCgroupPath 容器自己的cgroup，mydocker/<容器ID>
+func ContainerCgroupPath(containerID string) string {
+	return path.Join(CgroupParent, containerID)
+}
+
 type CgroupManager struct {
 	//cgroup在hierarchy中的路径 相当于创建的cgroup目录相对于root cgroup目录的路径
 	Path string
@@ -18,28 +37,143 @@ func NewCgroupManager(path string) *CgroupManager {
 	}
 }
 
-// 将进程pid加入到每个cgroup中
+// 将进程pid加入到cgroup中，cgroup v2中所有subsystem在同一个目录下，写一次cgroup.procs即可
 func (c *CgroupManager) Apply(pid int) error {
-	for _, subSysIns := range subsystems.SubsystemsIns {
-		subSysIns.Apply(c.Path, pid)
+	cgroupPath, err := subsystems.GetCgroupPath(c.Path, true)
+	if err != nil {
+		return fmt.Errorf("get cgroup %s error :%v", c.Path, err)
+	}
+	if err := ioutil.WriteFile(path.Join(cgroupPath, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		return fmt.Errorf("set cgroup proc fail %v", err)
 	}
 	return nil
 }
 
-// 设置各个subsystem挂载中的cgroup资源限制
+// 设置各个subsystem挂载中的cgroup资源限制，一个subsystem失败不影响其他subsystem，返回第一个错误
 func (c *CgroupManager) Set(res *subsystems.ResourceConfig) error {
+	var firstErr error
 	for _, subSysIns := range subsystems.SubsystemsIns {
-		subSysIns.Set(c.Path, res)
+		if err := subSysIns.Set(c.Path, res); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	return nil
+	return firstErr
 }
 
-// 释放各个subsysteam挂载中的cgroup
-func (c *CgroupManager) Destroy() error {
+// GetStats 读取cgroup中各个subsystem的资源使用情况
+func (c *CgroupManager) GetStats() (*subsystems.Stats, error) {
+	stats := &subsystems.Stats{}
 	for _, subSysIns := range subsystems.SubsystemsIns {
-		if err := subSysIns.Remove(c.Path); err != nil {
-			logrus.Warnf("remove cgroup fail %v", err)
+		if reader, ok := subSysIns.(subsystems.StatsReader); ok {
+			if err := reader.GetStats(c.Path, stats); err != nil {
+				return nil, err
+			}
 		}
 	}
-	return nil
+	return stats, nil
+}
+
+// Destroy 删除容器的cgroup，cgroup v2中所有subsystem在同一个目录下，删除一次即可
+// 旧版本所有容器共用的cgroup不删除，其中可能有其他容器的进程
+func (c *CgroupManager) Destroy() error {
+	if c.Path == "" || c.Path == LegacyCgroupPath {
+		return nil
+	}
+	cgroupPath := path.Join(subsystems.FindCgroupMountpoint(), c.Path)
+	//删除容器时杀死cgroup中残留的进程，比如忽略了SIGTERM的容器init进程
+	if procs, err := ioutil.ReadFile(path.Join(cgroupPath, "cgroup.procs")); err == nil && strings.TrimSpace(string(procs)) != "" {
+		if err := ioutil.WriteFile(path.Join(cgroupPath, "cgroup.kill"), []byte("1"), 0644); err != nil {
+			return fmt.Errorf("kill processes in cgroup %s error %v", cgroupPath, err)
+		}
+	}
+	//进程被杀死之后内核可能还没有把它移出cgroup，删除会返回EBUSY
+	var err error
+	for i := 0; i < 100; i++ {
+		if err = os.Remove(cgroupPath); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("remove cgroup %s error %v", cgroupPath, err)
+}
+
+// Freeze 冻结cgroup中的所有进程，cgroup v2中通过写cgroup.freeze实现
+func (c *CgroupManager) Freeze() error {
+	return c.setFrozen(true)
+}
+
+// Thaw 解冻cgroup中的所有进程
+func (c *CgroupManager) Thaw() error {
+	return c.setFrozen(false)
+}
+
+func (c *CgroupManager) setFrozen(frozen bool) error {
+	//和Destroy一样不操作旧版本共用的cgroup，冻结它会冻结所有旧版本的容器
+	if c.Path == "" || c.Path == LegacyCgroupPath {
+		return fmt.Errorf("cgroup %q is shared by containers, can not freeze a single container", c.Path)
+	}
+	cgroupPath, err := subsystems.GetCgroupPath(c.Path, false)
+	if err != nil {
+		return err
+	}
+	state := "0"
+	if frozen {
+		state = "1"
+	}
+	if err := ioutil.WriteFile(path.Join(cgroupPath, "cgroup.freeze"), []byte(state), 0644); err != nil {
+		return fmt.Errorf("write cgroup.freeze error %v", err)
+	}
+
+	//写入之后内核是异步冻结的，要等cgroup.events中的frozen变成对应的状态
+	for i := 0; i < 100; i++ {
+		events, err := ioutil.ReadFile(path.Join(cgroupPath, "cgroup.events"))
+		if err != nil {
+			return fmt.Errorf("read cgroup.events error %v", err)
+		}
+		if strings.Contains(string(events), "frozen "+state) {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("wait cgroup %s frozen=%s timeout", c.Path, state)
+}
+
+// StaleCgroups 检查mydocker下每个容器的cgroup和旧版本共用的cgroup，
+// 已经没有进程、也没有运行中的容器使用的返回删除它的修复
+func StaleCgroups(inUse map[string]bool) ([]utils.Repair, error) {
+	candidates := []string{LegacyCgroupPath}
+	entries, err := ioutil.ReadDir(path.Join(subsystems.FindCgroupMountpoint(), CgroupParent))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			candidates = append(candidates, ContainerCgroupPath(entry.Name()))
+		}
+	}
+
+	var repairs []utils.Repair
+	for _, cgroup := range candidates {
+		if inUse[cgroup] {
+			continue
+		}
+		cgroupPath, err := subsystems.GetCgroupPath(cgroup, false)
+		if err != nil {
+			continue
+		}
+		procs, err := ioutil.ReadFile(path.Join(cgroupPath, "cgroup.procs"))
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(string(procs)) != "" {
+			continue
+		}
+		repairs = append(repairs, utils.Repair{
+			Description: fmt.Sprintf("remove empty cgroup %s", cgroupPath),
+			Fix: func() error {
+				return os.Remove(cgroupPath)
+			},
+		})
+	}
+	return repairs, nil
 }
@@ -0,0 +1,45 @@
+package cgroups
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mydocker/cgroups/subsystems"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCgroupManagerApply(t *testing.T) {
+	if os.Getuid() != 0 || subsystems.FindCgroupMountpoint() == "" {
+		t.Skip("requires root and cgroup v2")
+	}
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	manager := NewCgroupManager(ContainerCgroupPath(fmt.Sprintf("test-%d", os.Getpid())))
+	if err := manager.Apply(cmd.Process.Pid); err != nil {
+		t.Fatalf("apply %v", err)
+	}
+	//cgroup.procs只写了一次，进程在容器的cgroup中
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", cmd.Process.Pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "::/"+manager.Path+"\n") {
+		t.Fatalf("process not in cgroup %s: %s", manager.Path, content)
+	}
+
+	//Destroy杀死残留的进程并删除cgroup
+	if err := manager.Destroy(); err != nil {
+		t.Fatalf("destroy %v", err)
+	}
+	if _, err := os.Stat(path.Join(subsystems.FindCgroupMountpoint(), manager.Path)); !os.IsNotExist(err) {
+		t.Fatalf("cgroup %s should be removed %v", manager.Path, err)
+	}
+}
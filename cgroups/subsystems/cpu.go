@@ -0,0 +1,94 @@
+package subsystems
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"runtime"
+	"strconv"
+)
+
+const (
+	// cpu.max默认的周期100ms
+	defaultCpuPeriod = 100000
+	// 内核允许的周期和配额范围(微秒)
+	minCpuPeriod = 1000
+	maxCpuPeriod = 1000000
+	minCpuQuota  = 1000
+	// cgroup v1的cpu.shares范围，cgroup v2的cpu.weight范围是1到10000
+	minCpuShares = 2
+	maxCpuShares = 262144
+)
+
+// CpuSubSystem cpu subsystem的实现，cgroup v2中cpu.max限制cpu时间，cpu.weight是竞争时的权重
+type CpuSubSystem struct {
+}
+
+// Set 设置cgroupPath对应的cgroup的cpu限制
+func (s *CpuSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	subsysCgroupPath, err := GetCgroupPath(cgroupPath, true)
+	if err != nil {
+		return err
+	}
+	if max := cpuMax(res); max != "" {
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "cpu.max"), []byte(max), 0644); err != nil {
+			return fmt.Errorf("set cgroup cpu.max fail %v", err)
+		}
+	}
+	if res.CpuShare != 0 {
+		weight := strconv.FormatUint(cpuSharesToWeight(res.CpuShare), 10)
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "cpu.weight"), []byte(weight), 0644); err != nil {
+			return fmt.Errorf("set cgroup cpu.weight fail %v", err)
+		}
+	}
+	return nil
+}
+
+// cpuMax cpu.max的内容"配额 周期"，配额为max表示不限制，没有设置cpu限制时返回空
+// --cpus按照周期换算成配额，比如--cpus 1.5在100ms的周期中可以使用150ms
+func cpuMax(res *ResourceConfig) string {
+	if res.NanoCpus == 0 && res.CpuQuota == 0 && res.CpuPeriod == 0 {
+		return ""
+	}
+	period := res.CpuPeriod
+	if period == 0 {
+		period = defaultCpuPeriod
+	}
+	quota := "max"
+	if res.NanoCpus > 0 {
+		quota = strconv.FormatInt(res.NanoCpus*int64(period)/1e9, 10)
+	} else if res.CpuQuota > 0 {
+		quota = strconv.FormatInt(res.CpuQuota, 10)
+	}
+	return fmt.Sprintf("%s %d", quota, period)
+}
+
+// cpuSharesToWeight 和Docker(runc)一样把cgroup v1的shares[2, 262144]线性映射到cgroup v2的weight[1, 10000]
+func cpuSharesToWeight(shares uint64) uint64 {
+	if shares == 0 {
+		return 0
+	}
+	return 1 + ((shares-2)*9999)/262142
+}
+
+func validateCpu(res *ResourceConfig) error {
+	if res.NanoCpus != 0 && (res.CpuQuota != 0 || res.CpuPeriod != 0) {
+		return fmt.Errorf("--cpus and --cpu-quota/--cpu-period can not both be set")
+	}
+	if res.NanoCpus < 0 || res.NanoCpus > int64(runtime.NumCPU())*1e9 {
+		return fmt.Errorf("--cpus should be in the range 0.01 - %d", runtime.NumCPU())
+	}
+	if res.NanoCpus > 0 && res.NanoCpus*defaultCpuPeriod/1e9 < minCpuQuota {
+		return fmt.Errorf("--cpus should be in the range 0.01 - %d", runtime.NumCPU())
+	}
+	if res.CpuPeriod != 0 && (res.CpuPeriod < minCpuPeriod || res.CpuPeriod > maxCpuPeriod) {
+		return fmt.Errorf("--cpu-period should be in the range %d - %d microseconds", minCpuPeriod, maxCpuPeriod)
+	}
+	if res.CpuQuota < -1 || (res.CpuQuota > 0 && res.CpuQuota < minCpuQuota) {
+		return fmt.Errorf("--cpu-quota should be -1 (unlimited) or at least %d microseconds", minCpuQuota)
+	}
+	if res.CpuShare != 0 && (res.CpuShare < minCpuShares || res.CpuShare > maxCpuShares) {
+		return fmt.Errorf("--cpu-shares should be in the range %d - %d", minCpuShares, maxCpuShares)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package subsystems
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// fakeCgroupRoot 用临时目录模拟cgroup2的根，根cgroup中可以开启cpu和memory
+func fakeCgroupRoot(t *testing.T) string {
+	root := t.TempDir()
+	if err := ioutil.WriteFile(path.Join(root, "cgroup.controllers"), []byte("cpu memory\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(root, "cgroup.subtree_control"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	old := cgroupRootPath
+	cgroupRootPath = root
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		cgroupRootPath = old
+		mu.Unlock()
+	})
+	return root
+}
+
+func readCgroupFile(t *testing.T, root, cgroup, file string) string {
+	content, err := ioutil.ReadFile(path.Join(root, cgroup, file))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ""
+		}
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(content))
+}
+
+func TestCpuCgroup(t *testing.T) {
+	cases := []struct {
+		res    ResourceConfig
+		max    string
+		weight string
+	}{
+		{ResourceConfig{NanoCpus: 500000000}, "50000 100000", ""},
+		{ResourceConfig{CpuQuota: 50000, CpuPeriod: 200000}, "50000 200000", ""},
+		{ResourceConfig{CpuQuota: -1}, "max 100000", ""},
+		{ResourceConfig{CpuPeriod: 50000}, "max 50000", ""},
+		{ResourceConfig{CpuShare: 1024}, "", "39"},
+		{ResourceConfig{CpuShare: 2}, "", "1"},
+		{ResourceConfig{CpuShare: 262144}, "", "10000"},
+		{ResourceConfig{MemoryLimit: 100 * 1024 * 1024}, "", ""},
+	}
+	for i, c := range cases {
+		root := fakeCgroupRoot(t)
+		if err := c.res.Validate(); err != nil {
+			t.Fatalf("case %d: validate %v", i, err)
+		}
+		if err := (&CpuSubSystem{}).Set("testcpulimit", &c.res); err != nil {
+			t.Fatalf("case %d: set %v", i, err)
+		}
+		if max := readCgroupFile(t, root, "testcpulimit", "cpu.max"); max != c.max {
+			t.Errorf("case %d: cpu.max %q, want %q", i, max, c.max)
+		}
+		if weight := readCgroupFile(t, root, "testcpulimit", "cpu.weight"); weight != c.weight {
+			t.Errorf("case %d: cpu.weight %q, want %q", i, weight, c.weight)
+		}
+		//父cgroup中开启了controller
+		if enabled := readCgroupFile(t, root, "", "cgroup.subtree_control"); enabled == "" {
+			t.Errorf("case %d: controllers not enabled", i)
+		}
+	}
+}
+
+func TestValidateCpu(t *testing.T) {
+	invalid := []ResourceConfig{
+		{NanoCpus: 1000000000, CpuQuota: 50000},
+		{NanoCpus: 1000000000, CpuPeriod: 50000},
+		{NanoCpus: 1000000},
+		{CpuQuota: 500},
+		{CpuQuota: -2},
+		{CpuPeriod: 999},
+		{CpuPeriod: 1000001},
+		{CpuShare: 1},
+		{CpuShare: 262145},
+	}
+	for _, res := range invalid {
+		if err := res.Validate(); err == nil {
+			t.Errorf("%+v should be invalid", res)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package subsystems
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 内核的NR_CPUS最大是8192，内存节点更少，超过的编号不可能存在，也避免超大的范围展开成巨大的map
+const maxCpuSetIndex = 8192
+
+// CpuSetSubSystem cpuset subsystem的实现，把容器固定在指定的cpu和内存节点上
+type CpuSetSubSystem struct {
+}
+
+// Set 设置cgroupPath对应的cgroup的cpuset.cpus和cpuset.mems
+// 请求的cpu和内存节点必须是父cgroup的cpuset.cpus.effective和cpuset.mems.effective的子集，否则内核会拒绝写入
+func (s *CpuSetSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	if res.CpuSet == "" && res.CpuSetMems == "" {
+		return nil
+	}
+	subsysCgroupPath, err := GetCgroupPath(cgroupPath, true)
+	if err != nil {
+		return err
+	}
+	for _, item := range []struct{ file, value, flag string }{
+		{"cpuset.cpus", res.CpuSet, "--cpuset-cpus"},
+		{"cpuset.mems", res.CpuSetMems, "--cpuset-mems"},
+	} {
+		if item.value == "" {
+			continue
+		}
+		effective, err := ioutil.ReadFile(path.Join(path.Dir(subsysCgroupPath), item.file+".effective"))
+		if err != nil {
+			return fmt.Errorf("read available %s error %v", item.file, err)
+		}
+		if err := checkSubset(item.value, strings.TrimSpace(string(effective))); err != nil {
+			return fmt.Errorf("invalid %s %s: %v", item.flag, item.value, err)
+		}
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, item.file), []byte(item.value), 0644); err != nil {
+			return fmt.Errorf("set cgroup %s fail %v", item.file, err)
+		}
+	}
+	return nil
+}
+
+// parseCpuList 解析0-3,5这样的列表
+func parseCpuList(list string) (map[int]bool, error) {
+	result := map[int]bool{}
+	if list == "" {
+		return result, nil
+	}
+	for _, part := range strings.Split(list, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid list %q", list)
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = strconv.Atoi(bounds[1]); err != nil || end < start {
+				return nil, fmt.Errorf("invalid list %q", list)
+			}
+		}
+		if end >= maxCpuSetIndex {
+			return nil, fmt.Errorf("invalid list %q, %d is larger than the maximum %d", list, end, maxCpuSetIndex-1)
+		}
+		for i := start; i <= end; i++ {
+			result[i] = true
+		}
+	}
+	return result, nil
+}
+
+// checkSubset 请求的列表中不在available中的项返回错误
+func checkSubset(requested, available string) error {
+	want, err := parseCpuList(requested)
+	if err != nil {
+		return err
+	}
+	have, err := parseCpuList(available)
+	if err != nil {
+		return err
+	}
+	var missing []int
+	for i := range want {
+		if !have[i] {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Ints(missing)
+		return fmt.Errorf("%v not available, only %s can be used", missing, available)
+	}
+	return nil
+}
+
+func validateCpuSet(res *ResourceConfig) error {
+	if _, err := parseCpuList(res.CpuSet); err != nil {
+		return fmt.Errorf("--cpuset-cpus: %v", err)
+	}
+	if _, err := parseCpuList(res.CpuSetMems); err != nil {
+		return fmt.Errorf("--cpuset-mems: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package subsystems
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestCpuSetCgroup(t *testing.T) {
+	root := fakeCgroupRoot(t)
+	if err := ioutil.WriteFile(path.Join(root, "cpuset.cpus.effective"), []byte("0-3,6\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(root, "cpuset.mems.effective"), []byte("0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	res := &ResourceConfig{CpuSet: "1-2,6", CpuSetMems: "0"}
+	if err := res.Validate(); err != nil {
+		t.Fatalf("validate %v", err)
+	}
+	if err := (&CpuSetSubSystem{}).Set("testcpuset", res); err != nil {
+		t.Fatalf("set %v", err)
+	}
+	if cpus := readCgroupFile(t, root, "testcpuset", "cpuset.cpus"); cpus != "1-2,6" {
+		t.Errorf("cpuset.cpus %q", cpus)
+	}
+	if mems := readCgroupFile(t, root, "testcpuset", "cpuset.mems"); mems != "0" {
+		t.Errorf("cpuset.mems %q", mems)
+	}
+
+	//父cgroup中没有的cpu和内存节点
+	for _, res := range []*ResourceConfig{{CpuSet: "3-4"}, {CpuSetMems: "1"}} {
+		if err := (&CpuSetSubSystem{}).Set("testcpuset2", res); err == nil {
+			t.Errorf("%+v should not be available", res)
+		}
+	}
+}
+
+func TestValidateCpuSet(t *testing.T) {
+	for _, list := range []string{"a", "1-", "3-1", "-1", "1,,2", "0-2000000000", "8192"} {
+		if err := (&ResourceConfig{CpuSet: list}).Validate(); err == nil {
+			t.Errorf("cpuset %q should be invalid", list)
+		}
+	}
+	for _, list := range []string{"0", "0-3", "0,2,4-7", "8191"} {
+		if err := (&ResourceConfig{CpuSetMems: list}).Validate(); err != nil {
+			t.Errorf("cpuset %q: %v", list, err)
+		}
+	}
+}
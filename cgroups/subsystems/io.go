@@ -0,0 +1,232 @@
+package subsystems
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"mydocker/utils"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// --blkio-weight的范围，和cgroup v1的blkio.weight一致，cgroup v2的io.weight范围是1到10000
+	minBlkioWeight = 10
+	maxBlkioWeight = 1000
+)
+
+// ThrottleDevice 对一个块设备的读写限制，Rate是每秒的字节数或者次数
+type ThrottleDevice struct {
+	Path  string
+	Major uint32
+	Minor uint32
+	Rate  uint64
+}
+
+// IoDeviceStats io.stat中一个设备的读写统计
+type IoDeviceStats struct {
+	Major  uint32 `json:"major"`
+	Minor  uint32 `json:"minor"`
+	RBytes uint64 `json:"rbytes"`
+	WBytes uint64 `json:"wbytes"`
+	RIOs   uint64 `json:"rios"`
+	WIOs   uint64 `json:"wios"`
+}
+
+// IoStats 容器的块设备读写
+type IoStats struct {
+	Devices []IoDeviceStats `json:"devices,omitempty"`
+}
+
+// Total 所有设备读写字节数的总和
+func (s IoStats) Total() (read, write uint64) {
+	for _, device := range s.Devices {
+		read += device.RBytes
+		write += device.WBytes
+	}
+	return read, write
+}
+
+// IoSubSystem io subsystem的实现，io.max限制每个设备的读写速率，io.weight是竞争时的权重
+type IoSubSystem struct {
+}
+
+// Set 设置cgroupPath对应的cgroup的io.weight和io.max
+func (s *IoSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	lines := ioMax(res)
+	if res.BlkioWeight == 0 && len(lines) == 0 {
+		return nil
+	}
+	subsysCgroupPath, err := GetCgroupPath(cgroupPath, true)
+	if err != nil {
+		return err
+	}
+	if res.BlkioWeight != 0 {
+		weight := "default " + strconv.FormatUint(blkioWeightToIoWeight(res.BlkioWeight), 10)
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "io.weight"), []byte(weight), 0644); err != nil {
+			return fmt.Errorf("set cgroup io.weight fail %v", err)
+		}
+	}
+	//内核每次写入只解析一个设备
+	for _, line := range lines {
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "io.max"), []byte(line), 0644); err != nil {
+			return fmt.Errorf("set cgroup io.max %q fail %v", line, err)
+		}
+	}
+	return nil
+}
+
+// GetStats 读取io.stat，每行是 major:minor rbytes=... wbytes=... rios=... wios=... dbytes=... dios=...
+func (s *IoSubSystem) GetStats(cgroupPath string, stats *Stats) error {
+	subsysCgroupPath, err := GetCgroupPath(cgroupPath, false)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(path.Join(subsysCgroupPath, "io.stat"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var device IoDeviceStats
+		if _, err := fmt.Sscanf(fields[0], "%d:%d", &device.Major, &device.Minor); err != nil {
+			return fmt.Errorf("parse io.stat device %q error %v", fields[0], err)
+		}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			value, err := strconv.ParseUint(kv[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("parse io.stat %q error %v", field, err)
+			}
+			switch kv[0] {
+			case "rbytes":
+				device.RBytes = value
+			case "wbytes":
+				device.WBytes = value
+			case "rios":
+				device.RIOs = value
+			case "wios":
+				device.WIOs = value
+			}
+		}
+		stats.Io.Devices = append(stats.Io.Devices, device)
+	}
+	return nil
+}
+
+// ioMax 把同一个设备的限制合并成io.max的一行，例如 8:0 rbps=1048576 wiops=100
+func ioMax(res *ResourceConfig) []string {
+	limits := map[string][]string{}
+	var devices []string
+	for _, item := range []struct {
+		key     string
+		devices []ThrottleDevice
+	}{
+		{"rbps", res.DeviceReadBps},
+		{"wbps", res.DeviceWriteBps},
+		{"riops", res.DeviceReadIOps},
+		{"wiops", res.DeviceWriteIOps},
+	} {
+		for _, device := range item.devices {
+			dev := fmt.Sprintf("%d:%d", device.Major, device.Minor)
+			if _, ok := limits[dev]; !ok {
+				devices = append(devices, dev)
+			}
+			limits[dev] = append(limits[dev], fmt.Sprintf("%s=%d", item.key, device.Rate))
+		}
+	}
+	sort.Strings(devices)
+	var lines []string
+	for _, dev := range devices {
+		lines = append(lines, dev+" "+strings.Join(limits[dev], " "))
+	}
+	return lines
+}
+
+// blkioWeightToIoWeight 把10到1000的blkio权重线性映射到1到10000的io.weight
+func blkioWeightToIoWeight(weight uint16) uint64 {
+	return 1 + (uint64(weight)-minBlkioWeight)*9999/(maxBlkioWeight-minBlkioWeight)
+}
+
+// ParseThrottleDevice 解析--device-read-bps这类参数: device-path:rate
+// size为true时rate是每秒的字节数，可以带单位，例如 /dev/sda:1mb，否则是每秒的次数
+func ParseThrottleDevice(spec string, size bool) (ThrottleDevice, error) {
+	i := strings.LastIndex(spec, ":")
+	if i <= 0 {
+		return ThrottleDevice{}, fmt.Errorf("invalid device rate %q, should be device-path:rate", spec)
+	}
+	device := ThrottleDevice{Path: spec[:i]}
+	value := spec[i+1:]
+	if size {
+		rate, err := utils.ParseSize(value)
+		if err != nil {
+			return ThrottleDevice{}, fmt.Errorf("invalid rate in %q: %v", spec, err)
+		}
+		device.Rate = uint64(rate)
+	} else {
+		rate, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return ThrottleDevice{}, fmt.Errorf("invalid rate in %q, should be a number of operations per second", spec)
+		}
+		device.Rate = rate
+	}
+	if device.Rate == 0 {
+		return ThrottleDevice{}, fmt.Errorf("invalid rate in %q, should be greater than 0", spec)
+	}
+	var err error
+	if device.Major, device.Minor, err = blockDevice(device.Path); err != nil {
+		return ThrottleDevice{}, err
+	}
+	return device, nil
+}
+
+// blockDevice 取得块设备的major:minor，分区换成所在的磁盘，io.max只接受整个磁盘
+func blockDevice(devicePath string) (uint32, uint32, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(devicePath, &st); err != nil {
+		return 0, 0, fmt.Errorf("stat device %s error %v", devicePath, err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return 0, 0, fmt.Errorf("%s is not a block device", devicePath)
+	}
+	major, minor := unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))
+	sysPath, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", major, minor))
+	if err != nil {
+		return major, minor, nil
+	}
+	if _, err := os.Stat(path.Join(sysPath, "partition")); err != nil {
+		return major, minor, nil
+	}
+	//分区在sysfs中的上一级目录是它所在的磁盘
+	disk, err := ioutil.ReadFile(path.Join(path.Dir(sysPath), "dev"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("find disk of partition %s error %v", devicePath, err)
+	}
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(disk)), "%d:%d", &major, &minor); err != nil {
+		return 0, 0, fmt.Errorf("parse disk of partition %s error %v", devicePath, err)
+	}
+	return major, minor, nil
+}
+
+func validateIo(res *ResourceConfig) error {
+	if res.BlkioWeight != 0 && (res.BlkioWeight < minBlkioWeight || res.BlkioWeight > maxBlkioWeight) {
+		return fmt.Errorf("--blkio-weight should be in range [%d, %d]", minBlkioWeight, maxBlkioWeight)
+	}
+	return nil
+}
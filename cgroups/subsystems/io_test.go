@@ -0,0 +1,54 @@
+package subsystems
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestIoCgroup(t *testing.T) {
+	root := fakeCgroupRoot(t)
+	res := &ResourceConfig{
+		BlkioWeight:     500,
+		DeviceReadBps:   []ThrottleDevice{{Major: 8, Minor: 0, Rate: 1048576}},
+		DeviceWriteIOps: []ThrottleDevice{{Major: 8, Minor: 0, Rate: 100}, {Major: 8, Minor: 16, Rate: 50}},
+	}
+	if err := (&IoSubSystem{}).Set("testio", res); err != nil {
+		t.Fatalf("set %v", err)
+	}
+	if weight := readCgroupFile(t, root, "testio", "io.weight"); weight != "default 4950" {
+		t.Errorf("io.weight %q", weight)
+	}
+	//假的cgroupfs中每次写入会覆盖，只剩下最后一个设备
+	if max := readCgroupFile(t, root, "testio", "io.max"); max != "8:16 wiops=50" {
+		t.Errorf("io.max %q", max)
+	}
+	lines := ioMax(res)
+	if len(lines) != 2 || lines[0] != "8:0 rbps=1048576 wiops=100" || lines[1] != "8:16 wiops=50" {
+		t.Errorf("io.max lines %q", lines)
+	}
+
+	stat := "8:0 rbytes=4096 wbytes=8192 rios=1 wios=2 dbytes=0 dios=0\n8:16 rbytes=100 wbytes=0 rios=3 wios=0 dbytes=0 dios=0\n"
+	if err := ioutil.WriteFile(path.Join(root, "testio", "io.stat"), []byte(stat), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stats := &Stats{}
+	if err := (&IoSubSystem{}).GetStats("testio", stats); err != nil {
+		t.Fatalf("get stats %v", err)
+	}
+	if len(stats.Io.Devices) != 2 || stats.Io.Devices[0] != (IoDeviceStats{Major: 8, Minor: 0, RBytes: 4096, WBytes: 8192, RIOs: 1, WIOs: 2}) {
+		t.Errorf("io stats %+v", stats.Io)
+	}
+	if read, write := stats.Io.Total(); read != 4196 || write != 8192 {
+		t.Errorf("total %d %d", read, write)
+	}
+
+	if err := (&ResourceConfig{BlkioWeight: 5}).Validate(); err == nil {
+		t.Errorf("--blkio-weight 5 should be invalid")
+	}
+	for _, spec := range []string{"/dev/null:1mb", "/dev/sda", "/dev/sda:0"} {
+		if _, err := ParseThrottleDevice(spec, true); err == nil {
+			t.Errorf("%s should be invalid", spec)
+		}
+	}
+}
@@ -2,12 +2,16 @@ package subsystems
 
 import (
 	"fmt"
+	"github.com/sirupsen/logrus"
 	"io/ioutil"
 	"os"
 	"path"
 	"strconv"
 )
 
+// 和docker一样，内存限制至少为6MB
+const minMemory = 6 * 1024 * 1024
+
 // MemorySubSystem  memory subsystem的实现
 type MemorySubSystem struct {
 }
@@ -15,40 +19,86 @@ type MemorySubSystem struct {
 // Set 设置cgroupPath对应的cgroup的内存资源限制
 func (s *MemorySubSystem) Set(cgroupPath string, res *ResourceConfig) error {
 	//GetCgroupPath 的作用是获取当前subsystem在虚拟文件系统中的路径，GetCgroupPath这个函数在下面会介绍。
-	if subsysCgroupPath, err := GetCgroupPath(cgroupPath, true); err == nil {
-		if res.MemoryLimit != "" {
-			//设置这个cgroup的内存限制，即将限制写入到cgroup对应目录的” memory.limit_in_bytes,新版本是memory.max文件中。
-			if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "memory.max"), []byte(res.MemoryLimit), 0644); err != nil {
-				return fmt.Errorf("set cgroup memory fail %v", err)
+	subsysCgroupPath, err := GetCgroupPath(cgroupPath, true)
+	if err != nil {
+		return err
+	}
+	if res.MemoryLimit > 0 {
+		//设置这个cgroup的内存限制，即将限制写入到cgroup对应目录的” memory.limit_in_bytes,新版本是memory.max文件中。
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "memory.max"), []byte(strconv.FormatInt(res.MemoryLimit, 10)), 0644); err != nil {
+			return fmt.Errorf("set cgroup memory fail %v", err)
+		}
+	}
+	if swap := memorySwapMax(res); swap != "" {
+		//内核没有开启swap的统计时没有这个文件，和docker一样只限制内存，只有指定了--memory-swap时才警告
+		if _, err := os.Stat(path.Join(subsysCgroupPath, "memory.swap.max")); os.IsNotExist(err) {
+			if res.MemorySwap != 0 {
+				logrus.Warnf("Your kernel does not support swap limit, memory limited without swap")
 			}
+		} else if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "memory.swap.max"), []byte(swap), 0644); err != nil {
+			return fmt.Errorf("set cgroup memory.swap.max fail %v", err)
 		}
-		return nil
-	} else {
-		return err
 	}
+	if res.MemoryReservation > 0 {
+		//软限制：超过memory.high之后内核优先回收容器的内存并限制它分配内存的速度，但不会触发OOM；
+		//memory.low保证宿主机内存紧张时容器至少保留这么多内存
+		reservation := []byte(strconv.FormatInt(res.MemoryReservation, 10))
+		for _, file := range []string{"memory.high", "memory.low"} {
+			if err := ioutil.WriteFile(path.Join(subsysCgroupPath, file), reservation, 0644); err != nil {
+				return fmt.Errorf("set cgroup %s fail %v", file, err)
+			}
+		}
+	}
+	return nil
 }
 
-// Remove 删除cgroupPath对应的cgroup
-func (s *MemorySubSystem) Remove(cgroupPath string) error {
-	if subsysCgroupPath, err := GetCgroupPath(cgroupPath, false); err == nil {
-		//删除cgroup便是删除对应的cgroupPath的目录
-		return os.Remove(subsysCgroupPath)
-	} else {
-		return err
+// memorySwapMax --memory-swap是内存加swap的总量，memory.swap.max只是swap的部分，-1表示不限制
+// 和docker一样，只指定了内存限制时swap和内存一样多，也就是总量是内存限制的两倍
+func memorySwapMax(res *ResourceConfig) string {
+	switch {
+	case res.MemorySwap == -1:
+		return "max"
+	case res.MemorySwap > 0:
+		return strconv.FormatInt(res.MemorySwap-res.MemoryLimit, 10)
+	case res.MemoryLimit > 0:
+		return strconv.FormatInt(res.MemoryLimit, 10)
 	}
+	return ""
 }
 
-// Apply 将一个进程假如到cgroupPath对应的cgroup中
-func (s *MemorySubSystem) Apply(cgroupPath string, pid int) error {
-	if subsysCgroupPath, err := GetCgroupPath(cgroupPath, false); err == nil {
-		//把进程的PID写到cgroup的虚拟文件系统对应目录下的"task"文件中，新版本是cgroup.procs
-		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
-			return fmt.Errorf("set cgroup proc fail %v", err)
-		}
-		return nil
-	} else {
-		return fmt.Errorf("get cgroup %s error :%v", cgroupPath, err)
+func validateMemory(res *ResourceConfig) error {
+	if res.MemoryLimit < 0 || (res.MemoryLimit > 0 && res.MemoryLimit < minMemory) {
+		return fmt.Errorf("minimum memory limit allowed is 6MB")
+	}
+	if res.MemorySwap < -1 {
+		return fmt.Errorf("--memory-swap should be a size or -1 for unlimited")
+	}
+	if res.MemorySwap != 0 && res.MemoryLimit == 0 {
+		return fmt.Errorf("you should always set the memory limit when using --memory-swap")
+	}
+	if res.MemorySwap > 0 && res.MemorySwap < res.MemoryLimit {
+		return fmt.Errorf("--memory-swap should be larger than or equal to the memory limit, it is the total of memory and swap")
+	}
+	if res.MemoryReservation < 0 || (res.MemoryReservation > 0 && res.MemoryReservation < minMemory) {
+		return fmt.Errorf("minimum memory reservation allowed is 6MB")
+	}
+	if res.MemoryLimit > 0 && res.MemoryReservation > res.MemoryLimit {
+		return fmt.Errorf("--memory-reservation should be smaller than the memory limit")
+	}
+	//cgroup v2没有memory.oom_control，内存不足时总会有进程被杀死，不能假装关闭了OOM killer
+	if res.OomKillDisable {
+		return fmt.Errorf("--oom-kill-disable is not supported on cgroup v2, the OOM killer can not be disabled")
+	}
+	return nil
+}
+
+// memoryWarnings 能够设置但可能和预期不一致的组合
+func memoryWarnings(res *ResourceConfig) []string {
+	var warnings []string
+	if res.KernelMemory != 0 {
+		warnings = append(warnings, "--kernel-memory is ignored, cgroup v2 counts kernel memory in the memory limit")
 	}
+	return warnings
 }
 
 //// cgroupV2已经不需要了 因为在cgroupV2中，cgroup的目录结构发生了改变meory，cpu等在同一文件下
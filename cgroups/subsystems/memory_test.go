@@ -1,15 +1,39 @@
 package subsystems
 
 import (
+	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"testing"
 )
 
+// requireController 真实的cgroupfs中需要root权限并且根cgroup启用了controller，否则跳过测试
+func requireController(t *testing.T, controller string) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	mountpoint := FindCgroupMountpoint()
+	if mountpoint == "" {
+		t.Skip("requires cgroup v2")
+	}
+	controllers, err := ioutil.ReadFile(path.Join(mountpoint, "cgroup.controllers"))
+	if err != nil {
+		t.Skipf("read cgroup.controllers %v", err)
+	}
+	for _, name := range strings.Fields(string(controllers)) {
+		if name == controller {
+			return
+		}
+	}
+	t.Skipf("%s controller is not available in %s", controller, mountpoint)
+}
+
 func TestMemoryCgroup(t *testing.T) {
+	requireController(t, "memory")
 	memSubSys := MemorySubSystem{}
 	resConfig := ResourceConfig{
-		MemoryLimit: "1000m",
+		MemoryLimit: 1000 * 1024 * 1024,
 	}
 	testCgroup := "testmemlimit"
 
@@ -19,15 +43,76 @@ func TestMemoryCgroup(t *testing.T) {
 	stat, _ := os.Stat(path.Join(FindCgroupMountpoint(), testCgroup))
 	t.Logf("cgroup stats: %+v", stat)
 
-	if err := memSubSys.Apply(testCgroup, os.Getpid()); err != nil {
-		t.Fatalf("cgroup Apply %v", err)
+	//加入进程由CgroupManager完成，这里只检查限制，然后删除cgroup
+	if err := os.Remove(path.Join(FindCgroupMountpoint(), testCgroup)); err != nil {
+		t.Fatalf("cgroup remove %v", err)
+	}
+}
+
+func TestMemoryLimits(t *testing.T) {
+	cases := []struct {
+		res                    ResourceConfig
+		max, swap, reservation string
+	}{
+		//只指定内存限制时和docker一样，swap和内存一样多
+		{ResourceConfig{MemoryLimit: 1 << 30}, "1073741824", "1073741824", ""},
+		{ResourceConfig{MemoryLimit: 1 << 30, MemorySwap: 3 << 30}, "1073741824", "2147483648", ""},
+		{ResourceConfig{MemoryLimit: 1 << 30, MemorySwap: 1 << 30}, "1073741824", "0", ""},
+		{ResourceConfig{MemoryLimit: 1 << 30, MemorySwap: -1}, "1073741824", "max", ""},
+		{ResourceConfig{MemoryLimit: 1 << 30, MemoryReservation: 512 << 20}, "1073741824", "1073741824", "536870912"},
+		{ResourceConfig{MemoryReservation: 512 << 20}, "", "", "536870912"},
+		{ResourceConfig{}, "", "", ""},
 	}
-	//将进程移回到根Cgroup节点
-	if err := memSubSys.Apply("", os.Getpid()); err != nil {
-		t.Fatalf("cgroup Apply %v", err)
+	for i, c := range cases {
+		root := fakeCgroupRoot(t)
+		if err := c.res.Validate(); err != nil {
+			t.Fatalf("case %d: validate %v", i, err)
+		}
+		//内核开启了swap统计时才有memory.swap.max
+		if err := os.MkdirAll(path.Join(root, "testmem"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(root, "testmem", "memory.swap.max"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := (&MemorySubSystem{}).Set("testmem", &c.res); err != nil {
+			t.Fatalf("case %d: set %v", i, err)
+		}
+		for file, want := range map[string]string{"memory.max": c.max, "memory.swap.max": c.swap, "memory.high": c.reservation, "memory.low": c.reservation} {
+			if got := readCgroupFile(t, root, "testmem", file); got != want {
+				t.Errorf("case %d: %s %q, want %q", i, file, got, want)
+			}
+		}
 	}
 
-	if err := memSubSys.Remove(testCgroup); err != nil {
-		t.Fatalf("cgroup remove %v", err)
+	//内核没有开启swap统计时不写memory.swap.max
+	root := fakeCgroupRoot(t)
+	if err := (&MemorySubSystem{}).Set("testmem", &ResourceConfig{MemoryLimit: 1 << 30}); err != nil {
+		t.Fatalf("set without swap accounting %v", err)
+	}
+	if swap := readCgroupFile(t, root, "testmem", "memory.swap.max"); swap != "" {
+		t.Errorf("memory.swap.max %q", swap)
+	}
+}
+
+func TestMemoryValidate(t *testing.T) {
+	invalid := []ResourceConfig{
+		{MemoryLimit: 1 << 20},
+		{MemorySwap: 1 << 30},
+		{MemorySwap: -1},
+		{MemoryLimit: 1 << 30, MemorySwap: 512 << 20},
+		{MemoryLimit: 1 << 30, MemorySwap: -2},
+		{MemoryLimit: 512 << 20, MemoryReservation: 1 << 30},
+		{MemoryReservation: 1 << 20},
+		{MemoryLimit: 1 << 30, OomKillDisable: true},
+	}
+	for i, res := range invalid {
+		if err := res.Validate(); err == nil {
+			t.Errorf("invalid case %d: %+v should be rejected", i, res)
+		}
+	}
+
+	if warnings := (&ResourceConfig{KernelMemory: 1 << 20}).Warnings(); len(warnings) != 1 {
+		t.Errorf("warnings %q", warnings)
 	}
 }
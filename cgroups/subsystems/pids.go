@@ -0,0 +1,111 @@
+package subsystems
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// PidsStats 容器中的进程数
+type PidsStats struct {
+	Current uint64 `json:"current"`
+	Limit   uint64 `json:"limit,omitempty"` //0表示不限制
+	// MaxEvents pids.events中的max，因为达到限制而fork失败的次数
+	MaxEvents uint64 `json:"max_events"`
+}
+
+// PidsSubSystem pids subsystem的实现，限制cgroup中的进程数，防止fork炸弹耗尽宿主机的pid
+type PidsSubSystem struct {
+}
+
+// Set 设置cgroupPath对应的cgroup的pids.max，-1表示不限制
+func (s *PidsSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	if res.PidsLimit == 0 {
+		return nil
+	}
+	subsysCgroupPath, err := GetCgroupPath(cgroupPath, true)
+	if err != nil {
+		return err
+	}
+	limit := "max"
+	if res.PidsLimit > 0 {
+		limit = strconv.FormatInt(res.PidsLimit, 10)
+	}
+	if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "pids.max"), []byte(limit), 0644); err != nil {
+		return fmt.Errorf("set cgroup pids.max fail %v", err)
+	}
+	return nil
+}
+
+// GetStats 读取pids.current、pids.max和pids.events，没有开启pids controller时文件不存在，保持为0
+func (s *PidsSubSystem) GetStats(cgroupPath string, stats *Stats) error {
+	subsysCgroupPath, err := GetCgroupPath(cgroupPath, false)
+	if err != nil {
+		return err
+	}
+	if stats.Pids.Current, err = readUint(path.Join(subsysCgroupPath, "pids.current")); err != nil {
+		return err
+	}
+	if stats.Pids.Limit, err = readUint(path.Join(subsysCgroupPath, "pids.max")); err != nil {
+		return err
+	}
+	events, err := readKeyValues(path.Join(subsysCgroupPath, "pids.events"))
+	if err != nil {
+		return err
+	}
+	stats.Pids.MaxEvents = events["max"]
+	return nil
+}
+
+// readUint 读取只有一个数字的接口文件，max读成0，文件不存在时返回0
+func readUint(file string) (uint64, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	value := strings.TrimSpace(string(content))
+	if value == "max" {
+		return 0, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// readKeyValues 读取每行是"key value"的接口文件，比如pids.events、memory.events，文件不存在时返回空
+func readKeyValues(file string) (map[string]uint64, error) {
+	result := map[string]uint64{}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s error %v", file, err)
+		}
+		result[fields[0]] = value
+	}
+	return result, nil
+}
+
+func validatePids(res *ResourceConfig) error {
+	if res.PidsLimit < -1 {
+		return fmt.Errorf("--pids-limit should be -1 (unlimited) or a positive number")
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package subsystems
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestPidsCgroup(t *testing.T) {
+	root := fakeCgroupRoot(t)
+	if err := (&PidsSubSystem{}).Set("testpids", &ResourceConfig{PidsLimit: 100}); err != nil {
+		t.Fatalf("set %v", err)
+	}
+	if max := readCgroupFile(t, root, "testpids", "pids.max"); max != "100" {
+		t.Errorf("pids.max %q", max)
+	}
+	if err := (&PidsSubSystem{}).Set("testpids", &ResourceConfig{PidsLimit: -1}); err != nil {
+		t.Fatalf("set %v", err)
+	}
+	if max := readCgroupFile(t, root, "testpids", "pids.max"); max != "max" {
+		t.Errorf("pids.max %q", max)
+	}
+
+	//模拟内核的统计文件
+	files := map[string]string{
+		"pids.current": "7\n",
+		"pids.max":     "100\n",
+		"pids.events":  "max 3\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(root, "testpids", name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := &Stats{}
+	if err := (&PidsSubSystem{}).GetStats("testpids", stats); err != nil {
+		t.Fatalf("get stats %v", err)
+	}
+	if stats.Pids != (PidsStats{Current: 7, Limit: 100, MaxEvents: 3}) {
+		t.Errorf("pids stats %+v", stats.Pids)
+	}
+
+	if err := (&ResourceConfig{PidsLimit: -2}).Validate(); err == nil {
+		t.Errorf("--pids-limit -2 should be invalid")
+	}
+}
@@ -2,29 +2,77 @@ package subsystems
 
 // ResourceConfig 用于传递资源限制配置的结构体，包含内存限制，cpu时间片权重，cpu核心数
 type ResourceConfig struct {
-	MemoryLimit string
-	CpuShare    string
-	CpuSet      string
+	MemoryLimit       int64  //-m 内存限制(字节)
+	MemorySwap        int64  //--memory-swap 内存加swap的总量，-1表示不限制swap
+	MemoryReservation int64  //--memory-reservation 内存紧张时尽量保留的内存
+	KernelMemory      int64  //--kernel-memory cgroup v2中没有单独的限制，只给出警告
+	OomKillDisable    bool   //--oom-kill-disable cgroup v2不能关闭OOM killer，指定时拒绝运行
+	CpuShare          uint64 //--cpu-shares cgroup v1的相对权重，转换成cpu.weight
+	CpuSet            string //--cpuset-cpus 可以使用的cpu，比如0-3,5
+	CpuSetMems        string //--cpuset-mems 可以使用的内存节点
+	CpuQuota          int64  //--cpu-quota 每个周期内可以使用的cpu时间(微秒)，0和-1表示不限制
+	CpuPeriod         uint64 //--cpu-period cpu.max的周期(微秒)
+	NanoCpus          int64  //--cpus 可以使用的cpu数乘以10^9
+	PidsLimit         int64  //--pids-limit 最多的进程数，-1表示不限制
+	BlkioWeight       uint16 //--blkio-weight 块设备读写的相对权重，转换成io.weight
+	// --device-read-bps等 每个块设备每秒最多读写的字节数和次数
+	DeviceReadBps   []ThrottleDevice
+	DeviceWriteBps  []ThrottleDevice
+	DeviceReadIOps  []ThrottleDevice
+	DeviceWriteIOps []ThrottleDevice
 }
 
-// Subsystem ，每个Subsystem可以实现下面的4个接口
+// Stats 从cgroup的接口文件中读取的资源使用情况
+type Stats struct {
+	Pids PidsStats `json:"pids"`
+	Io   IoStats   `json:"io"`
+}
+
+// Validate 在创建容器之前检查资源限制，避免容器启动之后才发现限制无法设置
+func (res *ResourceConfig) Validate() error {
+	if err := validateMemory(res); err != nil {
+		return err
+	}
+	if err := validateCpu(res); err != nil {
+		return err
+	}
+	if err := validateCpuSet(res); err != nil {
+		return err
+	}
+	if err := validatePids(res); err != nil {
+		return err
+	}
+	return validateIo(res)
+}
+
+// Warnings 不会导致失败、但是效果可能和预期不同的设置
+func (res *ResourceConfig) Warnings() []string {
+	return memoryWarnings(res)
+}
+
+// Subsystem ，每个Subsystem设置自己的资源限制
 // 这里将cgroup抽象成了path，原因是cgroup在hierarchy的路径，便是虚拟文件系统中的虚拟路径
+// cgroup v2中所有subsystem共用同一个目录，加入进程和删除cgroup由CgroupManager统一完成
 type Subsystem interface {
 	// Name 返回subsystem的名字，比如cpu，memory
 	//Name() string
 	// Set 设置某个cgroup在这个subsystem中的资源限制
 	Set(path string, res *ResourceConfig) error
-	// Apply 将进程添加到某个cgroup中
-	Apply(path string, pid int) error
-	// Remove 移除某个cgroup
-	Remove(path string) error
+}
+
+// StatsReader 能够读取资源使用情况的subsystem
+type StatsReader interface {
+	// GetStats 把cgroup中这个subsystem的使用情况填到stats中
+	GetStats(path string, stats *Stats) error
 }
 
 // SubsystemsIns 通过不同的subsystem初始化实例创建资源限制处理链数组
 var (
 	SubsystemsIns = []Subsystem{
-		//&CpuSetSubsystem{},
+		&CpuSetSubSystem{},
 		&MemorySubSystem{},
-		//&CpuSubsystem{},
+		&CpuSubSystem{},
+		&PidsSubSystem{},
+		&IoSubSystem{},
 	}
 )
@@ -3,6 +3,8 @@ package subsystems
 import (
 	"bufio"
 	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
 	"os"
 	"path"
 	"strings"
@@ -56,19 +58,61 @@ func FindCgroupMountpoint() string {
 	return ""
 }
 
-// GetCgroupPath 得到cgroup在文件系统中的绝对路径
+// GetCgroupPath 得到cgroup在文件系统中的绝对路径，autoCreate时逐级创建不存在的cgroup
 func GetCgroupPath(cgroupPath string, autoCreate bool) (string, error) {
 	cgroupRoot := FindCgroupMountpoint() // 获取cgroup挂载点 不用获取单个了
-	if _, err := os.Stat(path.Join(cgroupRoot, cgroupPath)); err == nil || (autoCreate && os.IsNotExist(err)) {
-		if os.IsNotExist(err) {
-			if err := os.Mkdir(path.Join(cgroupRoot, cgroupPath), 0755); err == nil {
+	absPath := path.Join(cgroupRoot, cgroupPath)
+	_, err := os.Stat(absPath)
+	if err == nil {
+		return absPath, nil
+	}
+	if !autoCreate || !os.IsNotExist(err) {
+		return "", fmt.Errorf("cgroup path error %v", err)
+	}
+	if err := createCgroup(cgroupRoot, cgroupPath); err != nil {
+		return "", fmt.Errorf("error create cgroup %v", err)
+	}
+	return absPath, nil
+}
 
-			} else {
-				return "", fmt.Errorf("error create cgroup %v", err)
-			}
+// createCgroup 从根cgroup开始逐级创建，cgroup v2中父cgroup的cgroup.subtree_control开启了controller，
+// 子cgroup中才会有memory.max这些接口文件
+func createCgroup(cgroupRoot, cgroupPath string) error {
+	current := cgroupRoot
+	for _, name := range strings.Split(strings.Trim(cgroupPath, "/"), "/") {
+		if err := enableControllers(current); err != nil {
+			return err
+		}
+		current = path.Join(current, name)
+		if err := os.Mkdir(current, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// enableControllers 在cgroup.subtree_control中开启cgroup.controllers里所有可用的controller
+func enableControllers(cgroupPath string) error {
+	available, err := ioutil.ReadFile(path.Join(cgroupPath, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	enabled, err := ioutil.ReadFile(path.Join(cgroupPath, "cgroup.subtree_control"))
+	if err != nil {
+		return err
+	}
+	enabledSet := map[string]bool{}
+	for _, controller := range strings.Fields(string(enabled)) {
+		enabledSet[controller] = true
+	}
+	for _, controller := range strings.Fields(string(available)) {
+		if enabledSet[controller] {
+			continue
+		}
+		//有进程的非根cgroup不能开启controller，这时只是对应的限制无法设置
+		if err := ioutil.WriteFile(path.Join(cgroupPath, "cgroup.subtree_control"), []byte("+"+controller), 0644); err != nil {
+			logrus.Warnf("Enable controller %s in %s error %v", controller, cgroupPath, err)
 		}
-		return path.Join(cgroupRoot, cgroupPath), nil
-	} else {
-		return "", fmt.Errorf("cgroup path error %v", err)
 	}
+	return nil
 }
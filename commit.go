@@ -1,18 +1,92 @@
 package main
 
 import (
+	"fmt"
 	"github.com/sirupsen/logrus"
+	"mydocker/cgroups"
 	"mydocker/container"
-	"os/exec"
+	"mydocker/image"
+	"time"
 )
 
-func CommitContainer(containerName, imageName string) {
-	//mntURL := "/root/mnt"
-	//imageTar := "/root/" + imageName + ".tar"
-	//fmt.Printf("%s", imageTar)
-	mntURL := container.GetMerge(containerName)
-	imageTar := container.GetImage(imageName)
-	if _, err := exec.Command("tar", "-czf", imageTar, "-C", mntURL, ".").CombinedOutput(); err != nil {
-		logrus.Errorf("Tar folder %s error %v", mntURL, err)
+// CommitOptions commit时写入新镜像的元数据
+type CommitOptions struct {
+	Author  string   //作者
+	Message string   //提交说明
+	Changes []string //对镜像配置的修改，例如 CMD ["sh"]
+	Pause   bool     //打包期间冻结容器
+}
+
+// CommitContainer 只把容器的可写层(upper)打包成新的镜像层，叠加在容器所用镜像的各层之上
+func CommitContainer(containerName, imageName string, opts *CommitOptions) error {
+	containerInfo, err := getContainerInfoByName(containerName)
+	if err != nil {
+		return fmt.Errorf("get container info by name %s error %v", containerName, err)
+	}
+	//优先使用创建容器时记录的镜像摘要，镜像名可能已经指向了其他镜像
+	parentRef := containerInfo.ImageDigest
+	if parentRef == "" {
+		parentRef = containerInfo.Image
+	}
+	if parentRef == "" {
+		return fmt.Errorf("container %s has no image recorded, can not commit", containerName)
+	}
+	storeLock, err := image.LockStore(false)
+	if err != nil {
+		return err
+	}
+	defer storeLock.Unlock()
+	parent, err := image.Get(parentRef)
+	if err != nil {
+		return fmt.Errorf("get parent image %s error %v", parentRef, err)
+	}
+
+	//在父镜像配置的基础上应用--change
+	config := parent.Config
+	for _, change := range opts.Changes {
+		if err := image.ApplyChange(&config.Config, change); err != nil {
+			return fmt.Errorf("apply change %q error %v", change, err)
+		}
+	}
+
+	//冻结容器的cgroup，保证打包时可写层不会被修改
+	//旧版本的容器共用一个cgroup(更早的版本没有记录cgroup)，冻结它会同时冻结其他容器，只能不暂停直接提交
+	sharedCgroup := containerInfo.CgroupPath == "" || containerInfo.CgroupPath == cgroups.LegacyCgroupPath
+	if opts.Pause && containerInfo.Status == container.RUNNING && sharedCgroup {
+		logrus.Warnf("Container %s shares cgroup %s with other containers, commit without pausing it", containerName, cgroups.LegacyCgroupPath)
+	} else if opts.Pause && containerInfo.Status == container.RUNNING {
+		cgroupManager := cgroups.NewCgroupManager(containerInfo.CgroupPath)
+		if err := cgroupManager.Freeze(); err != nil {
+			return fmt.Errorf("pause container %s error %v", containerName, err)
+		}
+		defer func() {
+			if err := cgroupManager.Thaw(); err != nil {
+				logrus.Errorf("unpause container %s error %v", containerName, err)
+			}
+		}()
+	}
+
+	layer, diffID, err := container.LookupSnapshotter(containerName).Commit(containerName)
+	if err != nil {
+		return fmt.Errorf("create layer of container %s error %v", containerName, err)
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	config.Created = now
+	config.Author = opts.Author
+	config.RootFS.DiffIDs = append(append([]string{}, parent.Config.RootFS.DiffIDs...), diffID)
+	config.History = append(append([]image.History{}, parent.Config.History...), image.History{
+		Created:   now,
+		CreatedBy: "mydocker commit " + containerName,
+		Author:    opts.Author,
+		Comment:   opts.Message,
+	})
+	layers := append(append([]image.Descriptor{}, parent.Manifest.Layers...), layer)
+
+	img, err := image.Save(imageName, &config, layers)
+	if err != nil {
+		return fmt.Errorf("save image %s error %v", imageName, err)
 	}
+	fmt.Println(img.ID())
+	return nil
 }
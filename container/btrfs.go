@@ -0,0 +1,253 @@
+package container
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"mydocker/image"
+	"mydocker/utils"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// btrfs存储驱动的根目录，必须位于btrfs文件系统上
+var BtrfsRootPath = "/var/lib/mydocker/btrfs/"
+
+const (
+	btrfsSuperMagic = 0x9123683e
+	// linux/btrfs.h 中的ioctl，不依赖btrfs-progs
+	btrfsIocSubvolCreate   = 0x5000940e // _IOW(0x94, 14, struct btrfs_ioctl_vol_args)
+	btrfsIocSnapDestroy    = 0x5000940f // _IOW(0x94, 15, struct btrfs_ioctl_vol_args)
+	btrfsIocSnapCreateV2   = 0x50009417 // _IOW(0x94, 23, struct btrfs_ioctl_vol_args_v2)
+	btrfsIocSubvolSetFlags = 0x4008941a // _IOW(0x94, 26, __u64)
+	btrfsSubvolRdonly      = 1 << 1
+	btrfsPathNameMax       = 4087
+	btrfsSubvolNameMax     = 4039
+)
+
+// btrfs_ioctl_vol_args
+type btrfsVolArgs struct {
+	fd   int64
+	name [btrfsPathNameMax + 1]byte
+}
+
+// btrfs_ioctl_vol_args_v2
+type btrfsVolArgsV2 struct {
+	fd      int64
+	transid uint64
+	flags   uint64
+	unused  [4]uint64
+	name    [btrfsSubvolNameMax + 1]byte
+}
+
+// btrfs 每个镜像层对应一个只读的子卷，上一层的子卷做快照后应用这一层的修改得到这一层的子卷，
+// 容器的根文件系统是最上层子卷的可写快照，创建容器和提交都不需要复制文件
+type btrfs struct{}
+
+func btrfsLayerPath(chainID string) string {
+	return path.Join(BtrfsRootPath, "layers", chainID)
+}
+
+func btrfsContainerPath(key string) string {
+	return path.Join(BtrfsRootPath, "containers", key)
+}
+
+func (b *btrfs) Name() string {
+	return "btrfs"
+}
+
+func (b *btrfs) Prepare(key string, layerDirs []string) error {
+	if !isBtrfs(BtrfsRootPath) {
+		return fmt.Errorf("%s is not on a btrfs filesystem", BtrfsRootPath)
+	}
+	containerPath := btrfsContainerPath(key)
+	if err := os.MkdirAll(containerPath, 0700); err != nil {
+		return err
+	}
+	if err := writeLayers(containerPath, layerDirs); err != nil {
+		return err
+	}
+	parent, err := b.prepareLayers(layerDirs)
+	if err != nil {
+		return err
+	}
+	if parent == "" {
+		return subvolCreate(containerPath, "rootfs")
+	}
+	return subvolSnapshot(parent, containerPath, "rootfs")
+}
+
+// prepareLayers 为每一层创建只读子卷，已经存在的直接复用，返回最上层子卷的路径
+// 子卷的内容由这一层以及下面的所有层共同决定，所以用层链的摘要命名
+func (b *btrfs) prepareLayers(layerDirs []string) (string, error) {
+	layersPath := path.Join(BtrfsRootPath, "layers")
+	if err := os.MkdirAll(layersPath, 0700); err != nil {
+		return "", err
+	}
+	parent, chainID := "", ""
+	for _, layerDir := range layerDirs {
+		chainID = btrfsChainID(chainID, layerDir)
+		layerPath := btrfsLayerPath(chainID)
+		if _, err := os.Stat(layerPath); err == nil {
+			parent = layerPath
+			continue
+		}
+
+		//先在临时名字下创建并写入，设置只读之后再改名，保证已有的子卷都是完整的
+		tmpName := chainID + "-tmp"
+		subvolDelete(layersPath, tmpName)
+		var err error
+		if parent == "" {
+			err = subvolCreate(layersPath, tmpName)
+		} else {
+			err = subvolSnapshot(parent, layersPath, tmpName)
+		}
+		if err != nil {
+			return "", err
+		}
+		tmpPath := path.Join(layersPath, tmpName)
+		if err := image.ApplyLayer(tmpPath, layerDir, nil); err != nil {
+			subvolDelete(layersPath, tmpName)
+			return "", fmt.Errorf("apply layer %s error %v", layerDir, err)
+		}
+		if err := subvolSetReadonly(tmpPath); err != nil {
+			subvolDelete(layersPath, tmpName)
+			return "", err
+		}
+		if err := os.Rename(tmpPath, layerPath); err != nil {
+			return "", err
+		}
+		logrus.Infof("Create btrfs layer subvolume %s for %s", chainID, layerDir)
+		parent = layerPath
+	}
+	return parent, nil
+}
+
+// Mount 快照本身就是一个目录，不需要挂载
+func (b *btrfs) Mount(key string) (string, error) {
+	return b.Path(key), nil
+}
+
+func (b *btrfs) Unmount(key string) error {
+	return nil
+}
+
+// Commit 与镜像最上层的只读子卷比较得到容器的修改
+func (b *btrfs) Commit(key string) (image.Descriptor, string, error) {
+	containerPath := btrfsContainerPath(key)
+	layerDirs, err := readLayers(containerPath)
+	if err != nil {
+		return image.Descriptor{}, "", err
+	}
+	parent, err := b.prepareLayers(layerDirs)
+	if err != nil {
+		return image.Descriptor{}, "", err
+	}
+	if parent == "" {
+		return image.CreateLayer(b.Path(key))
+	}
+	diffDir, err := ioutil.TempDir(containerPath, "diff-")
+	if err != nil {
+		return image.Descriptor{}, "", err
+	}
+	defer os.RemoveAll(diffDir)
+	if err := diffTree(parent, b.Path(key), diffDir); err != nil {
+		return image.Descriptor{}, "", fmt.Errorf("diff rootfs of %s error %v", key, err)
+	}
+	return image.CreateLayer(diffDir)
+}
+
+func (b *btrfs) Remove(key string) error {
+	containerPath := btrfsContainerPath(key)
+	if _, err := os.Stat(b.Path(key)); err == nil {
+		if err := subvolDelete(containerPath, "rootfs"); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(containerPath)
+}
+
+// Usage 快照与镜像层共享数据块，精确的独占空间需要开启quota，这里统计的是文件的大小
+func (b *btrfs) Usage(key string) (int64, error) {
+	return utils.DirSize(b.Path(key))
+}
+
+func (b *btrfs) Path(key string) string {
+	return path.Join(btrfsContainerPath(key), "rootfs")
+}
+
+func (b *btrfs) Exists(key string) bool {
+	_, err := os.Stat(btrfsContainerPath(key))
+	return err == nil
+}
+
+// isBtrfs 判断目录(不存在时判断它最近的已存在的上级目录)是否位于btrfs上
+func isBtrfs(dir string) bool {
+	for {
+		var stat syscall.Statfs_t
+		err := syscall.Statfs(dir, &stat)
+		if err == nil {
+			return uint32(stat.Type) == btrfsSuperMagic
+		}
+		if !os.IsNotExist(err) || dir == filepath.Dir(dir) {
+			return false
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func subvolCreate(parentDir, name string) error {
+	var args btrfsVolArgs
+	copy(args.name[:btrfsPathNameMax], name)
+	if err := ioctlDir(parentDir, btrfsIocSubvolCreate, unsafe.Pointer(&args)); err != nil {
+		return fmt.Errorf("create subvolume %s in %s error %v", name, parentDir, err)
+	}
+	return nil
+}
+
+// subvolSnapshot 创建src的可写快照parentDir/name
+func subvolSnapshot(src, parentDir, name string) error {
+	srcDir, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcDir.Close()
+	args := btrfsVolArgsV2{fd: int64(srcDir.Fd())}
+	copy(args.name[:btrfsSubvolNameMax], name)
+	if err := ioctlDir(parentDir, btrfsIocSnapCreateV2, unsafe.Pointer(&args)); err != nil {
+		return fmt.Errorf("snapshot %s to %s/%s error %v", src, parentDir, name, err)
+	}
+	return nil
+}
+
+func subvolSetReadonly(subvol string) error {
+	flags := uint64(btrfsSubvolRdonly)
+	if err := ioctlDir(subvol, btrfsIocSubvolSetFlags, unsafe.Pointer(&flags)); err != nil {
+		return fmt.Errorf("set subvolume %s readonly error %v", subvol, err)
+	}
+	return nil
+}
+
+func subvolDelete(parentDir, name string) error {
+	var args btrfsVolArgs
+	copy(args.name[:btrfsPathNameMax], name)
+	if err := ioctlDir(parentDir, btrfsIocSnapDestroy, unsafe.Pointer(&args)); err != nil {
+		return fmt.Errorf("delete subvolume %s in %s error %v", name, parentDir, err)
+	}
+	return nil
+}
+
+func ioctlDir(dir string, request uintptr, arg unsafe.Pointer) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), request, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
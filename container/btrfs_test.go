@@ -0,0 +1,79 @@
+package container
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// mountLoopbackBtrfs 在一个稀疏文件上创建btrfs并通过loop设备挂载
+func mountLoopbackBtrfs(t *testing.T) string {
+	if _, err := exec.LookPath("mkfs.btrfs"); err != nil {
+		t.Skip("mkfs.btrfs not found")
+	}
+	imageFile := filepath.Join(t.TempDir(), "btrfs.img")
+	if err := os.WriteFile(imageFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(imageFile, 256<<20); err != nil {
+		t.Fatal(err)
+	}
+	if output, err := exec.Command("mkfs.btrfs", "-q", imageFile).CombinedOutput(); err != nil {
+		t.Skipf("mkfs.btrfs %v %s", err, output)
+	}
+	mountPoint := t.TempDir()
+	if output, err := exec.Command("mount", "-o", "loop", imageFile, mountPoint).CombinedOutput(); err != nil {
+		t.Skipf("mount btrfs image %v %s", err, output)
+	}
+	t.Cleanup(func() {
+		syscall.Unmount(mountPoint, syscall.MNT_DETACH)
+	})
+	return mountPoint
+}
+
+func TestBtrfsSnapshotter(t *testing.T) {
+	BtrfsRootPath = mountLoopbackBtrfs(t)
+	lower, upper := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(lower, "kept"), []byte("kept"), 0644)
+	os.WriteFile(filepath.Join(lower, "deleted"), []byte("deleted"), 0644)
+	if err := syscall.Mknod(filepath.Join(upper, "deleted"), syscall.S_IFCHR, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	sn := snapshotters["btrfs"]
+	if err := sn.Prepare("test", []string{lower, upper}); err != nil {
+		t.Fatalf("prepare %v", err)
+	}
+	rootfs, err := sn.Mount("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "kept")); err != nil {
+		t.Fatalf("kept should exist %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(rootfs, "deleted")); !os.IsNotExist(err) {
+		t.Fatalf("deleted should not exist %v", err)
+	}
+
+	//镜像层的子卷是只读的，容器的快照是可写的
+	layerDirs, _ := readLayers(btrfsContainerPath("test"))
+	top, err := sn.(*btrfs).prepareLayers(layerDirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(top, "new"), nil, 0644); err == nil {
+		t.Fatalf("layer subvolume should be readonly")
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "new"), []byte("new"), 0644); err != nil {
+		t.Fatalf("write container snapshot %v", err)
+	}
+
+	if err := sn.Remove("test"); err != nil {
+		t.Fatalf("remove %v", err)
+	}
+	if sn.Exists("test") {
+		t.Fatalf("container snapshot should be removed")
+	}
+}
@@ -3,9 +3,9 @@ package container
 import (
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"mydocker/image"
 	"os"
 	"os/exec"
-	"strings"
 	"syscall"
 )
 
@@ -19,14 +19,22 @@ var (
 )
 
 type ContainerInfo struct {
-	Pid         string   `json:"pid"`          //容器的init进程在宿主机上的PID
-	ID          string   `json:"id"`           //容器ID
-	Name        string   `json:"name"`         //容器名
-	Command     string   `json:"command"`      //容器内init进程的运行命令
-	CreatedTime string   `json:"created_time"` //创建时间
-	Status      string   `json:"status"`       //容器的状态
-	Volume      string   `json:"volume"`       //容器挂载的数据卷
-	PortMapping []string `json:"portmapping"`  //端口映射
+	Pid         string   `json:"pid"`                //容器的init进程在宿主机上的PID
+	ID          string   `json:"id"`                 //容器ID
+	Name        string   `json:"name"`               //容器名
+	Command     string   `json:"command"`            //容器内init进程的运行命令
+	CreatedTime string   `json:"created_time"`       //创建时间
+	Status      string   `json:"status"`             //容器的状态
+	Volume      string   `json:"volume"`             //旧版本记录的数据卷，现在使用Mounts
+	Mounts      []Mount  `json:"mounts"`             //容器挂载的所有数据卷
+	PortMapping []string `json:"portmapping"`        //端口映射
+	Image       string   `json:"image"`              //创建容器使用的镜像
+	ImageDigest string   `json:"image_digest"`       //镜像manifest的摘要，镜像名被重新指向其他镜像之后仍然能找到原来的镜像
+	CgroupPath  string   `json:"cgroup_path"`        //容器所在的cgroup
+	ReadOnly    bool     `json:"readonly,omitempty"` //根文件系统是否只读
+	Rootfs      string   `json:"rootfs,omitempty"`   //--rootfs指定的目录，这时没有镜像
+	Network     string   `json:"network,omitempty"`  //容器连接的网络
+	IPAddress   string   `json:"ip,omitempty"`       //容器在网络中的地址
 }
 
 /*
@@ -38,7 +46,7 @@ type ContainerInfo struct {
 3.下面的clone参数就是去fork出来一个新进程，并且使用了namespace隔离创建的进程和外部环境。
 4.如果用户指定了 -ti 参数，就需要把当前进程的输入输出导入到标准输入输出上
 */
-func NewParentProcess(tty bool, volume, containerName, imageName string, envSlice *[]string) (*exec.Cmd, *os.File) {
+func NewParentProcess(tty bool, mounts []Mount, containerName, imageName string, storage StorageOpts, envSlice *[]string) (*exec.Cmd, *os.File) {
 	//logrus.Infof("NewParentProcess: %s", command)
 	readPipe, writePipe, err := NewPipe()
 	if err != nil {
@@ -95,8 +103,12 @@ func NewParentProcess(tty bool, volume, containerName, imageName string, envSlic
 
 	cmd.Env = append(os.Environ(), *envSlice...)
 
-	NewWorkSpace(volume, imageName, containerName)
-	cmd.Dir = GetMerge(containerName)
+	rootfs, err := NewWorkSpace(mounts, imageName, containerName, storage)
+	if err != nil {
+		logrus.Errorf("New workspace error %v", err)
+		return nil, nil
+	}
+	cmd.Dir = rootfs
 
 	return cmd, writePipe
 }
@@ -111,201 +123,111 @@ func NewPipe() (*os.File, *os.File, error) {
 	return read, write, nil
 }
 
-func NewWorkSpace(volume, imagerName, containerName string) {
-	CreateLowerLayer(containerName, imagerName)
-	CreteUpperLayer(containerName)
-	CreteWorkLayer(containerName)
-	CreateMountPoint(containerName)
-
-	//根据volume判断是否执行挂在数据卷的操作
-	if volume != "" {
-		volumeURLs := volumeUrlExtract(volume)
-		length := len(volumeURLs)
-		if length == 2 && volumeURLs[0] != "" && volumeURLs[1] != "" {
-			MountVolume(containerName, volumeURLs)
-			logrus.Infof("%q", volumeURLs)
-		} else {
-			logrus.Infof("Volume parameter input is not correct")
-		}
-
-	}
-
-}
-
-// CreateLowerLayer 将busybox.tar解压到busybox目录下，作为容器的只读层
-func CreateLowerLayer(containerName, imageName string) {
-	lowerPath := GetLower(containerName)
-	imagePath := GetImage(imageName)
-	exists, err := PathExists(lowerPath)
-
+// NewWorkSpace 准备容器的根文件系统并挂载数据卷，返回根文件系统的路径
+// 没有指定存储驱动时自动选择，挂载失败(例如嵌套在其他容器中不支持overlay)时改用vfs
+func NewWorkSpace(mounts []Mount, imageName, containerName string, storage StorageOpts) (string, error) {
+	layerDirs, err := workSpaceLayers(imageName, storage)
 	if err != nil {
-		logrus.Infof("Fail to judge whether dir %s exists., %v", lowerPath, err)
-	}
-
-	if exists == false {
-		if err := os.MkdirAll(lowerPath, 0777); err != nil {
-			logrus.Infof("Fail to create dir %s, %v", lowerPath, err)
-		}
-
-		if _, err := exec.Command("tar", "-xvf", imagePath, "-C", lowerPath).CombinedOutput(); err != nil {
-			logrus.Errorf("untTar dir %s error %v", imageName, err)
-		}
-
+		return "", err
 	}
 
-}
-
-// CreteUpperLayer 创建一个名为upper的文件夹作为容器唯一的可写层
-func CreteUpperLayer(containerName string) {
-	upperPath := GetUpper(containerName)
-	if err := os.Mkdir(upperPath, 0777); err != nil {
-		logrus.Errorf("Mkdir dir %s error. %v", upperPath, err)
+	sn, err := workSpaceSnapshotter(storage)
+	if err != nil {
+		return "", err
 	}
-}
-
-func CreteWorkLayer(containerName string) {
-	workPath := GetWorker(containerName)
-	if err := os.Mkdir(workPath, 0777); err != nil {
-		logrus.Errorf("Mkdir dir %s error. %v", workPath, err)
+	rootfs, err := prepareRootFS(sn, containerName, layerDirs, storage.Size)
+	if err != nil && storage.Driver == "" && storage.Size == 0 && !storage.RootfsRW {
+		logrus.Warnf("Storage driver %s not available, fallback to vfs: %v", sn.Name(), err)
+		sn = snapshotters["vfs"]
+		rootfs, err = prepareRootFS(sn, containerName, layerDirs, 0)
 	}
-}
-
-func CreateMountPoint(containerName string) {
-	mergePath := GetMerge(containerName)
-	//创建mnt文件夹作为挂载点
-	if err := os.Mkdir(mergePath, 0777); err != nil {
-		logrus.Infof("Mkdir dir %s error. %v", mergePath, err)
+	if err != nil {
+		return "", err
 	}
 
-	//把writeLayer目录和busybox目录mount到mnt目录下
-	//dirs := "dirs=" + rootURL + "writeLayer" + rootURL + "busybox"
-	//cmd := exec.Command("mount", "-t", "aufs", "-0", dirs, "none", mntURL)
-
-	//因为用的overlay2，还需要一个work层
-	//sudo mount -t overlay -o lowerdir=image-layer,upperdir=container-layer,workdir=work none mnt
-	//writeURL := rootURL + "/writeLayer"
-	//readOnlyURL := rootURL + "/busybox"
-	cmd := exec.Command("mount", "-t", "overlay",
-		"-o", GetOverlayFSDirs(GetLower(containerName), GetUpper(containerName), GetWorker(containerName)),
-		"none", mergePath)
-	//cmd := exec.Command("mount", "-t", "overlay", "-o", "lowerdir=", readOnlyURL, ",upperdir="+writeURL, ",workdir=", workURL, "none", mntURL)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		logrus.Errorf("%v", err)
+	//挂载数据卷
+	if err := MountVolumes(rootfs, mounts); err != nil {
+		sn.Unmount(containerName)
+		sn.Remove(containerName)
+		return "", err
 	}
+	return rootfs, nil
 }
 
-func DeleteWorkSpace(volume, containerName string) {
-	//如果指定了volume, 则写在挂载点
-	if volume != "" {
-		volumeURLs := volumeUrlExtract(volume)
-		length := len(volumeURLs)
-		if length == 2 && volumeURLs[0] != "" && volumeURLs[1] != "" {
-			DeleteMountPointWithVolume(containerName, volumeURLs)
-		} else {
-			DeleteMountPoint(containerName)
+// workSpaceLayers 镜像层解压在镜像存储中，多个容器共享同一份
+// 指定了--rootfs时不使用镜像，用户的目录就是唯一的一层
+func workSpaceLayers(imageName string, storage StorageOpts) ([]string, error) {
+	if storage.Rootfs != "" {
+		info, err := os.Stat(storage.Rootfs)
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		DeleteMountPoint(containerName)
-	}
-	DeleteUpperLayer(containerName)
-	DeleteWorkLayer(containerName)
-}
-
-func DeleteMountPoint(containerName string) {
-	mergePath := GetMerge(containerName)
-	cmd := exec.Command("umount", mergePath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		logrus.Errorf("%v", err)
-	}
-	if err := os.RemoveAll(mergePath); err != nil {
-		logrus.Errorf("Remove dir %s error %v", mergePath, err)
-	}
-
-}
-
-func DeleteUpperLayer(containerName string) {
-	upperPath := GetUpper(containerName)
-	if err := os.RemoveAll(upperPath); err != nil {
-		logrus.Errorf("Remove dir %s error %v", upperPath, err)
+		if !info.IsDir() {
+			return nil, fmt.Errorf("rootfs %s is not a directory", storage.Rootfs)
+		}
+		return []string{storage.Rootfs}, nil
 	}
-}
-
-func DeleteWorkLayer(containerName string) {
-	workPath := GetWorker(containerName)
-	if err := os.RemoveAll(workPath); err != nil {
-		logrus.Errorf("Remove dir %s error %v", workPath, err)
+	img, err := image.Get(imageName)
+	if err != nil {
+		return nil, err
 	}
+	return image.PrepareLayers(img)
 }
 
-// MountVolume 挂载数据卷就三步：1.创宿主机的目录2.创容器的目录3.挂载
-func MountVolume(containerName string, volumeURLs []string) {
-	//创建宿主机文件目录,不存在会创建一下
-	parentUrl := volumeURLs[0]
-	if err := createFile(parentUrl); err != nil {
-		logrus.Errorf("Create parent dir %s error. %v", parentUrl, err)
-		return
+// workSpaceSnapshotter --rootfs-rw直接使用用户的目录，--rootfs作为overlay的只读层，不复制目录
+// btrfs按照层的路径缓存子卷，目录的内容可能会变化，所以--rootfs不使用btrfs
+func workSpaceSnapshotter(storage StorageOpts) (Snapshotter, error) {
+	switch {
+	case storage.RootfsRW:
+		if storage.Size > 0 {
+			return nil, fmt.Errorf("size option is not supported with --rootfs-rw")
+		}
+		return rootfsDir, nil
+	case storage.Rootfs != "" && storage.Driver == "":
+		return snapshotters[DefaultStorageDriver], nil
+	case storage.Rootfs != "" && storage.Driver == "btrfs":
+		return nil, fmt.Errorf("storage driver btrfs does not support --rootfs")
+	}
+	return GetSnapshotter(storage.Driver)
+}
+
+// prepareRootFS 创建并挂载容器的根文件系统，失败时清理已经创建的内容
+// size大于0时先限制可写层的大小，存储驱动需要支持Quota
+func prepareRootFS(sn Snapshotter, containerName string, layerDirs []string, size int64) (string, error) {
+	if size > 0 {
+		quota, ok := sn.(Quota)
+		if !ok {
+			return "", fmt.Errorf("storage driver %s does not support size option", sn.Name())
+		}
+		if err := quota.SetQuota(containerName, size); err != nil {
+			sn.Remove(containerName)
+			return "", err
+		}
 	}
-
-	//在容器文件系统里创建挂载点
-	containerUrl := volumeURLs[1]
-	containerVolumeURL := GetMerge(containerName) + containerUrl
-	if err := createFile(containerVolumeURL); err != nil {
-		logrus.Errorf("Create parent dir %s error. %v", parentUrl, err)
-		return
+	if err := sn.Prepare(containerName, layerDirs); err != nil {
+		sn.Remove(containerName)
+		return "", err
 	}
-	//if err := os.Mkdir(containerVolumeURL, 0777); err != nil {
-	//	logrus.Infof("Mkdir container dir %s error. %v", containerVolumeURL, err)
-	//}
-
-	////把宿主机文件目录挂载到容器挂载点
-	//dirs := "dirs=" + parentUrl
-	//cmd := exec.Command("mount", "-t", "aufs", "-o", dirs, "none", containerVolumeURL)
-
-	////lowerdir=%s,upperdir=%s,workdir=%s
-	//workURL := parentUrl + "Work"
-	//CreteWorkDir(workURL)
-	//cmd := exec.Command("mount", "-t", "overlay",
-	//	"-o", fmt.Sprintf("lowerdir=%s,workdir=%s", parentUrl, workURL),
-	//	"none", containerVolumeURL)
-
-	cmd := exec.Command("mount", "-o", "bind", parentUrl, containerVolumeURL)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		logrus.Errorf("Mount volume failed. %v", err)
+	rootfs, err := sn.Mount(containerName)
+	if err != nil {
+		sn.Remove(containerName)
+		return "", err
 	}
+	return rootfs, nil
 }
 
-func DeleteMountPointWithVolume(containerName string, volumeURLS []string) {
-	mergePath := GetMerge(containerName)
-	//卸载容器里volume挂载点的文件系统
-	containerUrl := mergePath + volumeURLS[1]
-	cmd := exec.Command("umount", containerUrl)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		logrus.Errorf("Umount volume failed. %v", err)
-	}
-
-	//卸载整个容器文件系统的挂载点
-	cmd = exec.Command("umount", mergePath)
-	cmd.Stdout = os.Stdout
-	cmd.Stdin = os.Stdin
-	if err := cmd.Run(); err != nil {
-		logrus.Errorf("Umount volume failed. %v", err)
+// DeleteWorkSpace 卸载数据卷和容器的根文件系统，并删除容器的可写层
+func DeleteWorkSpace(mounts []Mount, containerName string) {
+	sn := LookupSnapshotter(containerName)
+	//先卸载hosts等文件和所有数据卷，再卸载根文件系统
+	UnmountVolumes(sn.Path(containerName), etcMounts(containerName))
+	UnmountVolumes(sn.Path(containerName), mounts)
+	if err := sn.Unmount(containerName); err != nil {
+		logrus.Errorf("%v", err)
 	}
-
-	//删除容器文件系统的挂载点
-	if err := os.RemoveAll(mergePath); err != nil {
-		logrus.Infof("Remove mountpoint dir %s error %v", mergePath, err)
+	if err := sn.Remove(containerName); err != nil {
+		logrus.Errorf("Remove rootfs of %s error %v", containerName, err)
 	}
-
-	//workURL := volumeURLS[0] + "Work"
-	//DeleteWorkLayer(workURL)
 }
 
 // PathExists 判断文件的路径是否存在
@@ -321,24 +243,3 @@ func PathExists(path string) (bool, error) {
 
 	return false, err //存在但不可访问
 }
-
-func volumeUrlExtract(volume string) []string {
-	return strings.Split(volume, ":")
-}
-
-func createFile(path string) error {
-	//创建宿主机文件目录,不存在会创建一下
-	//parentUrl := volumeURLs[0]
-	exists, err := PathExists(path)
-	if err != nil {
-		return fmt.Errorf("fail to judge whether dir %s exists., %v", path, err)
-	}
-
-	if !exists {
-		if err := os.Mkdir(path, 0777); err != nil {
-			return fmt.Errorf("mkdir parent dir %s error. %v", path, err)
-		}
-	}
-
-	return nil
-}
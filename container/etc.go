@@ -0,0 +1,89 @@
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// 每个容器一份的/etc/hosts和/etc/resolv.conf，保存在容器信息目录中，bind mount到容器里
+// 即使根文件系统是只读的，这两个文件也可以修改
+var etcFiles = []string{"hosts", "resolv.conf"}
+
+const defaultHosts = "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n"
+
+// 宿主机的resolv.conf中没有可用的DNS时使用的默认DNS
+const defaultNameserver = "nameserver 8.8.8.8\n"
+
+// SetUpEtcFiles 生成容器的hosts和resolv.conf并挂载到容器的/etc下，用户自己挂载了同一个文件时跳过
+func SetUpEtcFiles(rootfs, containerName string, mounts []Mount) error {
+	dirURL := fmt.Sprintf(DefaultInfoLocation, containerName)
+	if err := os.MkdirAll(dirURL, 0622); err != nil {
+		return err
+	}
+	contents := map[string]string{
+		"hosts":       defaultHosts,
+		"resolv.conf": resolvConf(),
+	}
+
+	userTargets := map[string]bool{}
+	for _, mount := range mounts {
+		userTargets[mount.Target] = true
+	}
+	var mounted []Mount
+	for _, mount := range etcMounts(containerName) {
+		if userTargets[mount.Target] {
+			continue
+		}
+		if err := ioutil.WriteFile(mount.Source, []byte(contents[path.Base(mount.Target)]), 0644); err != nil {
+			UnmountVolumes(rootfs, mounted)
+			return err
+		}
+		if err := mountVolume(rootfs, &mount); err != nil {
+			UnmountVolumes(rootfs, mounted)
+			return fmt.Errorf("mount %s error %v", mount.Target, err)
+		}
+		mounted = append(mounted, mount)
+	}
+	return nil
+}
+
+// etcMounts 容器的hosts和resolv.conf对应的挂载
+func etcMounts(containerName string) []Mount {
+	var mounts []Mount
+	for _, name := range etcFiles {
+		mounts = append(mounts, Mount{
+			Type:   MountTypeBind,
+			Source: path.Join(fmt.Sprintf(DefaultInfoLocation, containerName), name),
+			Target: path.Join("/etc", name),
+		})
+	}
+	return mounts
+}
+
+// resolvConf 复制宿主机的resolv.conf，去掉本机回环地址的DNS，容器的network namespace中访问不到它们
+func resolvConf() string {
+	content, err := ioutil.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return defaultNameserver
+	}
+	var lines []string
+	hasNameserver := false
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			if strings.HasPrefix(fields[1], "127.") || fields[1] == "::1" {
+				continue
+			}
+			hasNameserver = true
+		}
+		lines = append(lines, line)
+	}
+	result := strings.TrimRight(strings.Join(lines, "\n"), "\n") + "\n"
+	if !hasNameserver {
+		result += defaultNameserver
+	}
+	return result
+}
@@ -0,0 +1,66 @@
+package container
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// 所有容器的事件按行追加到这个文件中，删除容器之后仍然保留
+var EventsFile = fmt.Sprintf(DefaultInfoLocation, "") + "events.json"
+
+// Event 容器发生的事件，比如进程数达到了--pids-limit
+type Event struct {
+	Time       time.Time         `json:"time"`
+	Container  string            `json:"container"` //容器ID
+	Name       string            `json:"name"`      //容器名
+	Action     string            `json:"action"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// RecordEvent 追加一条事件，O_APPEND保证多个进程同时写入时每一行是完整的
+func RecordEvent(event Event) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	content, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(fmt.Sprintf(DefaultInfoLocation, ""), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(EventsFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(content, '\n'))
+	return err
+}
+
+// ReadEvents 按时间顺序读取所有事件
+func ReadEvents() ([]Event, error) {
+	file, err := os.Open(EventsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			//写到一半的行跳过
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
@@ -1,13 +1,13 @@
 package container
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
 	"syscall"
 )
 
@@ -40,16 +40,42 @@ import (
 //	return nil
 //}
 
+// InitConfig 父进程通过管道传给容器init进程的启动参数
+type InitConfig struct {
+	Args       []string `json:"args"`                  //用户命令
+	WorkingDir string   `json:"working_dir,omitempty"` //工作目录，不存在会自动创建
+	User       string   `json:"user,omitempty"`        //运行用户，支持user、uid、user:group、uid:gid
+	Mounts     []Mount  `json:"mounts,omitempty"`      //需要在容器内创建的tmpfs挂载
+	ReadOnly   bool     `json:"readonly,omitempty"`    //根文件系统只读
+}
+
 func RunContainerInitProcess() error {
 	//time.Sleep(5 * time.Second)
 	//打印RunContainerInitProcess函数
 	logrus.Infof("RunContainerInitProcess")
-	cmdArray := readUserCommand()
-	if cmdArray == nil || len(cmdArray) == 0 {
+	initConfig := readUserCommand()
+	if initConfig == nil || len(initConfig.Args) == 0 {
 		return fmt.Errorf("Run container get user commadn error,cmdArray is nil")
 	}
+	cmdArray := initConfig.Args
 
-	setUpMount()
+	if err := setUpMount(initConfig.Mounts); err != nil {
+		return err
+	}
+
+	//切换工作目录和用户都要在pivot_root之后，路径和/etc/passwd都是容器内的
+	if err := setUpWorkingDir(initConfig.WorkingDir); err != nil {
+		return err
+	}
+	//工作目录可能需要创建，所以只读要在切换工作目录之后，切换用户之后就没有权限remount了
+	if initConfig.ReadOnly {
+		if err := setUpReadonlyRootfs(); err != nil {
+			return err
+		}
+	}
+	if err := setUpUser(initConfig.User); err != nil {
+		return err
+	}
 
 	//打印一下cmdArray
 	logrus.Infof("commandArray %s", cmdArray)
@@ -66,7 +92,7 @@ func RunContainerInitProcess() error {
 	return nil
 }
 
-func readUserCommand() []string {
+func readUserCommand() *InitConfig {
 	//uintptr(3)就是指的index为3的文件描述符，也就是传递进来的管道的一端
 	pipe := os.NewFile(uintptr(3), "pipe")
 	msg, err := ioutil.ReadAll(pipe)
@@ -74,9 +100,37 @@ func readUserCommand() []string {
 		logrus.Errorf("init read pipe error %v", err)
 		return nil
 	}
-	msgStr := string(msg)
-	return strings.Split(msgStr, " ")
+	//管道中是json序列化的InitConfig，这样参数本身可以包含空格
+	var initConfig InitConfig
+	if err := json.Unmarshal(msg, &initConfig); err != nil {
+		logrus.Errorf("init unmarshal config error %v", err)
+		return nil
+	}
+	return &initConfig
+}
+
+// setUpWorkingDir 切换到镜像或用户指定的工作目录
+func setUpWorkingDir(workingDir string) error {
+	if workingDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(workingDir, 0755); err != nil {
+		return fmt.Errorf("mkdir working dir %s error %v", workingDir, err)
+	}
+	if err := syscall.Chdir(workingDir); err != nil {
+		return fmt.Errorf("chdir %s error %v", workingDir, err)
+	}
+	return nil
+}
 
+// setUpReadonlyRootfs 把根文件系统remount成只读
+// pivot_root之前根文件系统bind mount到了自己上面，remount只影响这个挂载本身，
+// /proc、/dev、tmpfs、数据卷以及hosts等文件是单独的挂载，仍然可以写
+func setUpReadonlyRootfs() error {
+	if err := syscall.Mount("", "/", "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("remount rootfs readonly error %v", err)
+	}
+	return nil
 }
 
 func pivotRoot(root string) error {
@@ -115,17 +169,18 @@ func pivotRoot(root string) error {
 /*
 init 挂载点
 */
-func setUpMount() {
+func setUpMount(mounts []Mount) error {
 
 	//获取当前路径
 	pwd, err := os.Getwd()
 	if err != nil {
-		logrus.Errorf("Get current location error %v", err)
-		return
+		return fmt.Errorf("Get current location error %v", err)
 	}
 
 	logrus.Infof("Current location is %s", pwd)
-	pivotRoot(pwd)
+	if err := pivotRoot(pwd); err != nil {
+		return err
+	}
 
 	//MS_NOEXEC 在本文件系统中不允许运行其他程序
 	//MS_NOSUID 在本系统中运行程序的时候，不允许set-user-ID或set-group-ID
@@ -134,10 +189,17 @@ func setUpMount() {
 	//mount proc
 	err = syscall.Mount("proc", "/proc", "proc", uintptr(defaultMountFlags), "")
 	if err != nil {
-		logrus.Errorf("mount proc err %v", err)
-		return
+		return fmt.Errorf("mount proc err %v", err)
 	}
 	//不挂载 /dev，会导致容器内部无法访问和使用许多设备，这可能导致系统无法正常工作
 	syscall.Mount("tmpfs", "/dev", "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755")
 
+	//tmpfs挂载在容器自己的mount namespace中创建，容器退出时随之消失
+	for _, mount := range mounts {
+		if err := MountTmpfs(mount); err != nil {
+			return fmt.Errorf("mount tmpfs %s error %v", mount.Target, err)
+		}
+		logrus.Infof("Mount tmpfs to %s", mount.Target)
+	}
+	return nil
 }
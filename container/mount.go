@@ -0,0 +1,399 @@
+package container
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"mydocker/utils"
+	"mydocker/volume"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	MountTypeBind   = "bind"
+	MountTypeVolume = "volume"
+	MountTypeTmpfs  = "tmpfs"
+)
+
+// 挂载传播类型对应的mount标志
+var propagationFlags = map[string]uintptr{
+	"rprivate": syscall.MS_REC | syscall.MS_PRIVATE,
+	"private":  syscall.MS_PRIVATE,
+	"rshared":  syscall.MS_REC | syscall.MS_SHARED,
+	"shared":   syscall.MS_SHARED,
+	"rslave":   syscall.MS_REC | syscall.MS_SLAVE,
+	"slave":    syscall.MS_SLAVE,
+}
+
+// Mount 容器中的一个挂载，记录在容器信息中，删除容器时据此卸载
+type Mount struct {
+	Type        string `json:"type"`                  //bind、volume或者tmpfs
+	Source      string `json:"source,omitempty"`      //宿主机路径或者数据卷名，tmpfs没有
+	Target      string `json:"target"`                //容器内的路径
+	ReadOnly    bool   `json:"readonly,omitempty"`    //只读挂载
+	Propagation string `json:"propagation,omitempty"` //挂载传播类型，默认rprivate
+	NoCopy      bool   `json:"nocopy,omitempty"`      //数据卷为空时不复制镜像中的内容
+	TmpfsSize   int64  `json:"tmpfs_size,omitempty"`  //tmpfs的大小限制，单位字节，0表示不限制
+	TmpfsMode   uint32 `json:"tmpfs_mode,omitempty"`  //tmpfs根目录的权限，0表示默认的1777
+	CreateHost  bool   `json:"-"`                     //bind的宿主机目录不存在时自动创建，只有-v会这样
+}
+
+// ParseVolume 解析-v参数: host-dir:container-dir[:options]、name:container-dir[:options]
+// 或者只有container-dir的匿名数据卷，options用逗号分隔，可以是ro、rw、nocopy和挂载传播类型
+func ParseVolume(spec string) (*Mount, error) {
+	parts := strings.Split(spec, ":")
+	mount := &Mount{Type: MountTypeVolume}
+	switch len(parts) {
+	case 1:
+		mount.Target = parts[0]
+	case 2, 3:
+		mount.Source, mount.Target = parts[0], parts[1]
+		if !volume.IsName(mount.Source) {
+			mount.Type = MountTypeBind
+		}
+	default:
+		return nil, fmt.Errorf("invalid volume specification %q", spec)
+	}
+	mount.CreateHost = mount.Type == MountTypeBind
+	if len(parts) < 3 {
+		return mount.validated(spec)
+	}
+
+	for _, option := range strings.Split(parts[2], ",") {
+		switch {
+		case option == "ro":
+			mount.ReadOnly = true
+		case option == "rw":
+			mount.ReadOnly = false
+		case option == "nocopy":
+			if mount.Type != MountTypeVolume {
+				return nil, fmt.Errorf("invalid volume specification %q, nocopy only applies to volumes", spec)
+			}
+			mount.NoCopy = true
+		case option == "z" || option == "Z":
+			//没有SELinux，重新打标签的选项直接忽略
+		case propagationFlags[option] != 0:
+			if mount.Propagation != "" {
+				return nil, fmt.Errorf("invalid volume specification %q, duplicate propagation", spec)
+			}
+			mount.Propagation = option
+		default:
+			return nil, fmt.Errorf("invalid volume specification %q, unknown option %s", spec, option)
+		}
+	}
+	return mount.validated(spec)
+}
+
+// ParseMount 解析--mount参数，逗号分隔的key=value，例如
+// type=bind,source=/data,target=/data,readonly 或者 type=tmpfs,target=/tmp,tmpfs-size=64m,tmpfs-mode=1770
+// type默认是volume，和-v不同，bind的宿主机路径必须已经存在
+func ParseMount(spec string) (*Mount, error) {
+	mount := &Mount{Type: MountTypeVolume}
+	for _, field := range strings.Split(spec, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		value := ""
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		var err error
+		switch key {
+		case "type":
+			mount.Type = value
+		case "source", "src":
+			mount.Source = value
+		case "target", "destination", "dst":
+			mount.Target = value
+		case "readonly", "ro":
+			mount.ReadOnly, err = parseMountBool(kv)
+		case "bind-propagation":
+			if propagationFlags[value] == 0 {
+				return nil, fmt.Errorf("invalid mount specification %q, unknown propagation %s", spec, value)
+			}
+			mount.Propagation = value
+		case "volume-nocopy":
+			mount.NoCopy, err = parseMountBool(kv)
+		case "tmpfs-size":
+			mount.TmpfsSize, err = utils.ParseSize(value)
+		case "tmpfs-mode":
+			var mode uint64
+			mode, err = strconv.ParseUint(value, 8, 32)
+			mount.TmpfsMode = uint32(mode)
+		default:
+			return nil, fmt.Errorf("invalid mount specification %q, unknown field %s", spec, key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid mount specification %q, field %s: %v", spec, key, err)
+		}
+	}
+
+	//各种类型只能使用自己的选项
+	switch mount.Type {
+	case MountTypeBind:
+		if mount.NoCopy || mount.TmpfsSize != 0 || mount.TmpfsMode != 0 {
+			return nil, fmt.Errorf("invalid mount specification %q, volume and tmpfs options do not apply to bind mounts", spec)
+		}
+	case MountTypeVolume:
+		if mount.TmpfsSize != 0 || mount.TmpfsMode != 0 {
+			return nil, fmt.Errorf("invalid mount specification %q, tmpfs options do not apply to volumes", spec)
+		}
+		if mount.Propagation != "" {
+			return nil, fmt.Errorf("invalid mount specification %q, bind-propagation only applies to bind mounts", spec)
+		}
+	case MountTypeTmpfs:
+		if mount.Source != "" {
+			return nil, fmt.Errorf("invalid mount specification %q, tmpfs does not take a source", spec)
+		}
+		if mount.NoCopy || mount.Propagation != "" {
+			return nil, fmt.Errorf("invalid mount specification %q, bind and volume options do not apply to tmpfs", spec)
+		}
+	default:
+		return nil, fmt.Errorf("invalid mount specification %q, unknown type %s", spec, mount.Type)
+	}
+	return mount.validated(spec)
+}
+
+// ParseTmpfs 解析--tmpfs参数: container-dir[:options]，options用逗号分隔，可以是ro、rw、size=和mode=
+func ParseTmpfs(spec string) (*Mount, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	mount := &Mount{Type: MountTypeTmpfs, Target: parts[0]}
+	if len(parts) == 2 {
+		for _, option := range strings.Split(parts[1], ",") {
+			kv := strings.SplitN(option, "=", 2)
+			var err error
+			switch {
+			case option == "ro":
+				mount.ReadOnly = true
+			case option == "rw":
+				mount.ReadOnly = false
+			case kv[0] == "size" && len(kv) == 2:
+				mount.TmpfsSize, err = utils.ParseSize(kv[1])
+			case kv[0] == "mode" && len(kv) == 2:
+				var mode uint64
+				mode, err = strconv.ParseUint(kv[1], 8, 32)
+				mount.TmpfsMode = uint32(mode)
+			default:
+				return nil, fmt.Errorf("invalid tmpfs specification %q, unknown option %s", spec, option)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid tmpfs specification %q, option %s: %v", spec, option, err)
+			}
+		}
+	}
+	return mount.validated(spec)
+}
+
+// parseMountBool 没有值的选项(例如readonly)表示true
+func parseMountBool(kv []string) (bool, error) {
+	if len(kv) == 1 {
+		return true, nil
+	}
+	return strconv.ParseBool(kv[1])
+}
+
+func (m *Mount) validated(spec string) (*Mount, error) {
+	if err := m.validate(spec); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// validate -v和--mount共用的校验，容器内路径必须是绝对路径并且不能是/
+func (m *Mount) validate(spec string) error {
+	if m.Target == "" || !path.IsAbs(m.Target) {
+		return fmt.Errorf("invalid mount specification %q, container path must be absolute", spec)
+	}
+	m.Target = path.Clean(m.Target)
+	if m.Target == "/" {
+		return fmt.Errorf("invalid mount specification %q, can not mount on /", spec)
+	}
+	switch m.Type {
+	case MountTypeBind:
+		if !path.IsAbs(m.Source) {
+			return fmt.Errorf("invalid mount specification %q, bind source must be an absolute path", spec)
+		}
+		m.Source = path.Clean(m.Source)
+	case MountTypeVolume:
+		if m.Source != "" && !volume.IsName(m.Source) {
+			return fmt.Errorf("invalid mount specification %q, invalid volume name %s", spec, m.Source)
+		}
+	}
+	return nil
+}
+
+// ValidateMounts 检查所有挂载，同一个容器内路径只能挂载一次
+func ValidateMounts(mounts []Mount) error {
+	targets := map[string]bool{}
+	for _, mount := range mounts {
+		if targets[mount.Target] {
+			return fmt.Errorf("duplicate mount point %s", mount.Target)
+		}
+		targets[mount.Target] = true
+	}
+	return nil
+}
+
+// ResolveTarget 在rootfs中解析容器内路径，路径中的符号链接按照容器内的视角解析，
+// 通过..跳出rootfs的返回错误，防止镜像中的符号链接把挂载点指到宿主机的目录上
+func ResolveTarget(rootfs, target string) (string, error) {
+	resolved, err := utils.SecureJoin(rootfs, target)
+	if err != nil {
+		return "", fmt.Errorf("invalid mount target %s: %v", target, err)
+	}
+	return resolved, nil
+}
+
+// HostPath 挂载源在宿主机上的路径
+func (m *Mount) HostPath() string {
+	if m.Type == MountTypeVolume {
+		return volume.Path(m.Source)
+	}
+	return m.Source
+}
+
+// MountVolumes 把bind和volume挂载到容器的根文件系统中，失败时卸载已经挂载的
+// tmpfs需要在容器的mount namespace中创建，由容器的init进程挂载
+func MountVolumes(rootfs string, mounts []Mount) error {
+	for i := range mounts {
+		if mounts[i].Type == MountTypeTmpfs {
+			continue
+		}
+		if err := mountVolume(rootfs, &mounts[i]); err != nil {
+			UnmountVolumes(rootfs, mounts[:i])
+			return fmt.Errorf("mount %s to %s error %v", mounts[i].Source, mounts[i].Target, err)
+		}
+		logrus.Infof("Mount %s %s to %s", mounts[i].Type, mounts[i].Source, mounts[i].Target)
+	}
+	return nil
+}
+
+// mountVolume 挂载数据卷就三步：1.创宿主机的目录2.创容器的目录3.挂载
+// 只读需要在bind mount之后再remount一次，bind mount时MS_RDONLY不会生效
+func mountVolume(rootfs string, mount *Mount) error {
+	source := mount.HostPath()
+	sourceInfo, err := os.Stat(source)
+	if os.IsNotExist(err) && mount.CreateHost {
+		//宿主机目录不存在时自动创建
+		if err = os.MkdirAll(source, 0755); err == nil {
+			sourceInfo, err = os.Stat(source)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	target, err := ResolveTarget(rootfs, mount.Target)
+	if err != nil {
+		return err
+	}
+	//数据卷第一次使用(为空)时，先把镜像中挂载点下的内容复制到数据卷中
+	if mount.Type == MountTypeVolume && !mount.NoCopy {
+		if err := copyUpVolume(target, source); err != nil {
+			return fmt.Errorf("copy image content to volume %s error %v", mount.Source, err)
+		}
+	}
+	if sourceInfo.IsDir() {
+		err = os.MkdirAll(target, 0755)
+	} else {
+		//挂载单个文件时挂载点也必须是文件
+		if err = os.MkdirAll(path.Dir(target), 0755); err == nil {
+			var file *os.File
+			if file, err = os.OpenFile(target, os.O_CREATE, 0644); err == nil {
+				file.Close()
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := syscall.Mount(source, target, "bind", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+	if mount.ReadOnly {
+		if err := syscall.Mount("", target, "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY, ""); err != nil {
+			syscall.Unmount(target, syscall.MNT_DETACH)
+			return err
+		}
+	}
+	propagation := mount.Propagation
+	if propagation == "" {
+		propagation = "rprivate"
+	}
+	if err := syscall.Mount("", target, "", propagationFlags[propagation], ""); err != nil {
+		syscall.Unmount(target, syscall.MNT_DETACH)
+		return err
+	}
+	return nil
+}
+
+// copyUpVolume 镜像中的挂载点是非空目录并且数据卷是空的时候，把目录下的内容复制到数据卷中，
+// 保留属主、权限、扩展属性和符号链接，数据卷的根目录也使用挂载点目录的属主和权限
+func copyUpVolume(target, volumePath string) error {
+	info, err := os.Lstat(target)
+	if err != nil || !info.IsDir() {
+		return nil
+	}
+	volumeEntries, err := ioutil.ReadDir(volumePath)
+	if err != nil || len(volumeEntries) > 0 {
+		return err
+	}
+	entries, err := ioutil.ReadDir(target)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	for _, entry := range entries {
+		if err := utils.CopyPath(path.Join(target, entry.Name()), path.Join(volumePath, entry.Name())); err != nil {
+			return err
+		}
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	if err := os.Lchown(volumePath, int(stat.Uid), int(stat.Gid)); err != nil {
+		return err
+	}
+	return os.Chmod(volumePath, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+}
+
+// UnmountVolumes 按照挂载的相反顺序卸载，嵌套的挂载点先卸载
+func UnmountVolumes(rootfs string, mounts []Mount) {
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if mounts[i].Type == MountTypeTmpfs {
+			continue
+		}
+		target, err := ResolveTarget(rootfs, mounts[i].Target)
+		if err != nil {
+			target = path.Join(rootfs, mounts[i].Target)
+		}
+		if err := syscall.Unmount(target, syscall.MNT_DETACH); err != nil && err != syscall.EINVAL && !os.IsNotExist(err) {
+			logrus.Errorf("Umount volume %s error %v", target, err)
+		}
+	}
+}
+
+// MountTmpfs 在容器内创建tmpfs挂载，在pivot_root之后由容器的init进程调用
+func MountTmpfs(mount Mount) error {
+	target, err := ResolveTarget("/", mount.Target)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV)
+	if mount.ReadOnly {
+		flags |= syscall.MS_RDONLY
+	}
+	mode := mount.TmpfsMode
+	if mode == 0 {
+		mode = 01777
+	}
+	data := fmt.Sprintf("mode=%o", mode)
+	if mount.TmpfsSize > 0 {
+		data += fmt.Sprintf(",size=%d", mount.TmpfsSize)
+	}
+	return syscall.Mount("tmpfs", target, "tmpfs", flags, data)
+}
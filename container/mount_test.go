@@ -0,0 +1,142 @@
+package container
+
+import (
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+func TestParseVolume(t *testing.T) {
+	cases := map[string]Mount{
+		"/data":                   {Type: MountTypeVolume, Target: "/data"},
+		"data:/data":              {Type: MountTypeVolume, Source: "data", Target: "/data"},
+		"data:/data:ro,nocopy":    {Type: MountTypeVolume, Source: "data", Target: "/data", ReadOnly: true, NoCopy: true},
+		"/host:/data/:rw,rshared": {Type: MountTypeBind, Source: "/host", Target: "/data", Propagation: "rshared", CreateHost: true},
+	}
+	for spec, want := range cases {
+		mount, err := ParseVolume(spec)
+		if err != nil {
+			t.Fatalf("parse %s %v", spec, err)
+		}
+		if *mount != want {
+			t.Fatalf("parse %s got %+v want %+v", spec, *mount, want)
+		}
+	}
+
+	for _, spec := range []string{"data:relative", "/host:/", "/host:/data:bogus", "/host:/data:nocopy", "a:b:c:d", "/h:/d:rshared,rslave"} {
+		if _, err := ParseVolume(spec); err == nil {
+			t.Fatalf("parse %s should fail", spec)
+		}
+	}
+}
+
+func TestParseMount(t *testing.T) {
+	cases := map[string]Mount{
+		"type=bind,source=/host,target=/data,readonly,bind-propagation=rslave": {Type: MountTypeBind, Source: "/host", Target: "/data", ReadOnly: true, Propagation: "rslave"},
+		"src=data,dst=/data,volume-nocopy=true":                                {Type: MountTypeVolume, Source: "data", Target: "/data", NoCopy: true},
+		"type=tmpfs,target=/tmp,tmpfs-size=64m,tmpfs-mode=1770":                {Type: MountTypeTmpfs, Target: "/tmp", TmpfsSize: 64 << 20, TmpfsMode: 01770},
+	}
+	for spec, want := range cases {
+		mount, err := ParseMount(spec)
+		if err != nil {
+			t.Fatalf("parse %s %v", spec, err)
+		}
+		if *mount != want {
+			t.Fatalf("parse %s got %+v want %+v", spec, *mount, want)
+		}
+	}
+
+	for _, spec := range []string{
+		"type=bind,source=relative,target=/data",
+		"type=tmpfs,source=/host,target=/tmp",
+		"type=volume,target=/data,tmpfs-size=1m",
+		"type=tmpfs,target=/tmp,tmpfs-mode=999",
+		"type=nfs,target=/data",
+		"target=/data,bogus=1",
+	} {
+		if _, err := ParseMount(spec); err == nil {
+			t.Fatalf("parse %s should fail", spec)
+		}
+	}
+}
+
+func TestParseTmpfs(t *testing.T) {
+	mount, err := ParseTmpfs("/run:ro,size=1g,mode=755")
+	if err != nil {
+		t.Fatalf("parse tmpfs %v", err)
+	}
+	want := Mount{Type: MountTypeTmpfs, Target: "/run", ReadOnly: true, TmpfsSize: 1 << 30, TmpfsMode: 0755}
+	if *mount != want {
+		t.Fatalf("parse tmpfs got %+v want %+v", *mount, want)
+	}
+	for _, spec := range []string{"run", "/run:noexec", "/run:size=abc"} {
+		if _, err := ParseTmpfs(spec); err == nil {
+			t.Fatalf("parse %s should fail", spec)
+		}
+	}
+}
+
+func TestResolveTarget(t *testing.T) {
+	rootfs := t.TempDir()
+	os.MkdirAll(path.Join(rootfs, "real"), 0755)
+	os.Symlink("/real", path.Join(rootfs, "abs"))
+	os.Symlink("../real", path.Join(rootfs, "real", "up"))
+	os.Symlink("../../../etc", path.Join(rootfs, "real", "escape"))
+
+	cases := map[string]string{
+		"/abs/data":     "/real/data",
+		"/real/up/data": "/real/data",
+		"/missing/data": "/missing/data",
+	}
+	for target, want := range cases {
+		got, err := ResolveTarget(rootfs, target)
+		if err != nil {
+			t.Fatalf("resolve %s %v", target, err)
+		}
+		if got != path.Join(rootfs, want) {
+			t.Fatalf("resolve %s got %s want %s", target, got, want)
+		}
+	}
+	if _, err := ResolveTarget(rootfs, "/real/escape/passwd"); err == nil {
+		t.Fatalf("resolve escaping target should fail")
+	}
+}
+
+func TestCopyUpVolume(t *testing.T) {
+	target, volumePath := t.TempDir(), t.TempDir()
+	os.MkdirAll(path.Join(target, "seed"), 0700)
+	os.WriteFile(path.Join(target, "seed", "data"), []byte("seed"), 0640)
+	os.Chown(path.Join(target, "seed", "data"), 1234, 1234)
+	os.Symlink("seed/data", path.Join(target, "link"))
+	os.Chmod(target, 0750)
+	xattr := syscall.Setxattr(path.Join(target, "seed", "data"), "user.seed", []byte("1"), 0) == nil
+
+	if err := copyUpVolume(target, volumePath); err != nil {
+		t.Fatalf("copy up %v", err)
+	}
+	info, err := os.Stat(path.Join(volumePath, "seed", "data"))
+	if err != nil || info.Mode().Perm() != 0640 || info.Sys().(*syscall.Stat_t).Uid != 1234 {
+		t.Fatalf("copied file %v %v", info, err)
+	}
+	if value := make([]byte, 1); xattr {
+		if _, err := syscall.Getxattr(path.Join(volumePath, "seed", "data"), "user.seed", value); err != nil || string(value) != "1" {
+			t.Fatalf("copied xattr %s %v", value, err)
+		}
+	}
+	if link, err := os.Readlink(path.Join(volumePath, "link")); err != nil || link != "seed/data" {
+		t.Fatalf("copied link %s %v", link, err)
+	}
+	if info, _ := os.Stat(volumePath); info.Mode().Perm() != 0750 {
+		t.Fatalf("volume root mode %v", info.Mode())
+	}
+
+	//数据卷不为空时不再复制
+	os.WriteFile(path.Join(target, "new"), []byte("new"), 0644)
+	if err := copyUpVolume(target, volumePath); err != nil {
+		t.Fatalf("copy up %v", err)
+	}
+	if _, err := os.Stat(path.Join(volumePath, "new")); !os.IsNotExist(err) {
+		t.Fatalf("non-empty volume should not be populated")
+	}
+}
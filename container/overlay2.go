@@ -1,9 +1,16 @@
 package container
 
-import "fmt"
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"mydocker/image"
+	"mydocker/utils"
+	"os"
+	"strings"
+	"syscall"
+)
 
 const (
-	ImagePath       = "/var/lib/mydocker/image/"
 	RootPath        = "/var/lib/mydocker/overlay2/"
 	lowerDirFormat  = RootPath + "%s/lower"
 	upperDirFormat  = RootPath + "%s/upper"
@@ -17,11 +24,6 @@ func GetRoot(containerName string) string {
 	return RootPath + containerName
 }
 
-// GetImage 获取镜像的绝对路径
-func GetImage(imageName string) string {
-	return fmt.Sprintf("%s/%s.tar", ImagePath, imageName)
-}
-
 func GetLower(containerName string) string {
 	return fmt.Sprintf(lowerDirFormat, containerName)
 }
@@ -39,3 +41,102 @@ func GetMerge(containerName string) string {
 func GetOverlayFSDirs(lower, upper, work string) string {
 	return fmt.Sprintf(overlayFSFormat, lower, upper, work)
 }
+
+// overlay2 使用内核的overlayfs，镜像层作为lowerdir共享，容器只有自己的upper和work目录
+type overlay2 struct{}
+
+func (o *overlay2) Name() string {
+	return "overlay2"
+}
+
+func (o *overlay2) Prepare(key string, layerDirs []string) error {
+	//镜像层是共享的，容器自己的目录需要单独创建
+	if err := os.MkdirAll(GetRoot(key), 0777); err != nil {
+		return fmt.Errorf("fail to create dir %s, %v", GetRoot(key), err)
+	}
+	//没有任何层的空镜像，用一个空目录作为只读层
+	if len(layerDirs) == 0 {
+		lowerPath := GetLower(key)
+		if err := os.MkdirAll(lowerPath, 0777); err != nil {
+			return fmt.Errorf("fail to create dir %s, %v", lowerPath, err)
+		}
+		layerDirs = []string{lowerPath}
+	}
+	if err := writeLayers(GetRoot(key), layerDirs); err != nil {
+		return err
+	}
+	for _, dir := range []string{GetUpper(key), GetWorker(key), GetMerge(key)} {
+		if err := os.Mkdir(dir, 0777); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("mkdir dir %s error. %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// Mount sudo mount -t overlay -o lowerdir=image-layer,upperdir=container-layer,workdir=work none mnt
+func (o *overlay2) Mount(key string) (string, error) {
+	layerDirs, err := readLayers(GetRoot(key))
+	if err != nil {
+		return "", err
+	}
+	//overlay的lowerdir中越靠前的目录越在上层，而镜像层是从下往上记录的
+	lowerDirs := make([]string, 0, len(layerDirs))
+	for i := len(layerDirs) - 1; i >= 0; i-- {
+		lowerDirs = append(lowerDirs, layerDirs[i])
+	}
+	mergePath := GetMerge(key)
+	options := GetOverlayFSDirs(strings.Join(lowerDirs, ":"), GetUpper(key), GetWorker(key))
+	if err := syscall.Mount("overlay", mergePath, "overlay", 0, options); err != nil {
+		return "", fmt.Errorf("mount overlay on %s error %v", mergePath, err)
+	}
+	return mergePath, nil
+}
+
+func (o *overlay2) Unmount(key string) error {
+	mergePath := GetMerge(key)
+	if err := syscall.Unmount(mergePath, 0); err != nil && err != syscall.EINVAL && !os.IsNotExist(err) {
+		return fmt.Errorf("umount %s error %v", mergePath, err)
+	}
+	return nil
+}
+
+// Commit overlay的upper目录本身就是容器的修改，whiteout在打包时转换成OCI格式
+func (o *overlay2) Commit(key string) (image.Descriptor, string, error) {
+	return image.CreateLayer(GetUpper(key))
+}
+
+func (o *overlay2) Remove(key string) error {
+	if err := removeDirQuota(GetRoot(key)); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(GetRoot(key)); err != nil {
+		return err
+	}
+	logrus.Infof("Remove overlay2 rootfs of %s", key)
+	return nil
+}
+
+func (o *overlay2) Usage(key string) (int64, error) {
+	return utils.DirSize(GetUpper(key))
+}
+
+// SetQuota upper和work目录都在容器目录下，限制整个容器目录的大小
+func (o *overlay2) SetQuota(key string, size int64) error {
+	if err := os.MkdirAll(GetRoot(key), 0777); err != nil {
+		return fmt.Errorf("fail to create dir %s, %v", GetRoot(key), err)
+	}
+	return setDirQuota(GetRoot(key), size)
+}
+
+func (o *overlay2) QuotaUsage(key string) (int64, int64, error) {
+	return dirQuotaUsage(GetRoot(key))
+}
+
+func (o *overlay2) Path(key string) string {
+	return GetMerge(key)
+}
+
+func (o *overlay2) Exists(key string) bool {
+	_, err := os.Stat(GetRoot(key))
+	return err == nil
+}
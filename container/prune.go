@@ -0,0 +1,138 @@
+package container
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"mydocker/utils"
+	"os"
+	"path"
+)
+
+// PruneReport 回收存储驱动中不再需要的数据的结果
+type PruneReport struct {
+	Deleted        []string //被删除的目录
+	SpaceReclaimed int64    //回收的空间
+}
+
+// legacyLowerDir 旧版本为每个容器解压一份完整的镜像作为lower目录，这样的容器目录下没有layers.json
+func legacyLowerDir(key string) (string, bool) {
+	if _, err := os.Stat(path.Join(GetRoot(key), layersFile)); err == nil {
+		return "", false
+	}
+	if info, err := os.Stat(GetLower(key)); err != nil || !info.IsDir() {
+		return "", false
+	}
+	return GetLower(key), true
+}
+
+// LegacyLowerUsage 旧版本的容器自己的镜像副本占用的空间，不是旧版本的容器返回0
+func LegacyLowerUsage(key string) (int64, error) {
+	lowerDir, ok := legacyLowerDir(key)
+	if !ok {
+		return 0, nil
+	}
+	return utils.DirSize(lowerDir)
+}
+
+// PruneLegacyLowerDirs 删除容器已经不存在的旧版本lower目录，containers是所有容器的名字
+// 调用者需要持有镜像存储的排他锁，保证没有正在创建、还没有记录信息的容器
+func PruneLegacyLowerDirs(containers map[string]bool, dryRun bool) (*PruneReport, error) {
+	report := &PruneReport{}
+	entries, err := ioutil.ReadDir(RootPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return report, nil
+		}
+		return nil, err
+	}
+	for _, entry := range entries {
+		key := entry.Name()
+		if !entry.IsDir() || containers[key] {
+			continue
+		}
+		if _, ok := legacyLowerDir(key); !ok || isMountPoint(GetMerge(key)) {
+			continue
+		}
+		size, err := utils.DirSize(GetRoot(key))
+		if err != nil {
+			return nil, err
+		}
+		report.Deleted = append(report.Deleted, GetRoot(key))
+		report.SpaceReclaimed += size
+		if dryRun {
+			continue
+		}
+		if err := snapshotters["overlay2"].Remove(key); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// btrfsChainID 层链的摘要，由下面所有层的摘要和这一层的目录决定
+func btrfsChainID(parent, layerDir string) string {
+	hash := sha256.Sum256([]byte(parent + " " + layerDir))
+	return hex.EncodeToString(hash[:])
+}
+
+// BtrfsLayersUsage btrfs为镜像层创建的只读子卷占用的空间，子卷之间共享的数据块会重复计算
+func BtrfsLayersUsage() (int64, error) {
+	return utils.DirSize(path.Join(BtrfsRootPath, "layers"))
+}
+
+// PruneBtrfsLayers 删除不属于layers中任何一个镜像、也不属于任何btrfs容器的镜像层子卷
+// layers是保留下来的镜像各自的镜像层目录(从下到上)，被删除的子卷在需要时会重新创建
+// 调用者需要持有镜像存储的排他锁
+func PruneBtrfsLayers(layers [][]string, dryRun bool) (*PruneReport, error) {
+	report := &PruneReport{}
+	layersPath := path.Join(BtrfsRootPath, "layers")
+	entries, err := ioutil.ReadDir(layersPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return report, nil
+		}
+		return nil, err
+	}
+	//容器的快照不依赖镜像层子卷，保留它们只是为了commit时不需要重新创建
+	containerEntries, err := ioutil.ReadDir(path.Join(BtrfsRootPath, "containers"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range containerEntries {
+		if layerDirs, err := readLayers(btrfsContainerPath(entry.Name())); err == nil {
+			layers = append(layers, layerDirs)
+		}
+	}
+	keep := map[string]bool{}
+	for _, layerDirs := range layers {
+		chainID := ""
+		for _, layerDir := range layerDirs {
+			chainID = btrfsChainID(chainID, layerDir)
+			keep[chainID] = true
+		}
+	}
+
+	for _, entry := range entries {
+		if keep[entry.Name()] {
+			continue
+		}
+		layerPath := path.Join(layersPath, entry.Name())
+		size, err := utils.DirSize(layerPath)
+		if err != nil {
+			return nil, err
+		}
+		report.Deleted = append(report.Deleted, layerPath)
+		report.SpaceReclaimed += size
+		if dryRun {
+			continue
+		}
+		//子卷不能用rmdir删除，只有中断的操作留下的普通目录才直接删除
+		if err := subvolDelete(layersPath, entry.Name()); err != nil {
+			if removeErr := os.RemoveAll(layerPath); removeErr != nil {
+				return nil, err
+			}
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,41 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPruneBtrfsLayers(t *testing.T) {
+	BtrfsRootPath = t.TempDir()
+	//不在btrfs上时子卷就是普通目录
+	base, app := btrfsChainID("", "/layers/base"), btrfsChainID(btrfsChainID("", "/layers/base"), "/layers/app")
+	committed := btrfsChainID(base, "/layers/committed")
+	for _, name := range []string{base, app, committed, "deleted", app + "-tmp"} {
+		if err := os.MkdirAll(filepath.Join(BtrfsRootPath, "layers", name), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	containerPath := btrfsContainerPath("web")
+	if err := os.MkdirAll(containerPath, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeLayers(containerPath, []string{"/layers/base", "/layers/committed"}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := PruneBtrfsLayers([][]string{{"/layers/base", "/layers/app"}}, false)
+	if err != nil {
+		t.Fatalf("prune %v", err)
+	}
+	if len(report.Deleted) != 2 {
+		t.Fatalf("deleted %v", report.Deleted)
+	}
+	entries, err := os.ReadDir(filepath.Join(BtrfsRootPath, "layers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("layers left %v", entries)
+	}
+}
@@ -0,0 +1,349 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mydocker/utils"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// 每个有大小限制的容器目录下记录限制的方式
+	quotaFile = "quota.json"
+
+	quotaTypeProject = "project"
+	quotaTypeLoop    = "loop"
+
+	// 容器使用的project id从这里开始分配，避开系统中手工配置的project
+	baseProjectID = 100000
+
+	// linux/fs.h 中的ioctl和标志
+	fsIocFsGetXattr     = 0x801c581f // _IOR('X', 31, struct fsxattr)
+	fsIocFsSetXattr     = 0x401c5820 // _IOW('X', 32, struct fsxattr)
+	fsXflagProjInherit  = 0x200
+	backingFsBlockDev   = "backingFsBlockDev"
+	quotaSubCmdShift    = 8
+	prjQuota            = 2
+	qXGetQuota          = 0x5803 // XQM_CMD(3)
+	qXSetQLim           = 0x5804 // XQM_CMD(4)
+	fsDquotVersion      = 1
+	fsProjQuota         = 2
+	fsDqBHard           = 1 << 3
+	fsDqBSoft           = 1 << 2
+	quotaBasicBlockSize = 512
+)
+
+// StorageOpts 容器根文件系统的选项
+type StorageOpts struct {
+	Driver   string //存储驱动，为空时自动选择
+	Size     int64  //可写层的大小限制，单位字节，0表示不限制
+	Rootfs   string //不使用镜像，直接用这个目录作为只读层
+	RootfsRW bool   //直接在Rootfs目录上运行，不使用存储驱动
+}
+
+// ParseStorageOpts 解析--storage-opt参数，目前只支持size=，例如size=10G
+func ParseStorageOpts(driver string, opts []string) (StorageOpts, error) {
+	storage := StorageOpts{Driver: driver}
+	for _, opt := range opts {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return storage, fmt.Errorf("invalid storage option %q", opt)
+		}
+		switch strings.ToLower(kv[0]) {
+		case "size":
+			size, err := utils.ParseSize(kv[1])
+			if err != nil {
+				return storage, err
+			}
+			if size <= 0 {
+				return storage, fmt.Errorf("invalid storage option %q, size must be positive", opt)
+			}
+			storage.Size = size
+		default:
+			return storage, fmt.Errorf("unknown storage option %s", kv[0])
+		}
+	}
+	return storage, nil
+}
+
+// Quota 支持限制容器可写层大小的存储驱动
+type Quota interface {
+	// SetQuota 在Prepare之前调用，限制容器可写层的大小
+	SetQuota(key string, size int64) error
+	// QuotaUsage 可写层已经使用的空间和限制，没有限制时limit为0
+	QuotaUsage(key string) (used, limit int64, err error)
+}
+
+// dirQuota 记录一个目录的大小限制是怎样实现的
+type dirQuota struct {
+	Type      string `json:"type"`                 //project或者loop
+	Size      int64  `json:"size"`                 //大小限制
+	ProjectID uint32 `json:"project_id,omitempty"` //project quota使用的project id
+}
+
+// fsxattr linux/fs.h 中的struct fsxattr
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+// fsDiskQuota linux/dqblk_xfs.h 中的struct fs_disk_quota，ext4也支持这套接口
+type fsDiskQuota struct {
+	version      int8
+	flags        int8
+	fieldmask    uint16
+	id           uint32
+	blkHardlimit uint64
+	blkSoftlimit uint64
+	inoHardlimit uint64
+	inoSoftlimit uint64
+	bcount       uint64
+	icount       uint64
+	itimer       int32
+	btimer       int32
+	iwarns       uint16
+	bwarns       uint16
+	itimerHi     int8
+	btimerHi     int8
+	rtbtimerHi   int8
+	padding2     int8
+	rtbHardlimit uint64
+	rtbSoftlimit uint64
+	rtbcount     uint64
+	rtbtimer     int32
+	rtbwarns     uint16
+	padding3     int16
+	padding4     [8]byte
+}
+
+// setDirQuota 限制目录dir能使用的空间，dir需要是空目录，里面的文件在之后创建
+// 所在的文件系统支持project quota(xfs或者开启了prjquota的ext4)时使用project quota，
+// 否则创建一个稀疏文件格式化成ext4，通过loop设备挂载到dir上
+func setDirQuota(dir string, size int64) error {
+	quota, err := setProjectQuota(dir, size)
+	if err != nil {
+		quota, err = setLoopQuota(dir, size, err)
+		if err != nil {
+			return err
+		}
+	}
+	content, err := json.Marshal(quota)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(dir, quotaFile), content, 0644)
+}
+
+func readDirQuota(dir string) (*dirQuota, error) {
+	content, err := ioutil.ReadFile(path.Join(dir, quotaFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var quota dirQuota
+	if err := json.Unmarshal(content, &quota); err != nil {
+		return nil, err
+	}
+	return &quota, nil
+}
+
+// dirQuotaUsage 目录已经使用的空间和限制，没有限制时返回0
+func dirQuotaUsage(dir string) (int64, int64, error) {
+	quota, err := readDirQuota(dir)
+	if err != nil || quota == nil {
+		return 0, 0, err
+	}
+	switch quota.Type {
+	case quotaTypeProject:
+		d, err := getProjectQuota(path.Dir(path.Clean(dir)), quota.ProjectID)
+		if err != nil {
+			return 0, quota.Size, err
+		}
+		return int64(d.bcount) * quotaBasicBlockSize, quota.Size, nil
+	default:
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(dir, &stat); err != nil {
+			return 0, quota.Size, err
+		}
+		return int64(stat.Blocks-stat.Bfree) * stat.Bsize, quota.Size, nil
+	}
+}
+
+// removeDirQuota 删除目录之前调用，卸载loop设备或者清除project的限制
+func removeDirQuota(dir string) error {
+	quota, err := readDirQuota(dir)
+	if err != nil || quota == nil {
+		return err
+	}
+	if quota.Type == quotaTypeProject {
+		return setProjectLimit(path.Dir(path.Clean(dir)), quota.ProjectID, 0)
+	}
+	//loop设备在挂载时设置了autoclear，卸载之后自动释放
+	if err := syscall.Unmount(dir, 0); err != nil && err != syscall.EINVAL {
+		return fmt.Errorf("umount quota of %s error %v", dir, err)
+	}
+	return nil
+}
+
+// setProjectQuota 为目录分配一个新的project id，设置继承标志让里面新建的文件使用同一个id，然后设置限制
+func setProjectQuota(dir string, size int64) (*dirQuota, error) {
+	parent := path.Dir(path.Clean(dir))
+	//分配project id时锁住父目录，防止同时启动的容器拿到同一个id
+	lock, err := os.Open(parent)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return nil, err
+	}
+
+	projectID, err := nextProjectID(parent)
+	if err != nil {
+		return nil, err
+	}
+	if err := setProjectID(dir, projectID); err != nil {
+		return nil, err
+	}
+	if err := setProjectLimit(parent, projectID, size); err != nil {
+		setProjectID(dir, 0)
+		return nil, err
+	}
+	return &dirQuota{Type: quotaTypeProject, Size: size, ProjectID: projectID}, nil
+}
+
+// nextProjectID 在父目录下所有子目录已经使用的project id之后分配
+func nextProjectID(parent string) (uint32, error) {
+	entries, err := ioutil.ReadDir(parent)
+	if err != nil {
+		return 0, err
+	}
+	next := uint32(baseProjectID)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		attr, err := getFsXattr(path.Join(parent, entry.Name()))
+		if err != nil {
+			return 0, err
+		}
+		if attr.projid >= next {
+			next = attr.projid + 1
+		}
+	}
+	return next, nil
+}
+
+func getFsXattr(dir string) (*fsxattr, error) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var attr fsxattr
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), fsIocFsGetXattr, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return nil, fmt.Errorf("get project id of %s error %v", dir, errno)
+	}
+	return &attr, nil
+}
+
+func setProjectID(dir string, projectID uint32) error {
+	attr, err := getFsXattr(dir)
+	if err != nil {
+		return err
+	}
+	attr.projid = projectID
+	attr.xflags |= fsXflagProjInherit
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), fsIocFsSetXattr, uintptr(unsafe.Pointer(attr))); errno != 0 {
+		return fmt.Errorf("set project id of %s error %v", dir, errno)
+	}
+	return nil
+}
+
+// setProjectLimit 设置project的空间限制，size为0时清除限制
+func setProjectLimit(parent string, projectID uint32, size int64) error {
+	d := fsDiskQuota{
+		version:      fsDquotVersion,
+		flags:        fsProjQuota,
+		fieldmask:    fsDqBHard | fsDqBSoft,
+		id:           projectID,
+		blkHardlimit: uint64(size) / quotaBasicBlockSize,
+		blkSoftlimit: uint64(size) / quotaBasicBlockSize,
+	}
+	return quotactl(parent, qXSetQLim, projectID, unsafe.Pointer(&d))
+}
+
+func getProjectQuota(parent string, projectID uint32) (*fsDiskQuota, error) {
+	var d fsDiskQuota
+	if err := quotactl(parent, qXGetQuota, projectID, unsafe.Pointer(&d)); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// quotactl 需要文件系统所在的块设备，在父目录下创建一个对应的设备文件
+func quotactl(parent string, cmd int, projectID uint32, addr unsafe.Pointer) error {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(parent, &stat); err != nil {
+		return err
+	}
+	device := path.Join(parent, backingFsBlockDev)
+	os.Remove(device)
+	if err := syscall.Mknod(device, syscall.S_IFBLK|0600, int(stat.Dev)); err != nil {
+		return fmt.Errorf("mknod %s error %v", device, err)
+	}
+	devicePtr, err := syscall.BytePtrFromString(device)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_QUOTACTL, uintptr(cmd<<quotaSubCmdShift|prjQuota),
+		uintptr(unsafe.Pointer(devicePtr)), uintptr(projectID), uintptr(addr), 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("quotactl on %s error %v", device, errno)
+	}
+	return nil
+}
+
+// setLoopQuota 在dir中创建稀疏的ext4镜像文件，然后把它挂载到dir上，镜像文件被挂载点盖住
+func setLoopQuota(dir string, size int64, projectErr error) (*dirQuota, error) {
+	imagePath := path.Join(dir, "disk.img")
+	file, err := os.OpenFile(imagePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = file.Truncate(size)
+	file.Close()
+	if err != nil {
+		os.Remove(imagePath)
+		return nil, err
+	}
+	//没有日志和保留块，所有空间都留给容器
+	if output, err := exec.Command("mkfs.ext4", "-q", "-F", "-m", "0", "-O", "^has_journal", imagePath).CombinedOutput(); err != nil {
+		os.Remove(imagePath)
+		return nil, fmt.Errorf("project quota not supported (%v), mkfs.ext4 error %v %s", projectErr, err, output)
+	}
+	if output, err := exec.Command("mount", "-o", "loop", imagePath, dir).CombinedOutput(); err != nil {
+		os.Remove(imagePath)
+		return nil, fmt.Errorf("project quota not supported (%v), mount loop device error %v %s", projectErr, err, output)
+	}
+	//ext4根目录下的lost+found不属于容器的数据
+	os.Remove(path.Join(dir, "lost+found"))
+	return &dirQuota{Type: quotaTypeLoop, Size: size}, nil
+}
@@ -0,0 +1,31 @@
+package container
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestQuotaStructSize(t *testing.T) {
+	//和内核中struct fsxattr、struct fs_disk_quota的大小一致
+	if size := unsafe.Sizeof(fsxattr{}); size != 28 {
+		t.Fatalf("fsxattr size %d", size)
+	}
+	if size := unsafe.Sizeof(fsDiskQuota{}); size != 112 {
+		t.Fatalf("fs_disk_quota size %d", size)
+	}
+}
+
+func TestParseStorageOpts(t *testing.T) {
+	storage, err := ParseStorageOpts("overlay2", []string{"size=10G"})
+	if err != nil {
+		t.Fatalf("parse %v", err)
+	}
+	if storage.Driver != "overlay2" || storage.Size != 10<<30 {
+		t.Fatalf("parse got %+v", storage)
+	}
+	for _, opt := range []string{"size", "size=0", "size=abc", "inodes=100"} {
+		if _, err := ParseStorageOpts("", []string{opt}); err == nil {
+			t.Fatalf("parse %s should fail", opt)
+		}
+	}
+}
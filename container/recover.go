@@ -0,0 +1,133 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"mydocker/utils"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// storageRoot 存储驱动保存容器根文件系统的目录，目录下每一项的名字就是容器名
+type storageRoot struct {
+	dir string
+	sn  Snapshotter
+}
+
+func storageRoots() []storageRoot {
+	return []storageRoot{
+		{RootPath, snapshotters["overlay2"]},
+		{VfsRootPath, snapshotters["vfs"]},
+		{path.Join(BtrfsRootPath, "containers"), snapshotters["btrfs"]},
+		{DirectRootPath, rootfsDir},
+	}
+}
+
+// RecoverStorage 对照/proc/self/mountinfo和各个存储驱动的目录，找出不属于keep中任何容器的挂载和根文件系统
+// 先卸载泄漏的挂载(overlay、数据卷、hosts等)，再删除孤立的容器目录
+func RecoverStorage(keep map[string]bool) ([]utils.Repair, error) {
+	mountPoints, err := readMountPoints()
+	if err != nil {
+		return nil, err
+	}
+	//深的挂载点先卸载
+	sort.Sort(sort.Reverse(sort.StringSlice(mountPoints)))
+
+	var repairs []utils.Repair
+	for _, root := range storageRoots() {
+		for _, mountPoint := range mountPoints {
+			key, ok := storageKey(root.dir, mountPoint)
+			if !ok || keep[key] {
+				continue
+			}
+			mountPoint := mountPoint
+			repairs = append(repairs, utils.Repair{
+				Description: fmt.Sprintf("unmount leaked mount %s", mountPoint),
+				Fix: func() error {
+					return syscall.Unmount(mountPoint, syscall.MNT_DETACH)
+				},
+			})
+		}
+
+		entries, err := ioutil.ReadDir(root.dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() || keep[entry.Name()] {
+				continue
+			}
+			key, root, dir := entry.Name(), root, path.Join(root.dir, entry.Name())
+			repairs = append(repairs, utils.Repair{
+				Description: fmt.Sprintf("remove orphaned %s rootfs %s", root.sn.Name(), dir),
+				Fix: func() error {
+					//卸载失败时不能删除，否则会删到挂载在里面的数据卷
+					mountPoints, err := readMountPoints()
+					if err != nil {
+						return err
+					}
+					for _, mountPoint := range mountPoints {
+						if k, ok := storageKey(root.dir, mountPoint); ok && k == key {
+							return fmt.Errorf("%s is still mounted", mountPoint)
+						}
+					}
+					return root.sn.Remove(key)
+				},
+			})
+		}
+	}
+	return repairs, nil
+}
+
+// storageKey 挂载点位于存储驱动目录之下时返回它所属的容器名
+func storageKey(root, mountPoint string) (string, bool) {
+	root = path.Clean(root) + "/"
+	if !strings.HasPrefix(mountPoint, root) {
+		return "", false
+	}
+	return strings.SplitN(strings.TrimPrefix(mountPoint, root), "/", 2)[0], true
+}
+
+// readMountPoints 读取/proc/self/mountinfo中所有的挂载点，第5列是挂载点
+func readMountPoints() ([]string, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var mountPoints []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), " ")
+		if len(fields) < 5 {
+			continue
+		}
+		mountPoints = append(mountPoints, unescapeMountInfo(fields[4]))
+	}
+	return mountPoints, scanner.Err()
+}
+
+// unescapeMountInfo mountinfo中空格、制表符、换行和反斜杠被转义成\040这样的八进制
+func unescapeMountInfo(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,23 @@
+package container
+
+import "testing"
+
+func TestStorageKey(t *testing.T) {
+	cases := map[string]string{
+		"/var/lib/mydocker/overlay2/web/merged":                "web",
+		"/var/lib/mydocker/overlay2/web/merged/data":           "web",
+		"/var/lib/mydocker/overlay2/web":                       "web",
+		"/var/lib/mydocker/overlay2":                           "",
+		"/var/lib/mydocker/overlay2-other/web":                 "",
+		unescapeMountInfo(`/var/lib/mydocker/vfs/a\040b/root`): "",
+	}
+	for mountPoint, want := range cases {
+		key, _ := storageKey(RootPath, mountPoint)
+		if key != want {
+			t.Errorf("storageKey(%s) = %q, want %q", mountPoint, key, want)
+		}
+	}
+	if key, ok := storageKey(VfsRootPath, unescapeMountInfo(`/var/lib/mydocker/vfs/a\040b/rootfs`)); !ok || key != "a b" {
+		t.Errorf("escaped mount point key %q", key)
+	}
+}
@@ -0,0 +1,70 @@
+package container
+
+import (
+	"fmt"
+	"mydocker/image"
+	"os"
+)
+
+const DirectRootPath = "/var/lib/mydocker/rootfs/"
+
+// directRootfs run --rootfs-rw 直接把用户指定的目录作为容器的根文件系统，容器的修改直接写到目录中
+// 这个驱动只记录目录的位置，删除容器时不会删除目录本身，不能通过--storage-driver选择
+type directRootfs struct{}
+
+var rootfsDir = &directRootfs{}
+
+func directRoot(key string) string {
+	return DirectRootPath + key
+}
+
+func (d *directRootfs) Name() string {
+	return "rootfs"
+}
+
+func (d *directRootfs) Prepare(key string, layerDirs []string) error {
+	if len(layerDirs) != 1 {
+		return fmt.Errorf("rootfs driver needs exactly one directory, got %d", len(layerDirs))
+	}
+	if err := os.MkdirAll(directRoot(key), 0700); err != nil {
+		return err
+	}
+	return writeLayers(directRoot(key), layerDirs)
+}
+
+// Mount 根文件系统就是用户的目录，pivotRoot时会bind mount到自身
+func (d *directRootfs) Mount(key string) (string, error) {
+	return d.Path(key), nil
+}
+
+func (d *directRootfs) Unmount(key string) error {
+	return nil
+}
+
+// Commit 没有镜像作为比较的基础，无法得到容器的修改
+func (d *directRootfs) Commit(key string) (image.Descriptor, string, error) {
+	return image.Descriptor{}, "", fmt.Errorf("can not commit container %s running on --rootfs-rw", key)
+}
+
+// Remove 只删除记录，用户的目录保持不变
+func (d *directRootfs) Remove(key string) error {
+	return os.RemoveAll(directRoot(key))
+}
+
+// Usage 容器的修改和目录原有的内容混在一起，无法单独统计
+func (d *directRootfs) Usage(key string) (int64, error) {
+	return 0, nil
+}
+
+func (d *directRootfs) Path(key string) string {
+	layerDirs, err := readLayers(directRoot(key))
+	if err != nil || len(layerDirs) != 1 {
+		return directRoot(key)
+	}
+	return layerDirs[0]
+}
+
+func (d *directRootfs) Exists(key string) bool {
+	_, err := os.Stat(directRoot(key))
+	return err == nil
+}
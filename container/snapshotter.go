@@ -0,0 +1,159 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"mydocker/image"
+	"os"
+	"path"
+	"sort"
+	"syscall"
+)
+
+const (
+	DefaultStorageDriver = "overlay2"
+	// 每个容器目录下记录容器使用的镜像层(从下到上)
+	layersFile = "layers.json"
+)
+
+// Snapshotter 存储驱动，负责为容器准备根文件系统，以及把容器的修改提交成镜像层
+// key是容器名，每个驱动把容器的数据保存在自己的目录下
+type Snapshotter interface {
+	// Name 存储驱动的名字，即--storage-driver的值
+	Name() string
+	// Prepare 在镜像的各层(从下到上)之上为容器创建可写的根文件系统
+	Prepare(key string, layerDirs []string) error
+	// Mount 挂载容器的根文件系统，返回根文件系统的路径
+	Mount(key string) (string, error)
+	// Unmount 卸载容器的根文件系统
+	Unmount(key string) error
+	// Commit 把容器相对于镜像的修改打包成一个镜像层，返回镜像层的描述和diffID
+	Commit(key string) (image.Descriptor, string, error)
+	// Remove 删除容器的根文件系统，调用前需要先Unmount
+	Remove(key string) error
+	// Usage 容器自己的可写部分占用的空间
+	Usage(key string) (int64, error)
+	// Path 容器根文件系统的路径
+	Path(key string) string
+	// Exists 容器的根文件系统是否由这个驱动管理
+	Exists(key string) bool
+}
+
+var snapshotters = map[string]Snapshotter{
+	"btrfs":    &btrfs{},
+	"overlay2": &overlay2{},
+	"vfs":      &vfs{},
+}
+
+// GetSnapshotter 根据名字获取存储驱动
+// 名字为空时，/var/lib/mydocker在btrfs上则使用btrfs，否则使用默认的overlay2
+func GetSnapshotter(name string) (Snapshotter, error) {
+	if name == "" {
+		name = DefaultStorageDriver
+		if isBtrfs(BtrfsRootPath) {
+			name = "btrfs"
+		}
+	}
+	sn, ok := snapshotters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage driver %s", name)
+	}
+	return sn, nil
+}
+
+// LookupSnapshotter 找到管理容器根文件系统的存储驱动，找不到时返回默认驱动
+func LookupSnapshotter(key string) Snapshotter {
+	var names []string
+	for name := range snapshotters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if snapshotters[name].Exists(key) {
+			return snapshotters[name]
+		}
+	}
+	if rootfsDir.Exists(key) {
+		return rootfsDir
+	}
+	return snapshotters[DefaultStorageDriver]
+}
+
+// MountRootfsView 把容器的根文件系统挂载到一个临时目录，返回路径和清理函数
+// 不递归的bind mount不包含数据卷和hosts等挂载，只有容器自己的文件
+// 容器已经停止、根文件系统没有挂载时临时挂载，清理时再卸载
+func MountRootfsView(key string) (string, func(), error) {
+	sn := LookupSnapshotter(key)
+	if !sn.Exists(key) {
+		return "", nil, fmt.Errorf("rootfs of container %s not found", key)
+	}
+	rootfs := sn.Path(key)
+	mounted := isMountPoint(rootfs)
+	if !mounted {
+		var err error
+		if rootfs, err = sn.Mount(key); err != nil {
+			return "", nil, err
+		}
+	}
+	unmountRootfs := func() {
+		if mounted {
+			return
+		}
+		if err := sn.Unmount(key); err != nil {
+			logrus.Errorf("%v", err)
+		}
+	}
+
+	view, err := ioutil.TempDir("", "mydocker-rootfs-")
+	if err != nil {
+		unmountRootfs()
+		return "", nil, err
+	}
+	if err := syscall.Mount(rootfs, view, "", syscall.MS_BIND, ""); err != nil {
+		os.Remove(view)
+		unmountRootfs()
+		return "", nil, fmt.Errorf("bind mount %s error %v", rootfs, err)
+	}
+	cleanup := func() {
+		if err := syscall.Unmount(view, syscall.MNT_DETACH); err != nil {
+			logrus.Errorf("Umount %s error %v", view, err)
+		}
+		os.Remove(view)
+		unmountRootfs()
+	}
+	return view, cleanup, nil
+}
+
+// isMountPoint 和父目录不在同一个设备上的目录是挂载点，overlay挂载之后就是这样
+func isMountPoint(dir string) bool {
+	var stat, parentStat syscall.Stat_t
+	if err := syscall.Stat(dir, &stat); err != nil {
+		return false
+	}
+	if err := syscall.Stat(path.Dir(path.Clean(dir)), &parentStat); err != nil {
+		return false
+	}
+	return stat.Dev != parentStat.Dev
+}
+
+func writeLayers(dir string, layerDirs []string) error {
+	content, err := json.Marshal(layerDirs)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(dir, layersFile), content, 0644)
+}
+
+func readLayers(dir string) ([]string, error) {
+	content, err := ioutil.ReadFile(path.Join(dir, layersFile))
+	if err != nil {
+		return nil, err
+	}
+	var layerDirs []string
+	if err := json.Unmarshal(content, &layerDirs); err != nil {
+		return nil, fmt.Errorf("unmarshal %s error %v", layersFile, err)
+	}
+	return layerDirs, nil
+}
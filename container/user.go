@@ -0,0 +1,112 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	passwdFile = "/etc/passwd"
+	groupFile  = "/etc/group"
+)
+
+// setUpUser 切换到指定的用户运行，user为空时保持root
+// 用户名和组名从容器内的/etc/passwd和/etc/group中查找
+func setUpUser(user string) error {
+	if user == "" {
+		return nil
+	}
+	userPart, groupPart := user, ""
+	if i := strings.Index(user, ":"); i >= 0 {
+		userPart, groupPart = user[:i], user[i+1:]
+	}
+
+	uid, gid, err := lookupUser(userPart)
+	if err != nil {
+		return err
+	}
+	if groupPart != "" {
+		if gid, err = lookupGroup(groupPart); err != nil {
+			return err
+		}
+	}
+
+	//先清空附加组并设置gid，setuid之后就没有权限再修改了
+	if err := syscall.Setgroups([]int{}); err != nil {
+		return fmt.Errorf("setgroups error %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid %d error %v", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid %d error %v", uid, err)
+	}
+	return nil
+}
+
+// lookupUser 返回用户的uid和默认gid，数字形式的uid在/etc/passwd中找不到时gid为0
+func lookupUser(user string) (int, int, error) {
+	uid, numericErr := strconv.Atoi(user)
+	entries, err := readColonFile(passwdFile)
+	if err != nil && numericErr != nil {
+		return 0, 0, fmt.Errorf("lookup user %s error %v", user, err)
+	}
+	//passwd每行为 name:password:uid:gid:gecos:home:shell
+	for _, fields := range entries {
+		if len(fields) < 4 {
+			continue
+		}
+		if fields[0] == user || (numericErr == nil && fields[2] == user) {
+			entryUID, err1 := strconv.Atoi(fields[2])
+			entryGID, err2 := strconv.Atoi(fields[3])
+			if err1 == nil && err2 == nil {
+				return entryUID, entryGID, nil
+			}
+		}
+	}
+	if numericErr == nil {
+		return uid, 0, nil
+	}
+	return 0, 0, fmt.Errorf("no such user %s", user)
+}
+
+// lookupGroup 返回组的gid
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	entries, err := readColonFile(groupFile)
+	if err != nil {
+		return 0, fmt.Errorf("lookup group %s error %v", group, err)
+	}
+	//group每行为 name:password:gid:members
+	for _, fields := range entries {
+		if len(fields) >= 3 && fields[0] == group {
+			return strconv.Atoi(fields[2])
+		}
+	}
+	return 0, fmt.Errorf("no such group %s", group)
+}
+
+func readColonFile(filePath string) ([][]string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries [][]string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,213 @@
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mydocker/image"
+	"mydocker/utils"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const VfsRootPath = "/var/lib/mydocker/vfs/"
+
+// vfs 不依赖任何特殊文件系统，把镜像的所有层完整复制一份作为容器的根文件系统
+// 占用空间大、创建慢，但是在不支持overlay的环境(例如嵌套容器)中也能使用
+type vfs struct{}
+
+func vfsRoot(key string) string {
+	return VfsRootPath + key
+}
+
+func (v *vfs) Name() string {
+	return "vfs"
+}
+
+func (v *vfs) Prepare(key string, layerDirs []string) error {
+	rootfs := v.Path(key)
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return fmt.Errorf("fail to create dir %s, %v", rootfs, err)
+	}
+	if err := writeLayers(vfsRoot(key), layerDirs); err != nil {
+		return err
+	}
+	for _, layerDir := range layerDirs {
+		if err := image.ApplyLayer(rootfs, layerDir, nil); err != nil {
+			return fmt.Errorf("copy layer %s error %v", layerDir, err)
+		}
+	}
+	return nil
+}
+
+// Mount 根文件系统就是一个普通目录，不需要挂载，pivotRoot时会bind mount到自身
+func (v *vfs) Mount(key string) (string, error) {
+	return v.Path(key), nil
+}
+
+func (v *vfs) Unmount(key string) error {
+	return nil
+}
+
+// Commit 重新复制出镜像原来的内容，与容器的根文件系统逐个文件比较得到修改
+func (v *vfs) Commit(key string) (image.Descriptor, string, error) {
+	layerDirs, err := readLayers(vfsRoot(key))
+	if err != nil {
+		return image.Descriptor{}, "", err
+	}
+	baseDir, err := ioutil.TempDir(vfsRoot(key), "base-")
+	if err != nil {
+		return image.Descriptor{}, "", err
+	}
+	defer os.RemoveAll(baseDir)
+	for _, layerDir := range layerDirs {
+		if err := image.ApplyLayer(baseDir, layerDir, nil); err != nil {
+			return image.Descriptor{}, "", err
+		}
+	}
+
+	diffDir, err := ioutil.TempDir(vfsRoot(key), "diff-")
+	if err != nil {
+		return image.Descriptor{}, "", err
+	}
+	defer os.RemoveAll(diffDir)
+	if err := diffTree(baseDir, v.Path(key), diffDir); err != nil {
+		return image.Descriptor{}, "", fmt.Errorf("diff rootfs of %s error %v", key, err)
+	}
+	return image.CreateLayer(diffDir)
+}
+
+func (v *vfs) Remove(key string) error {
+	return os.RemoveAll(vfsRoot(key))
+}
+
+func (v *vfs) Usage(key string) (int64, error) {
+	return utils.DirSize(v.Path(key))
+}
+
+func (v *vfs) Path(key string) string {
+	return path.Join(vfsRoot(key), "rootfs")
+}
+
+func (v *vfs) Exists(key string) bool {
+	_, err := os.Stat(vfsRoot(key))
+	return err == nil
+}
+
+// diffTree 比较base和changed两个目录，把changed中新增和修改的文件复制到out中，
+// 删除的文件在out中创建whiteout，得到和overlay的upper目录相同格式的结果
+func diffTree(base, changed, out string) error {
+	err := filepath.Walk(changed, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(changed, filePath)
+		if err != nil || relPath == "." {
+			return err
+		}
+		baseInfo, err := os.Lstat(filepath.Join(base, relPath))
+		if err == nil && sameFile(filepath.Join(base, relPath), filePath, baseInfo, info) {
+			return nil
+		}
+		if err := mkdirParents(changed, out, relPath); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return copyDir(filePath, filepath.Join(out, relPath), info)
+		}
+		return utils.CopyPath(filePath, filepath.Join(out, relPath))
+	})
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(base, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(base, filePath)
+		if err != nil || relPath == "." {
+			return err
+		}
+		changedInfo, err := os.Lstat(filepath.Join(changed, relPath))
+		if err == nil {
+			//目录被替换成了文件，下面的内容不需要再比较
+			if info.IsDir() && !changedInfo.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if err := mkdirParents(changed, out, relPath); err != nil {
+			return err
+		}
+		if err := syscall.Mknod(filepath.Join(out, relPath), syscall.S_IFCHR, 0); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// sameFile 判断文件是否没有被修改，目录只比较权限和属主
+func sameFile(basePath, changedPath string, baseInfo, changedInfo os.FileInfo) bool {
+	baseStat := baseInfo.Sys().(*syscall.Stat_t)
+	changedStat := changedInfo.Sys().(*syscall.Stat_t)
+	if baseInfo.Mode() != changedInfo.Mode() || baseStat.Uid != changedStat.Uid || baseStat.Gid != changedStat.Gid {
+		return false
+	}
+	switch {
+	case baseInfo.IsDir():
+		return true
+	case baseInfo.Mode()&os.ModeSymlink != 0:
+		baseLink, _ := os.Readlink(basePath)
+		changedLink, _ := os.Readlink(changedPath)
+		return baseLink == changedLink
+	case baseInfo.Mode()&(os.ModeDevice|os.ModeCharDevice) != 0:
+		return baseStat.Rdev == changedStat.Rdev
+	default:
+		return baseInfo.Size() == changedInfo.Size() && baseInfo.ModTime().Equal(changedInfo.ModTime())
+	}
+}
+
+// mkdirParents 在out中创建relPath的各级父目录，权限和属主与changed中的保持一致
+func mkdirParents(changed, out, relPath string) error {
+	parts := strings.Split(filepath.Dir(relPath), string(filepath.Separator))
+	current := ""
+	for _, part := range parts {
+		if part == "." {
+			continue
+		}
+		current = filepath.Join(current, part)
+		outPath := filepath.Join(out, current)
+		if _, err := os.Lstat(outPath); err == nil {
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(changed, current))
+		if err != nil {
+			return err
+		}
+		if err := copyDir(filepath.Join(changed, current), outPath, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyDir 只创建目录本身，不复制目录中的内容
+func copyDir(src, dst string, info os.FileInfo) error {
+	if err := os.Mkdir(dst, info.Mode().Perm()); err != nil && !os.IsExist(err) {
+		return err
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	if err := os.Lchown(dst, int(stat.Uid), int(stat.Gid)); err != nil {
+		return err
+	}
+	return os.Chmod(dst, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+}
@@ -0,0 +1,57 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDiffTree(t *testing.T) {
+	base, changed, out := t.TempDir(), t.TempDir(), t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	for _, root := range []string{base, changed} {
+		for _, dir := range []string{"keep", "gone"} {
+			if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, file := range []string{"keep/same", "keep/modified", "keep/deleted", "gone/file"} {
+			filePath := filepath.Join(root, file)
+			if err := os.WriteFile(filePath, []byte("old"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			os.Chtimes(filePath, old, old)
+		}
+	}
+	//容器中修改、删除和新增的文件
+	os.WriteFile(filepath.Join(changed, "keep/modified"), []byte("new content"), 0644)
+	os.Remove(filepath.Join(changed, "keep/deleted"))
+	os.RemoveAll(filepath.Join(changed, "gone"))
+	os.WriteFile(filepath.Join(changed, "added"), []byte("added"), 0644)
+
+	if err := diffTree(base, changed, out); err != nil {
+		t.Fatalf("diff tree %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(out, "keep/same")); !os.IsNotExist(err) {
+		t.Fatalf("unchanged file should not be in diff %v", err)
+	}
+	for _, file := range []string{"keep/modified", "added"} {
+		if _, err := os.Lstat(filepath.Join(out, file)); err != nil {
+			t.Fatalf("%s should be in diff %v", file, err)
+		}
+	}
+	for _, file := range []string{"keep/deleted", "gone"} {
+		info, err := os.Lstat(filepath.Join(out, file))
+		if err != nil {
+			t.Fatalf("%s should be a whiteout %v", file, err)
+		}
+		if info.Mode()&os.ModeCharDevice == 0 || info.Sys().(*syscall.Stat_t).Rdev != 0 {
+			t.Fatalf("%s is not a whiteout %v", file, info.Mode())
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(out, "gone/file")); err == nil {
+		t.Fatalf("files under deleted dir should not be in diff")
+	}
+}
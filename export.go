@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"mydocker/container"
+	"mydocker/image"
+	"os"
+	"path"
+)
+
+// exportContainer 把容器合并之后的根文件系统打包成tar，不包含数据卷中的内容
+// output为空或者是-时写到标准输出
+func exportContainer(containerName, output string) error {
+	if _, err := getContainerInfoByName(containerName); err != nil {
+		return fmt.Errorf("get container info by name %s error %v", containerName, err)
+	}
+	rootfs, cleanup, err := container.MountRootfsView(containerName)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if output == "" || output == "-" {
+		//日志默认输出到标准输出，导出到标准输出时改到标准错误，避免混进tar中
+		logrus.SetOutput(os.Stderr)
+		return image.ExportDir(rootfs, os.Stdout)
+	}
+	//先写临时文件，失败时不会留下不完整的tar
+	tmpPath := path.Join(path.Dir(output), "."+path.Base(output)+".tmp")
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	if err := image.ExportDir(rootfs, file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, output)
+}
+
+// importImage 把一个rootfs的tar包(可以是压缩的，-表示标准输入)导入成单层镜像，changes和commit的--change一样
+func importImage(source, imageName string, changes []string) error {
+	config := image.NewConfig()
+	for _, change := range changes {
+		if err := image.ApplyChange(&config.Config, change); err != nil {
+			return fmt.Errorf("apply change %q error %v", change, err)
+		}
+	}
+
+	var reader io.Reader = os.Stdin
+	if source != "-" {
+		file, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	storeLock, err := image.LockStore(false)
+	if err != nil {
+		return err
+	}
+	defer storeLock.Unlock()
+	layer, diffID, err := image.ImportLayerFrom(reader, source)
+	if err != nil {
+		return fmt.Errorf("import layer from %s error %v", source, err)
+	}
+	config.RootFS.DiffIDs = []string{diffID}
+	config.History = []image.History{{
+		Created:   config.Created,
+		CreatedBy: "mydocker import " + source,
+	}}
+	img, err := image.Save(imageName, config, []image.Descriptor{layer})
+	if err != nil {
+		return fmt.Errorf("save image %s error %v", imageName, err)
+	}
+	fmt.Println(img.ID())
+	return nil
+}
@@ -3,12 +3,16 @@ module mydocker
 go 1.20
 
 require (
+	github.com/klauspost/compress v1.17.9
 	github.com/sirupsen/logrus v1.9.3
+	github.com/ulikunitz/xz v0.5.12
 	github.com/urfave/cli v1.22.15
 	github.com/vishvananda/netlink v1.1.0
 	github.com/vishvananda/netns v0.0.4
-	github.com/cpuguy83/go-md2man/v2 v2.0.4 // indirect
-    github.com/russross/blackfriday/v2 v2.1.0 // indirect
-    golang.org/x/sys v0.2.0 // indirect
+	golang.org/x/sys v0.2.0
 )
 
+require (
+	github.com/cpuguy83/go-md2man/v2 v2.0.4 // indirect
+	github.com/russross/blackfriday/v2 v2.1.0 // indirect
+)
@@ -0,0 +1,371 @@
+package image
+
+import (
+	"archive/tar"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"io"
+	"mydocker/utils"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// tar的PAX扩展头中保存扩展属性的前缀
+const paxXattrPrefix = "SCHILY.xattr."
+
+// ProgressFunc 打包或解包的进度，每处理完一个条目调用一次，参数是已经处理的条目数和文件内容的字节数
+type ProgressFunc func(entries int, bytes int64)
+
+// ArchiveOptions 打包和解包的选项
+type ArchiveOptions struct {
+	// Whiteouts 在overlay的whiteout(0/0字符设备、opaque属性)和OCI的.wh.文件之间转换
+	Whiteouts bool
+	// Progress 不为空时报告进度
+	Progress ProgressFunc
+}
+
+// LogProgress 返回一个每隔几秒用日志输出一次进度的ProgressFunc
+func LogProgress(action, name string) ProgressFunc {
+	last := time.Now()
+	return func(entries int, bytes int64) {
+		if time.Since(last) < 2*time.Second {
+			return
+		}
+		last = time.Now()
+		logrus.Infof("%s %s: %d files, %s", action, name, entries, utils.HumanSize(bytes))
+	}
+}
+
+// Pack 把root下的内容打包成tar写入w，保留属主、权限、修改时间、扩展属性、硬链接和设备文件
+// opts.Whiteouts时overlay的whiteout和opaque目录被转换成OCI的.wh.文件
+func Pack(w io.Writer, root string, opts ArchiveOptions) error {
+	tw := tar.NewWriter(w)
+	//同一个inode的第二次出现写成硬链接
+	inodes := map[uint64]string{}
+	var entries int
+	var bytes int64
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(root, filePath)
+		if err != nil || relPath == "." {
+			return err
+		}
+		entries++
+		if opts.Progress != nil {
+			defer func() { opts.Progress(entries, bytes) }()
+		}
+
+		//overlay中被删除的文件是一个设备号为0/0的字符设备
+		if opts.Whiteouts && isOverlayWhiteout(info) {
+			dir, base := filepath.Split(relPath)
+			return tw.WriteHeader(&tar.Header{
+				Name:     filepath.Join(dir, whiteoutPrefix+base),
+				Typeflag: tar.TypeReg,
+				Mode:     0600,
+				ModTime:  info.ModTime(),
+			})
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(filePath); err != nil {
+				return err
+			}
+		}
+		//FileInfoHeader在linux上会从Stat_t中带上uid/gid以及设备号
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = relPath
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		if info.Mode().IsRegular() && stat.Nlink > 1 {
+			if first, ok := inodes[stat.Ino]; ok {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = first
+				header.Size = 0
+			} else {
+				inodes[stat.Ino] = relPath
+			}
+		}
+		if err := addXattrs(header, filePath); err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			//opaque目录额外写一个.wh..wh..opq标记
+			if opts.Whiteouts && isOverlayOpaque(filePath) {
+				return tw.WriteHeader(&tar.Header{
+					Name:     filepath.Join(relPath, whiteoutOpaqueDir),
+					Typeflag: tar.TypeReg,
+					Mode:     0600,
+					ModTime:  info.ModTime(),
+				})
+			}
+			return nil
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		n, err := io.Copy(tw, file)
+		bytes += n
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// addXattrs 把文件的扩展属性写到PAX扩展头中，overlay自己使用的trusted.overlay.*除外
+func addXattrs(header *tar.Header, filePath string) error {
+	size, err := unix.Llistxattr(filePath, nil)
+	if err != nil || size == 0 {
+		if err == unix.ENOTSUP {
+			return nil
+		}
+		return err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(filePath, buf); err != nil {
+		return err
+	}
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name == "" || strings.HasPrefix(name, "trusted.overlay.") {
+			continue
+		}
+		valueSize, err := unix.Lgetxattr(filePath, name, nil)
+		if err != nil {
+			return err
+		}
+		value := make([]byte, valueSize)
+		if valueSize, err = unix.Lgetxattr(filePath, name, value); err != nil {
+			return err
+		}
+		if header.PAXRecords == nil {
+			header.PAXRecords = map[string]string{}
+		}
+		header.PAXRecords[paxXattrPrefix+name] = string(value[:valueSize])
+	}
+	return nil
+}
+
+// Unpack 在进程内把tar流解包到dest，不依赖宿主机上的tar命令
+// 条目的路径中跳出dest的..会被拒绝，父目录中的符号链接以dest为根解析，硬链接的目标也限制在dest之内，
+// 这样恶意的归档无法通过..或者先解出一个符号链接再往里面写的方式写到dest之外
+// 保留属主、权限、修改时间、扩展属性和设备文件，opts.Whiteouts时把OCI的.wh.文件转换成overlay的whiteout
+func Unpack(r io.Reader, dest string, opts ArchiveOptions) error {
+	tr := tar.NewReader(r)
+	var dirs []*tar.Header
+	var entries int
+	var bytes int64
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name, err := cleanEntryName(header.Name)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+		//父目录中的符号链接在dest之内解析，最后一级是条目自身，不跟随
+		parent, err := utils.SecureJoin(dest, path.Dir(name))
+		if err != nil {
+			return fmt.Errorf("entry %s: %v", header.Name, err)
+		}
+		base := path.Base(name)
+		target := filepath.Join(parent, base)
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+
+		if opts.Whiteouts && strings.HasPrefix(base, whiteoutPrefix) {
+			if err := unpackWhiteout(dest, name); err != nil {
+				return fmt.Errorf("entry %s: %v", header.Name, err)
+			}
+			continue
+		}
+
+		//已经存在的条目被替换，只有目录与目录之间是合并
+		if existing, err := os.Lstat(target); err == nil && !(existing.IsDir() && header.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(target, 0755); err != nil && !os.IsExist(err) {
+				return err
+			}
+			//子条目会修改目录的时间，目录的时间最后再设置
+			dirs = append(dirs, header)
+		case tar.TypeReg, tar.TypeRegA:
+			n, err := unpackFile(tr, target)
+			bytes += n
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			linkName, err := cleanEntryName(header.Linkname)
+			if err != nil || linkName == "" {
+				return fmt.Errorf("entry %s: invalid hard link target %s", header.Name, header.Linkname)
+			}
+			linkParent, err := utils.SecureJoin(dest, path.Dir(linkName))
+			if err != nil {
+				return fmt.Errorf("entry %s: %v", header.Name, err)
+			}
+			if err := os.Link(filepath.Join(linkParent, path.Base(linkName)), target); err != nil {
+				return err
+			}
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			mode := uint32(header.Mode & 07777)
+			switch header.Typeflag {
+			case tar.TypeChar:
+				mode |= syscall.S_IFCHR
+			case tar.TypeBlock:
+				mode |= syscall.S_IFBLK
+			default:
+				mode |= syscall.S_IFIFO
+			}
+			if err := syscall.Mknod(target, mode, int(unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor)))); err != nil {
+				return err
+			}
+		default:
+			logrus.Warnf("Skip unsupported tar entry %s type %c", header.Name, header.Typeflag)
+			continue
+		}
+
+		if header.Typeflag != tar.TypeLink {
+			if err := setMetadata(target, header); err != nil {
+				return fmt.Errorf("entry %s: %v", header.Name, err)
+			}
+		}
+		entries++
+		if opts.Progress != nil {
+			opts.Progress(entries, bytes)
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		name, _ := cleanEntryName(dirs[i].Name)
+		target, err := utils.SecureJoin(dest, name)
+		if err != nil {
+			return err
+		}
+		mtime := unix.NsecToTimespec(dirs[i].ModTime.UnixNano())
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, target, []unix.Timespec{mtime, mtime}, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanEntryName 去掉开头的/和./，包含跳出归档根目录的..时返回错误，归档根目录本身返回空
+func cleanEntryName(name string) (string, error) {
+	cleaned := path.Clean(strings.TrimLeft(name, "/"))
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("entry %s escapes the archive root", name)
+	}
+	if cleaned == "." {
+		return "", nil
+	}
+	return cleaned, nil
+}
+
+// unpackWhiteout .wh..wh..opq把所在目录标记为opaque，.wh.<name>变成name位置上的0/0字符设备
+// 被删除的名字必须是目录中的一项，.wh...和.wh.会删掉上一级目录或者dest本身
+func unpackWhiteout(dest, name string) error {
+	dir, err := utils.SecureJoin(dest, path.Dir(name))
+	if err != nil {
+		return err
+	}
+	base := path.Base(name)
+	if base == whiteoutOpaqueDir {
+		return syscall.Setxattr(dir, overlayOpaqueXattr, []byte("y"), 0)
+	}
+	deleted := strings.TrimPrefix(base, whiteoutPrefix)
+	if deleted == "" || deleted == "." || deleted == ".." || strings.Contains(deleted, "/") {
+		return fmt.Errorf("invalid whiteout %s", base)
+	}
+	//最后一级不跟随符号链接，删除的是链接本身
+	target := filepath.Join(dir, deleted)
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+	return syscall.Mknod(target, syscall.S_IFCHR, 0)
+}
+
+func unpackFile(r io.Reader, target string) (int64, error) {
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// setMetadata 先chown再设置扩展属性和权限，chown会清掉setuid位和security.capability
+func setMetadata(target string, header *tar.Header) error {
+	if err := os.Lchown(target, header.Uid, header.Gid); err != nil {
+		return err
+	}
+	for key, value := range header.PAXRecords {
+		if !strings.HasPrefix(key, paxXattrPrefix) {
+			continue
+		}
+		attr := strings.TrimPrefix(key, paxXattrPrefix)
+		if err := unix.Lsetxattr(target, attr, []byte(value), 0); err != nil && err != unix.ENOTSUP {
+			return fmt.Errorf("set xattr %s error %v", attr, err)
+		}
+	}
+	if header.Typeflag != tar.TypeSymlink {
+		mode := os.FileMode(header.Mode).Perm()
+		if header.Mode&04000 != 0 {
+			mode |= os.ModeSetuid
+		}
+		if header.Mode&02000 != 0 {
+			mode |= os.ModeSetgid
+		}
+		if header.Mode&01000 != 0 {
+			mode |= os.ModeSticky
+		}
+		if err := os.Chmod(target, mode); err != nil {
+			return err
+		}
+	}
+	mtime := unix.NsecToTimespec(header.ModTime.UnixNano())
+	return unix.UtimesNanoAt(unix.AT_FDCWD, target, []unix.Timespec{mtime, mtime}, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,217 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func buildTar(t *testing.T, headers ...*tar.Header) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, header := range headers {
+		if header.Typeflag == tar.TypeReg && header.Mode == 0 {
+			header.Mode = 0644
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestUnpackTraversal(t *testing.T) {
+	cases := map[string][]*tar.Header{
+		"dotdot": {{Name: "../evil", Typeflag: tar.TypeReg}},
+		//先解出一个指向外部的符号链接，再通过它写文件
+		"symlink parent": {
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../../outside"},
+			{Name: "link/evil", Typeflag: tar.TypeReg},
+		},
+		"absolute symlink parent": {
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/outside"},
+			{Name: "link/evil", Typeflag: tar.TypeReg},
+		},
+		"hardlink": {{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../outside/passwd"}},
+	}
+	for name, headers := range cases {
+		t.Run(name, func(t *testing.T) {
+			root := t.TempDir()
+			outside := filepath.Join(root, "outside")
+			if err := os.Mkdir(outside, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(outside, "passwd"), []byte("secret"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			dest := filepath.Join(root, "a", "dest")
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+			err := Unpack(buildTar(t, headers...), dest, ArchiveOptions{})
+			if _, statErr := os.Lstat(filepath.Join(outside, "evil")); statErr == nil {
+				t.Fatalf("file written outside of dest")
+			}
+			if _, statErr := os.Lstat(filepath.Join(root, "a", "evil")); statErr == nil {
+				t.Fatalf("file written outside of dest")
+			}
+			if name != "absolute symlink parent" {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			//绝对路径的符号链接以dest为根解析，文件落在dest之内
+			if err != nil {
+				t.Fatalf("unpack %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dest, "outside", "evil")); err != nil {
+				t.Fatalf("file should be scoped to dest %v", err)
+			}
+		})
+	}
+}
+
+func TestUnpackWhiteoutTraversal(t *testing.T) {
+	cases := map[string][]*tar.Header{
+		"dotdot":        {{Name: ".wh...", Typeflag: tar.TypeReg}},
+		"empty":         {{Name: ".wh.", Typeflag: tar.TypeReg}},
+		"nested dotdot": {{Name: "sub/", Typeflag: tar.TypeDir}, {Name: "sub/.wh...", Typeflag: tar.TypeReg}},
+		"symlink parent": {
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../../sibling"},
+			{Name: "link/.wh.keep", Typeflag: tar.TypeReg},
+		},
+	}
+	for name, headers := range cases {
+		t.Run(name, func(t *testing.T) {
+			root := t.TempDir()
+			sibling := filepath.Join(root, "sibling")
+			if err := os.MkdirAll(sibling, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(sibling, "keep"), []byte("keep"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			dest := filepath.Join(root, "a", "dest")
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := Unpack(buildTar(t, headers...), dest, ArchiveOptions{Whiteouts: true}); err == nil {
+				t.Fatalf("expected error")
+			}
+			if _, err := os.Stat(filepath.Join(sibling, "keep")); err != nil {
+				t.Fatalf("file outside of dest was removed %v", err)
+			}
+			for _, dir := range []string{filepath.Join(root, "a"), dest} {
+				if info, err := os.Lstat(dir); err != nil || !info.IsDir() {
+					t.Fatalf("%s should still be a directory %v", dir, err)
+				}
+			}
+		})
+	}
+}
+
+func TestPackUnpack(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "bin", "tool"), []byte("tool"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	//chown会清掉setuid位，最后再chmod
+	if err := os.Chown(filepath.Join(src, "bin", "tool"), 1000, 1001); err != nil {
+		t.Skipf("chown %v", err)
+	}
+	xattrs := unix.Setxattr(filepath.Join(src, "bin", "tool"), "user.test", []byte("value"), 0) == nil
+	if err := os.Chmod(filepath.Join(src, "bin", "tool"), os.ModeSetuid|0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(src, "bin", "tool"), filepath.Join(src, "bin", "tool2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("tool", filepath.Join(src, "bin", "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(src, "fifo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	//overlay的whiteout和opaque目录
+	if err := syscall.Mknod(filepath.Join(src, "deleted"), syscall.S_IFCHR, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(src, "opaque"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Setxattr(filepath.Join(src, "opaque"), overlayOpaqueXattr, []byte("y"), 0); err != nil {
+		t.Skipf("set trusted xattr %v", err)
+	}
+
+	var buf bytes.Buffer
+	var packed int
+	if err := Pack(&buf, src, ArchiveOptions{Whiteouts: true, Progress: func(entries int, bytes int64) { packed = entries }}); err != nil {
+		t.Fatalf("pack %v", err)
+	}
+	if packed == 0 {
+		t.Fatalf("progress not reported")
+	}
+
+	//tar中是OCI格式的whiteout
+	names := map[string]bool{}
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names[header.Name] = true
+	}
+	for _, name := range []string{".wh.deleted", "opaque/.wh..wh..opq", "bin/tool2"} {
+		if !names[name] {
+			t.Fatalf("%s not in archive %v", name, names)
+		}
+	}
+
+	dest := t.TempDir()
+	if err := Unpack(bytes.NewReader(buf.Bytes()), dest, ArchiveOptions{Whiteouts: true}); err != nil {
+		t.Fatalf("unpack %v", err)
+	}
+	info, err := os.Lstat(filepath.Join(dest, "bin", "tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	if info.Mode()&os.ModeSetuid == 0 || info.Mode().Perm() != 0755 || stat.Uid != 1000 || stat.Gid != 1001 {
+		t.Fatalf("tool mode %v uid %d gid %d", info.Mode(), stat.Uid, stat.Gid)
+	}
+	if stat.Nlink != 2 {
+		t.Fatalf("tool2 should be a hard link, nlink %d", stat.Nlink)
+	}
+	if xattrs {
+		value := make([]byte, 16)
+		n, err := unix.Lgetxattr(filepath.Join(dest, "bin", "tool"), "user.test", value)
+		if err != nil || string(value[:n]) != "value" {
+			t.Fatalf("xattr %q %v", value[:n], err)
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(dest, "bin", "link")); err != nil || link != "tool" {
+		t.Fatalf("symlink %q %v", link, err)
+	}
+	if info, err := os.Lstat(filepath.Join(dest, "fifo")); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+		t.Fatalf("fifo %v %v", info, err)
+	}
+	if info, err := os.Lstat(filepath.Join(dest, "deleted")); err != nil || !isOverlayWhiteout(info) {
+		t.Fatalf("deleted should be a whiteout %v", err)
+	}
+	if !isOverlayOpaque(filepath.Join(dest, "opaque")) {
+		t.Fatalf("opaque directory lost")
+	}
+}
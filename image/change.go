@@ -0,0 +1,153 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ApplyChange 将一条Dockerfile风格的指令应用到容器配置上
+// 用于commit --change，支持 CMD ENTRYPOINT ENV WORKDIR USER EXPOSE LABEL
+func ApplyChange(config *ContainerConfig, change string) error {
+	instruction, args := SplitInstruction(change)
+	if args == "" {
+		return fmt.Errorf("%s requires at least one argument", instruction)
+	}
+
+	switch instruction {
+	case "CMD":
+		config.Cmd = ParseCommand(args)
+	case "ENTRYPOINT":
+		config.Entrypoint = ParseCommand(args)
+	case "ENV":
+		pairs, err := ParseKeyValues(args)
+		if err != nil {
+			return fmt.Errorf("ENV %v", err)
+		}
+		for _, pair := range pairs {
+			config.Env = SetEnv(config.Env, pair[0], pair[1])
+		}
+	case "LABEL":
+		pairs, err := ParseKeyValues(args)
+		if err != nil {
+			return fmt.Errorf("LABEL %v", err)
+		}
+		if config.Labels == nil {
+			config.Labels = map[string]string{}
+		}
+		for _, pair := range pairs {
+			config.Labels[pair[0]] = pair[1]
+		}
+	case "WORKDIR":
+		config.WorkingDir = args
+	case "USER":
+		config.User = args
+	case "EXPOSE":
+		if config.ExposedPorts == nil {
+			config.ExposedPorts = map[string]struct{}{}
+		}
+		for _, port := range strings.Fields(args) {
+			if !strings.Contains(port, "/") {
+				port += "/tcp"
+			}
+			config.ExposedPorts[port] = struct{}{}
+		}
+	default:
+		return fmt.Errorf("unsupported change instruction %s", instruction)
+	}
+	return nil
+}
+
+// SplitInstruction 把一行指令拆分为大写的指令名和参数
+func SplitInstruction(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	fields := strings.SplitN(line, " ", 2)
+	instruction := strings.ToUpper(fields[0])
+	if len(fields) < 2 {
+		return instruction, ""
+	}
+	return instruction, strings.TrimSpace(fields[1])
+}
+
+// ParseCommand 解析命令参数，JSON数组为exec形式，否则为shell形式，交给/bin/sh -c执行
+func ParseCommand(args string) []string {
+	if strings.HasPrefix(args, "[") {
+		var command []string
+		if err := json.Unmarshal([]byte(args), &command); err == nil {
+			return command
+		}
+	}
+	return []string{"/bin/sh", "-c", args}
+}
+
+// ParseKeyValues 解析 k=v k2="v 2" 或者 k v 两种形式的键值对
+func ParseKeyValues(args string) ([][2]string, error) {
+	words := SplitWords(args)
+	if len(words) == 0 {
+		return nil, fmt.Errorf("missing key")
+	}
+	//旧格式 KEY VALUE，值是第一个空格之后的全部内容
+	if !strings.Contains(words[0], "=") {
+		fields := strings.SplitN(args, " ", 2)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s must have a value", fields[0])
+		}
+		return [][2]string{{fields[0], strings.TrimSpace(fields[1])}}, nil
+	}
+
+	var pairs [][2]string
+	for _, word := range words {
+		kv := strings.SplitN(word, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid key value pair %q", word)
+		}
+		pairs = append(pairs, [2]string{kv[0], kv[1]})
+	}
+	return pairs, nil
+}
+
+// SplitWords 以空白分隔单词，引号内的空白不分隔，引号本身会被去掉
+func SplitWords(s string) []string {
+	var words []string
+	var word strings.Builder
+	var quote rune
+	inWord := false
+	for _, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// SetEnv 设置环境变量，同名的会被覆盖
+func SetEnv(env []string, key, value string) []string {
+	entry := key + "=" + value
+	for i, e := range env {
+		if strings.HasPrefix(e, key+"=") {
+			env[i] = entry
+			return env
+		}
+	}
+	return append(env, entry)
+}
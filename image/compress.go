@@ -0,0 +1,111 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"io"
+)
+
+// Compression 镜像层blob或者tar包的压缩格式，bzip2和xz只用于ADD的tar包，不能作为镜像层
+type Compression int
+
+const (
+	Uncompressed Compression = iota
+	Gzip
+	Zstd
+	Bzip2
+	Xz
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b, 0x08}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	bzip2Magic = []byte{0x42, 0x5a, 0x68}
+	xzMagic    = []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}
+)
+
+func (c Compression) String() string {
+	switch c {
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	case Bzip2:
+		return "bzip2"
+	case Xz:
+		return "xz"
+	default:
+		return "uncompressed"
+	}
+}
+
+// MediaType 该压缩格式对应的OCI镜像层类型
+func (c Compression) MediaType() string {
+	switch c {
+	case Gzip:
+		return MediaTypeLayerGzip
+	case Zstd:
+		return MediaTypeLayerZstd
+	case Bzip2, Xz:
+		return ""
+	default:
+		return MediaTypeLayer
+	}
+}
+
+// DetectCompression 根据数据开头的magic number判断压缩格式
+func DetectCompression(header []byte) Compression {
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return Gzip
+	case bytes.HasPrefix(header, zstdMagic):
+		return Zstd
+	case bytes.HasPrefix(header, bzip2Magic):
+		return Bzip2
+	case bytes.HasPrefix(header, xzMagic):
+		return Xz
+	default:
+		return Uncompressed
+	}
+}
+
+// Decompress 返回一个流式解压的reader，压缩格式由数据开头自动识别
+// 不依赖manifest中的mediaType，docker和oci的各种层类型都可以处理
+func Decompress(r io.Reader) (io.ReadCloser, Compression, error) {
+	buffered := bufio.NewReader(r)
+	header, err := buffered.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return nil, Uncompressed, err
+	}
+
+	compression := DetectCompression(header)
+	switch compression {
+	case Gzip:
+		gzReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, compression, fmt.Errorf("open gzip stream error %v", err)
+		}
+		return gzReader, compression, nil
+	case Zstd:
+		zstdReader, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, compression, fmt.Errorf("open zstd stream error %v", err)
+		}
+		return zstdReader.IOReadCloser(), compression, nil
+	case Bzip2:
+		return io.NopCloser(bzip2.NewReader(buffered)), compression, nil
+	case Xz:
+		xzReader, err := xz.NewReader(buffered)
+		if err != nil {
+			return nil, compression, fmt.Errorf("open xz stream error %v", err)
+		}
+		return io.NopCloser(xzReader), compression, nil
+	default:
+		return io.NopCloser(buffered), compression, nil
+	}
+}
@@ -0,0 +1,101 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testLayerTar(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	content := []byte("world")
+	if err := tw.WriteHeader(&tar.Header{Name: "hello", Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(content)
+	tw.Close()
+	return buf.Bytes()
+}
+
+func compressLayer(t *testing.T, compression Compression, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch compression {
+	case Gzip:
+		w = gzip.NewWriter(&buf)
+	case Zstd:
+		encoder, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = encoder
+	default:
+		return data
+	}
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestImportCompressedLayers(t *testing.T) {
+	for _, compression := range []Compression{Uncompressed, Gzip, Zstd} {
+		ImagePath = t.TempDir()
+		tarPath := filepath.Join(t.TempDir(), "layer.tar")
+		if err := os.WriteFile(tarPath, compressLayer(t, compression, testLayerTar(t)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		layer, diffID, err := ImportLayer(tarPath)
+		if err != nil {
+			t.Fatalf("import %s layer %v", compression, err)
+		}
+		if layer.MediaType != compression.MediaType() {
+			t.Fatalf("media type %s, want %s", layer.MediaType, compression.MediaType())
+		}
+		config := NewConfig()
+		config.RootFS.DiffIDs = []string{diffID}
+		img, err := Save("compressed", config, []Descriptor{layer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		layerDirs, err := PrepareLayers(img)
+		if err != nil {
+			t.Fatalf("prepare %s layer %v", compression, err)
+		}
+		content, err := os.ReadFile(filepath.Join(layerDirs[0], "hello"))
+		if err != nil || string(content) != "world" {
+			t.Fatalf("read hello %q %v", content, err)
+		}
+	}
+}
+
+func TestPrepareLayersDiffIDMismatch(t *testing.T) {
+	ImagePath = t.TempDir()
+	tarPath := filepath.Join(t.TempDir(), "layer.tar.zst")
+	if err := os.WriteFile(tarPath, compressLayer(t, Zstd, testLayerTar(t)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	layer, _, err := ImportLayer(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := NewConfig()
+	badDiffID := Digest([]byte("other content"))
+	config.RootFS.DiffIDs = []string{badDiffID}
+	img, err := Save("mismatch", config, []Descriptor{layer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PrepareLayers(img); err == nil || !strings.Contains(err.Error(), "diff id mismatch") {
+		t.Fatalf("prepare layers should fail with diff id mismatch, got %v", err)
+	}
+	if _, err := os.Stat(LayerPath(badDiffID)); !os.IsNotExist(err) {
+		t.Fatalf("mismatched layer should not be kept %v", err)
+	}
+}
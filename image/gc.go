@@ -0,0 +1,283 @@
+package image
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"mydocker/utils"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// manifest一般只有几KB，超过这个大小的blob肯定是镜像层，不需要读取
+const maxManifestSize = 4 << 20
+
+// PruneReport 垃圾回收的结果
+type PruneReport struct {
+	Untagged       []string   //被删除的镜像名
+	Deleted        []string   //被删除的镜像(manifest摘要)
+	SpaceReclaimed int64      //回收的空间
+	Layers         [][]string //保留下来的镜像各自的镜像层目录(从下到上)
+}
+
+// DiskUsage 镜像存储占用的空间
+type DiskUsage struct {
+	Images      int        //镜像数量，按manifest计算，包括没有名字的镜像
+	Active      int        //被容器使用的镜像数量
+	Size        int64      //blob、解压后的镜像层和旧版本的镜像tar包占用的空间
+	Reclaimable int64      //删除所有没有被容器使用的镜像可以回收的空间
+	Layers      [][]string //被容器使用的镜像各自的镜像层目录(从下到上)
+}
+
+// Prune 删除不再需要的镜像，以及没有被保留下来的镜像引用的blob和解压后的镜像层
+// 旧版本commit生成的<name>.tar已经导入过的直接删除，没有导入的当作有名字的镜像处理
+// all为false时只删除没有名字的镜像(dangling)，为true时删除所有没有被容器使用的镜像
+// inUse是容器使用的镜像，可以是镜像名或者摘要；dryRun为true时只统计不删除
+// 调用者需要持有镜像存储的排他锁
+func Prune(all bool, inUse []string, dryRun bool) (*PruneReport, error) {
+	repos, err := loadRepositories()
+	if err != nil {
+		return nil, err
+	}
+	manifests, err := listManifests()
+	if err != nil {
+		return nil, err
+	}
+
+	legacyTars, err := listLegacyTars()
+	if err != nil {
+		return nil, err
+	}
+
+	keep := map[string]bool{}
+	inUseNames := map[string]bool{}
+	for _, ref := range inUse {
+		inUseNames[NormalizeName(ref)] = true
+		if digest := resolveManifest(repos, manifests, ref); digest != "" {
+			keep[digest] = true
+		}
+	}
+	report := &PruneReport{}
+	//tar包导入之后镜像由repositories.json记录，tar包不再需要，留着的话镜像被删除之后还会被重新导入
+	var legacyNames []string
+	for name := range legacyTars {
+		legacyNames = append(legacyNames, name)
+	}
+	sort.Strings(legacyNames)
+	for _, name := range legacyNames {
+		fullName := NormalizeName(name)
+		if _, imported := repos[fullName]; !imported {
+			if !all || inUseNames[fullName] {
+				continue
+			}
+			report.Untagged = append(report.Untagged, fullName)
+		}
+		if err := removeEntry(legacyTars[name], dryRun, report); err != nil {
+			return nil, err
+		}
+	}
+
+	var names []string
+	for name := range repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		digest := repos[name]
+		if !all || keep[digest] {
+			keep[digest] = true
+			continue
+		}
+		report.Untagged = append(report.Untagged, name)
+		delete(repos, name)
+	}
+	for digest := range manifests {
+		if !keep[digest] {
+			report.Deleted = append(report.Deleted, digest)
+		}
+	}
+	sort.Strings(report.Deleted)
+
+	//标记保留下来的镜像引用的blob和镜像层
+	blobs := map[string]bool{}
+	diffIDs := map[string]bool{}
+	for digest := range keep {
+		manifest, ok := manifests[digest]
+		if !ok {
+			continue
+		}
+		blobs[digest] = true
+		blobs[manifest.Config.Digest] = true
+		for _, layer := range manifest.Layers {
+			blobs[layer.Digest] = true
+		}
+		var config Config
+		if err := readJSONBlob(manifest.Config.Digest, &config); err != nil {
+			continue
+		}
+		var layerDirs []string
+		for _, diffID := range config.RootFS.DiffIDs {
+			diffIDs[diffID] = true
+			layerDirs = append(layerDirs, LayerPath(diffID))
+		}
+		report.Layers = append(report.Layers, layerDirs)
+	}
+
+	//清除没有被标记的blob和镜像层，包括中断的下载和解压留下的临时文件
+	if err := sweep(path.Join(ImagePath, "blobs", "sha256"), blobs, dryRun, report); err != nil {
+		return nil, err
+	}
+	if err := sweep(path.Join(ImagePath, "layers"), diffIDs, dryRun, report); err != nil {
+		return nil, err
+	}
+	if !dryRun && len(report.Untagged) > 0 {
+		if err := dumpRepositories(repos); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// Usage 统计镜像存储占用的空间，inUse的含义与Prune相同
+// 调用者需要持有镜像存储的锁
+func Usage(inUse []string) (*DiskUsage, error) {
+	manifests, err := listManifests()
+	if err != nil {
+		return nil, err
+	}
+	report, err := Prune(true, inUse, true)
+	if err != nil {
+		return nil, err
+	}
+	usage := &DiskUsage{
+		Images:      len(manifests),
+		Active:      len(manifests) - len(report.Deleted),
+		Reclaimable: report.SpaceReclaimed,
+		Layers:      report.Layers,
+	}
+	for _, dir := range []string{"blobs", "layers"} {
+		size, err := utils.DirSize(path.Join(ImagePath, dir))
+		if err != nil {
+			return nil, err
+		}
+		usage.Size += size
+	}
+	legacyTars, err := listLegacyTars()
+	if err != nil {
+		return nil, err
+	}
+	for _, tarPath := range legacyTars {
+		size, err := utils.DirSize(tarPath)
+		if err != nil {
+			return nil, err
+		}
+		usage.Size += size
+	}
+	return usage, nil
+}
+
+// sweep 删除dir下没有被标记的条目，条目名是摘要的十六进制部分
+func sweep(dir string, marked map[string]bool, dryRun bool, report *PruneReport) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if marked["sha256:"+entry.Name()] {
+			continue
+		}
+		if err := removeEntry(path.Join(dir, entry.Name()), dryRun, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeEntry 统计并删除一个文件或目录，dryRun为true时只统计
+func removeEntry(entryPath string, dryRun bool, report *PruneReport) error {
+	size, err := utils.DirSize(entryPath)
+	if err != nil {
+		return err
+	}
+	report.SpaceReclaimed += size
+	if dryRun {
+		return nil
+	}
+	return os.RemoveAll(entryPath)
+}
+
+// listLegacyTars 找出镜像存储目录下旧版本的镜像tar包，返回镜像名到路径的映射
+func listLegacyTars() (map[string]string, error) {
+	tars := map[string]string{}
+	entries, err := ioutil.ReadDir(ImagePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return tars, nil
+		}
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".tar")
+		if !entry.Mode().IsRegular() || name == entry.Name() || name == "" {
+			continue
+		}
+		tars[name] = path.Join(ImagePath, entry.Name())
+	}
+	return tars, nil
+}
+
+// listManifests 找出blob中所有的镜像manifest
+// blob是内容寻址的，只能通过内容区分manifest、config和镜像层
+func listManifests() (map[string]*Manifest, error) {
+	manifests := map[string]*Manifest{}
+	blobDir := path.Join(ImagePath, "blobs", "sha256")
+	entries, err := ioutil.ReadDir(blobDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return manifests, nil
+		}
+		return nil, err
+	}
+	for _, entry := range entries {
+		//临时文件的名字不是64位的摘要
+		if len(entry.Name()) != 64 || !entry.Mode().IsRegular() || entry.Size() > maxManifestSize {
+			continue
+		}
+		content, err := ioutil.ReadFile(path.Join(blobDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if len(content) == 0 || content[0] != '{' {
+			continue
+		}
+		var manifest Manifest
+		if err := json.Unmarshal(content, &manifest); err != nil {
+			continue
+		}
+		//config中没有config.digest，index中没有config
+		if manifest.SchemaVersion == 2 && manifest.Config.Digest != "" {
+			manifests["sha256:"+entry.Name()] = &manifest
+		}
+	}
+	return manifests, nil
+}
+
+// resolveManifest 把镜像名、manifest摘要或者镜像ID转换成manifest摘要
+func resolveManifest(repos map[string]string, manifests map[string]*Manifest, ref string) string {
+	if digest, ok := repos[NormalizeName(ref)]; ok {
+		return digest
+	}
+	if _, ok := manifests[ref]; ok {
+		return ref
+	}
+	for digest, manifest := range manifests {
+		if manifest.Config.Digest == ref {
+			return digest
+		}
+	}
+	return ""
+}
@@ -0,0 +1,118 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func saveTestImage(t *testing.T, name, content string) *Image {
+	upper := t.TempDir()
+	if err := os.WriteFile(filepath.Join(upper, "file"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	layer, diffID, err := CreateLayer(upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := NewConfig()
+	config.RootFS.DiffIDs = []string{diffID}
+	var img *Image
+	if name == "" {
+		img, err = Create(config, []Descriptor{layer})
+	} else {
+		img, err = Save(name, config, []Descriptor{layer})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PrepareLayers(img); err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestPrune(t *testing.T) {
+	ImagePath = t.TempDir()
+	tagged := saveTestImage(t, "tagged", "tagged")
+	used := saveTestImage(t, "used", "used")
+	dangling := saveTestImage(t, "", "dangling")
+
+	report, err := Prune(false, []string{"used"}, false)
+	if err != nil {
+		t.Fatalf("prune %v", err)
+	}
+	if len(report.Deleted) != 1 || report.Deleted[0] != dangling.Digest || report.SpaceReclaimed == 0 {
+		t.Fatalf("prune dangling report %+v", report)
+	}
+	if _, err := os.Stat(LayerPath(dangling.Config.RootFS.DiffIDs[0])); !os.IsNotExist(err) {
+		t.Fatalf("layer of dangling image should be removed %v", err)
+	}
+	if _, err := Get("tagged"); err != nil {
+		t.Fatalf("tagged image should be kept %v", err)
+	}
+
+	usage, err := Usage([]string{used.ID()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Images != 2 || usage.Active != 1 || usage.Reclaimable == 0 {
+		t.Fatalf("usage %+v", usage)
+	}
+
+	report, err = Prune(true, []string{used.ID()}, false)
+	if err != nil {
+		t.Fatalf("prune all %v", err)
+	}
+	if len(report.Untagged) != 1 || report.Untagged[0] != "tagged:latest" || report.Deleted[0] != tagged.Digest {
+		t.Fatalf("prune all report %+v", report)
+	}
+	if _, err := os.Stat(BlobPath(tagged.Manifest.Layers[0].Digest)); !os.IsNotExist(err) {
+		t.Fatalf("layer blob of tagged image should be removed %v", err)
+	}
+	if _, err := PrepareLayers(used); err != nil {
+		t.Fatalf("used image should be kept %v", err)
+	}
+}
+
+func TestPruneLegacyTars(t *testing.T) {
+	ImagePath = t.TempDir()
+	used := saveTestImage(t, "used", "used")
+	for _, name := range []string{"imported", "old", "busy"} {
+		if err := os.WriteFile(filepath.Join(ImagePath, name+".tar"), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//imported已经导入过，tar包不再需要
+	if err := Tag("imported", used.Digest); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Prune(false, []string{used.Digest, "busy"}, false)
+	if err != nil {
+		t.Fatalf("prune %v", err)
+	}
+	if len(report.Untagged) != 0 || report.SpaceReclaimed != int64(len("imported")) {
+		t.Fatalf("prune report %+v", report)
+	}
+	if _, err := os.Stat(filepath.Join(ImagePath, "old.tar")); err != nil {
+		t.Fatalf("legacy image should be kept without -a %v", err)
+	}
+	if len(report.Layers) != 1 || report.Layers[0][0] != LayerPath(used.Config.RootFS.DiffIDs[0]) {
+		t.Fatalf("kept layers %v", report.Layers)
+	}
+
+	report, err = Prune(true, []string{used.Digest, "busy"}, false)
+	if err != nil {
+		t.Fatalf("prune all %v", err)
+	}
+	if len(report.Untagged) != 1 || report.Untagged[0] != "old:latest" {
+		t.Fatalf("prune all report %+v", report)
+	}
+	if _, err := os.Stat(filepath.Join(ImagePath, "old.tar")); !os.IsNotExist(err) {
+		t.Fatalf("unused legacy image should be removed %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(ImagePath, "busy.tar")); err != nil {
+		t.Fatalf("legacy image used by a container should be kept %v", err)
+	}
+}
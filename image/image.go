@@ -0,0 +1,403 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// 镜像的存储布局参考了OCI image layout
+// blobs/sha256/<hex>      镜像的manifest、config以及每一层的压缩包，内容寻址
+// layers/<diffID hex>/diff 解压之后的镜像层，作为overlay的lowerdir被多个容器共享
+// repositories.json        镜像名到manifest摘要的映射
+var ImagePath = "/var/lib/mydocker/image/"
+
+const (
+	MediaTypeManifest  = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeConfig    = "application/vnd.oci.image.config.v1+json"
+	MediaTypeLayer     = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeLayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	repositoriesFile = "repositories.json"
+	legacyFormat     = "%s.tar"
+	defaultTag       = "latest"
+	timeFormat       = time.RFC3339Nano
+)
+
+// Descriptor 描述一个blob，与OCI的content descriptor一致
+type Descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// Manifest 镜像清单，记录镜像的配置和按顺序叠加的各层
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// ContainerConfig 镜像中保存的容器默认运行参数
+type ContainerConfig struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+}
+
+// RootFS 记录每一层解压后内容的摘要(diffID)
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// History 每一层的创建记录，EmptyLayer表示这一步只修改了元数据
+type History struct {
+	Created    string `json:"created,omitempty"`
+	CreatedBy  string `json:"created_by,omitempty"`
+	Author     string `json:"author,omitempty"`
+	Comment    string `json:"comment,omitempty"`
+	EmptyLayer bool   `json:"empty_layer,omitempty"`
+}
+
+// Config 镜像配置，与OCI image config一致，它的摘要即镜像ID
+type Config struct {
+	Created      string          `json:"created,omitempty"`
+	Author       string          `json:"author,omitempty"`
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Config       ContainerConfig `json:"config"`
+	RootFS       RootFS          `json:"rootfs"`
+	History      []History       `json:"history,omitempty"`
+}
+
+// Image 一个已经加载到内存中的镜像
+type Image struct {
+	Name     string
+	Digest   string //manifest的摘要
+	Manifest Manifest
+	Config   Config
+}
+
+// ID 镜像ID即镜像配置的摘要
+func (img *Image) ID() string {
+	return img.Manifest.Config.Digest
+}
+
+// NewConfig 生成一个空镜像的配置
+func NewConfig() *Config {
+	return &Config{
+		Created:      time.Now().UTC().Format(timeFormat),
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+		RootFS:       RootFS{Type: "layers", DiffIDs: []string{}},
+	}
+}
+
+// NormalizeName 没有指定tag的镜像名默认使用latest
+func NormalizeName(name string) string {
+	//tag在最后一个:之后，并且不能包含/，否则这个:是仓库地址中的端口
+	if i := strings.LastIndex(name, ":"); i < 0 || strings.Contains(name[i+1:], "/") {
+		return name + ":" + defaultTag
+	}
+	return name
+}
+
+// Digest 计算一段内容的sha256摘要
+func Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// 本地存储只支持sha256摘要，摘要中的十六进制部分会被用作文件名
+var digestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// ValidateDigest 检查来自镜像仓库的摘要，避免sha256:../../x这样的摘要把文件写到存储目录之外
+func ValidateDigest(digest string) error {
+	if !digestPattern.MatchString(digest) {
+		return fmt.Errorf("invalid digest %q", digest)
+	}
+	return nil
+}
+
+// BlobPath 获取blob在本地存储的路径
+func BlobPath(digest string) string {
+	algo, hexPart := splitDigest(digest)
+	return path.Join(ImagePath, "blobs", algo, hexPart)
+}
+
+// LayerPath 获取解压后的镜像层目录
+func LayerPath(diffID string) string {
+	_, hexPart := splitDigest(diffID)
+	return path.Join(ImagePath, "layers", hexPart, "diff")
+}
+
+func splitDigest(digest string) (string, string) {
+	if i := strings.Index(digest, ":"); i >= 0 {
+		return digest[:i], digest[i+1:]
+	}
+	return "sha256", digest
+}
+
+// Get 根据镜像名加载镜像，也可以使用manifest摘要或者镜像ID(sha256:...)
+// 如果镜像不在仓库中，但是存在旧版本commit产生的<name>.tar，则将其作为单层镜像导入
+func Get(name string) (*Image, error) {
+	repos, err := loadRepositories()
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(name, "sha256:") {
+		return getByDigest(repos, name)
+	}
+	fullName := NormalizeName(name)
+	digest, ok := repos[fullName]
+	if !ok {
+		legacyTar := path.Join(ImagePath, fmt.Sprintf(legacyFormat, name))
+		if _, err := os.Stat(legacyTar); err != nil {
+			return nil, fmt.Errorf("no such image: %s", name)
+		}
+		return importLegacy(fullName, legacyTar)
+	}
+	return load(fullName, digest)
+}
+
+// getByDigest 先把摘要当作manifest摘要，不是的话再按镜像ID查找有名字的镜像
+func getByDigest(repos map[string]string, digest string) (*Image, error) {
+	if img, err := load("", digest); err == nil {
+		return img, nil
+	}
+	for name, manifestDigest := range repos {
+		img, err := load(name, manifestDigest)
+		if err == nil && img.ID() == digest {
+			return img, nil
+		}
+	}
+	return nil, fmt.Errorf("no such image: %s", digest)
+}
+
+// load 从blob中读取manifest和config
+func load(name, digest string) (*Image, error) {
+	img := &Image{Name: name, Digest: digest}
+	if err := readJSONBlob(digest, &img.Manifest); err != nil {
+		return nil, fmt.Errorf("read manifest of %s error %v", name, err)
+	}
+	if err := readJSONBlob(img.Manifest.Config.Digest, &img.Config); err != nil {
+		return nil, fmt.Errorf("read config of %s error %v", name, err)
+	}
+	if len(img.Config.RootFS.DiffIDs) != len(img.Manifest.Layers) {
+		return nil, fmt.Errorf("image %s has %d layers but %d diff ids", name,
+			len(img.Manifest.Layers), len(img.Config.RootFS.DiffIDs))
+	}
+	return img, nil
+}
+
+// Save 保存镜像配置和镜像层，生成manifest并记录到镜像名下
+func Save(name string, config *Config, layers []Descriptor) (*Image, error) {
+	img, err := Create(config, layers)
+	if err != nil {
+		return nil, err
+	}
+	img.Name = NormalizeName(name)
+	if err := Tag(img.Name, img.Digest); err != nil {
+		return nil, err
+	}
+	logrus.Infof("Save image %s %s", img.Name, img.ID())
+	return img, nil
+}
+
+// Create 保存镜像配置和镜像层并生成manifest，但不给镜像命名，可以通过摘要引用
+func Create(config *Config, layers []Descriptor) (*Image, error) {
+	configBytes, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	configDesc, err := WriteBlob(MediaTypeConfig, configBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if layers == nil {
+		layers = []Descriptor{}
+	}
+	manifest := Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config:        configDesc,
+		Layers:        layers,
+	}
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	manifestDesc, err := WriteBlob(MediaTypeManifest, manifestBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Image{Digest: manifestDesc.Digest, Manifest: manifest, Config: *config}, nil
+}
+
+// Tag 将镜像名指向某个manifest
+func Tag(name, manifestDigest string) error {
+	return updateRepositories(func(repos map[string]string) {
+		repos[NormalizeName(name)] = manifestDigest
+	})
+}
+
+// WriteBlob 以内容寻址的方式保存一个blob
+func WriteBlob(mediaType string, data []byte) (Descriptor, error) {
+	desc := Descriptor{
+		MediaType: mediaType,
+		Digest:    Digest(data),
+		Size:      int64(len(data)),
+	}
+	blobPath := BlobPath(desc.Digest)
+	if err := os.MkdirAll(path.Dir(blobPath), 0755); err != nil {
+		return desc, err
+	}
+	return desc, WriteFileAtomic(blobPath, data)
+}
+
+// WriteFileAtomic 先写同一目录下的临时文件再rename，其他进程不会读到写了一半的文件
+// 每次写入使用不同的临时文件，同时写入同一个文件的进程不会截断彼此的临时文件
+func WriteFileAtomic(filePath string, data []byte) error {
+	tmpFile, err := ioutil.TempFile(path.Dir(filePath), "."+path.Base(filePath)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Chmod(0644); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filePath)
+}
+
+func readJSONBlob(digest string, v interface{}) error {
+	content, err := ioutil.ReadFile(BlobPath(digest))
+	if err != nil {
+		return err
+	}
+	if Digest(content) != digest {
+		return fmt.Errorf("blob %s digest mismatch", digest)
+	}
+	return json.Unmarshal(content, v)
+}
+
+func loadRepositories() (map[string]string, error) {
+	repos := map[string]string{}
+	content, err := ioutil.ReadFile(path.Join(ImagePath, repositoriesFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return repos, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &repos); err != nil {
+		return nil, fmt.Errorf("unmarshal %s error %v", repositoriesFile, err)
+	}
+	return repos, nil
+}
+
+func dumpRepositories(repos map[string]string) error {
+	if err := os.MkdirAll(ImagePath, 0755); err != nil {
+		return err
+	}
+	content, err := json.Marshal(repos)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path.Join(ImagePath, repositoriesFile), content)
+}
+
+// updateRepositories 在repositories.json专用的排他锁之内读取、修改并保存镜像名的映射
+// pull、commit、build和tag只持有镜像存储的共享锁，同时修改时需要在这里串行，否则后保存的会覆盖先保存的
+func updateRepositories(update func(repos map[string]string)) error {
+	lock, err := LockFile(repositoriesLockFile, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	repos, err := loadRepositories()
+	if err != nil {
+		return err
+	}
+	update(repos)
+	return dumpRepositories(repos)
+}
+
+// importLegacy 把旧版本的镜像tar包(整个rootfs打成一个包)导入为单层镜像
+func importLegacy(name, tarPath string) (*Image, error) {
+	logrus.Infof("Import legacy image %s from %s", name, tarPath)
+	layer, diffID, err := ImportLayer(tarPath)
+	if err != nil {
+		return nil, err
+	}
+
+	config := NewConfig()
+	config.RootFS.DiffIDs = []string{diffID}
+	config.History = []History{{
+		Created:   config.Created,
+		CreatedBy: "import " + path.Base(tarPath),
+	}}
+	return Save(name, config, []Descriptor{layer})
+}
+
+// SaveManifest 保存从镜像仓库拉取的原始manifest，保证manifest的摘要与仓库中的一致
+// manifest引用的config和各层blob需要已经在本地存储中
+func SaveManifest(name string, manifestBytes []byte) (*Image, error) {
+	var manifest Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, fmt.Errorf("unmarshal manifest error %v", err)
+	}
+	for _, desc := range append([]Descriptor{manifest.Config}, manifest.Layers...) {
+		if err := ValidateDigest(desc.Digest); err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(BlobPath(desc.Digest)); err != nil {
+			return nil, fmt.Errorf("blob %s of manifest missing %v", desc.Digest, err)
+		}
+	}
+	//diff_id会被用作解压后镜像层的目录名
+	var config Config
+	if err := readJSONBlob(manifest.Config.Digest, &config); err != nil {
+		return nil, err
+	}
+	for _, diffID := range config.RootFS.DiffIDs {
+		if err := ValidateDigest(diffID); err != nil {
+			return nil, fmt.Errorf("config of manifest: %v", err)
+		}
+	}
+	manifestDesc, err := WriteBlob(manifest.MediaType, manifestBytes)
+	if err != nil {
+		return nil, err
+	}
+	fullName := NormalizeName(name)
+	img, err := load(fullName, manifestDesc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	return img, Tag(fullName, manifestDesc.Digest)
+}
@@ -0,0 +1,49 @@
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentTag(t *testing.T) {
+	ImagePath = t.TempDir()
+	img := saveTestImage(t, "base", "base")
+
+	//同时打标签的进程不会丢失彼此的标签
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- Tag(fmt.Sprintf("app%d", i), img.Digest)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("tag %v", err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := Get(fmt.Sprintf("app%d", i)); err != nil {
+			t.Errorf("lost tag app%d: %v", i, err)
+		}
+	}
+
+	//临时文件都已经rename或者删除
+	entries, err := ioutil.ReadDir(ImagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		switch entry.Name() {
+		case "blobs", "layers", repositoriesFile, storeLockFile, repositoriesLockFile:
+		default:
+			t.Errorf("unexpected file %s left in the image store", entry.Name())
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package image
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+)
+
+const (
+	// OCI规范中的whiteout文件前缀，.wh.<name>表示删除下层的<name>
+	whiteoutPrefix = ".wh."
+	// 目录中存在.wh..wh..opq表示该目录是opaque的，下层同名目录中的内容全部不可见
+	whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
+	// overlayfs用这个xattr标记opaque目录
+	overlayOpaqueXattr = "trusted.overlay.opaque"
+)
+
+// CreateLayer 将容器的upper目录打包成一个gzip压缩的镜像层
+// overlayfs的whiteout(0/0字符设备)和opaque目录会被转换成OCI的.wh.文件
+// 返回镜像层blob的描述以及解压后内容的摘要diffID
+func CreateLayer(upperDir string) (Descriptor, string, error) {
+	desc := Descriptor{MediaType: MediaTypeLayerGzip}
+
+	blobDir := path.Join(ImagePath, "blobs", "sha256")
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		return desc, "", err
+	}
+	tmpFile, err := ioutil.TempFile(blobDir, "layer-")
+	if err != nil {
+		return desc, "", err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	//写入顺序 tar -> (diffID) -> gzip -> (digest) -> 文件，一次遍历同时算出两个摘要
+	blobHash := sha256.New()
+	counter := &countWriter{w: io.MultiWriter(tmpFile, blobHash)}
+	gzWriter := gzip.NewWriter(counter)
+	diffHash := sha256.New()
+	progress := LogProgress("Packing", upperDir)
+	if err := Pack(io.MultiWriter(gzWriter, diffHash), upperDir, ArchiveOptions{Whiteouts: true, Progress: progress}); err != nil {
+		return desc, "", fmt.Errorf("tar dir %s error %v", upperDir, err)
+	}
+	if err := gzWriter.Close(); err != nil {
+		return desc, "", err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return desc, "", err
+	}
+
+	desc.Digest = "sha256:" + hex.EncodeToString(blobHash.Sum(nil))
+	desc.Size = counter.n
+	diffID := "sha256:" + hex.EncodeToString(diffHash.Sum(nil))
+	if err := os.Rename(tmpFile.Name(), BlobPath(desc.Digest)); err != nil {
+		return desc, "", err
+	}
+	logrus.Infof("Create layer %s from %s", desc.Digest, upperDir)
+	return desc, diffID, nil
+}
+
+// ExportDir 把一个目录(例如容器合并之后的根文件系统)打包成不压缩的tar写入w
+func ExportDir(root string, w io.Writer) error {
+	if err := Pack(w, root, ArchiveOptions{Progress: LogProgress("Exporting", root)}); err != nil {
+		return fmt.Errorf("tar dir %s error %v", root, err)
+	}
+	return nil
+}
+
+func isOverlayWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
+
+func isOverlayOpaque(dirPath string) bool {
+	value := make([]byte, 1)
+	n, err := syscall.Getxattr(dirPath, overlayOpaqueXattr, value)
+	return err == nil && n == 1 && value[0] == 'y'
+}
+
+// ImportLayer 将一个tar包(可以是gzip或zstd压缩的)作为镜像层保存到blob中
+// 读取一遍文件，同时算出blob的摘要和解压后内容的diffID
+func ImportLayer(tarPath string) (Descriptor, string, error) {
+	file, err := os.Open(tarPath)
+	if err != nil {
+		return Descriptor{}, "", err
+	}
+	defer file.Close()
+	return ImportLayerFrom(file, tarPath)
+}
+
+// ImportLayerFrom 和ImportLayer一样，但是从任意的reader(例如标准输入)读取，name只用于错误信息
+func ImportLayerFrom(file io.Reader, name string) (Descriptor, string, error) {
+	desc := Descriptor{}
+	blobDir := path.Join(ImagePath, "blobs", "sha256")
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		return desc, "", err
+	}
+	tmpFile, err := ioutil.TempFile(blobDir, "import-")
+	if err != nil {
+		return desc, "", err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	blobHash := sha256.New()
+	counter := &countWriter{w: io.MultiWriter(tmpFile, blobHash)}
+	blobReader := io.TeeReader(file, counter)
+	reader, compression, err := Decompress(blobReader)
+	if err != nil {
+		return desc, "", fmt.Errorf("read layer %s error %v", name, err)
+	}
+	defer reader.Close()
+	if compression.MediaType() == "" {
+		return desc, "", fmt.Errorf("%s compressed layer %s is not supported", compression, name)
+	}
+	diffHash := sha256.New()
+	if _, err := io.Copy(diffHash, reader); err != nil {
+		return desc, "", fmt.Errorf("read layer %s error %v", name, err)
+	}
+	//压缩流结束之后可能还有剩余的数据，也要写入blob
+	if _, err := io.Copy(ioutil.Discard, blobReader); err != nil {
+		return desc, "", err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return desc, "", err
+	}
+
+	desc.MediaType = compression.MediaType()
+	desc.Digest = "sha256:" + hex.EncodeToString(blobHash.Sum(nil))
+	desc.Size = counter.n
+	if err := os.Rename(tmpFile.Name(), BlobPath(desc.Digest)); err != nil {
+		return desc, "", err
+	}
+	return desc, "sha256:" + hex.EncodeToString(diffHash.Sum(nil)), nil
+}
+
+// PrepareLayers 解压镜像的每一层，返回从最底层到最上层的目录
+// 已经解压过的层会被直接复用，新解压的层会校验blob摘要和diffID
+func PrepareLayers(img *Image) ([]string, error) {
+	if len(img.Config.RootFS.DiffIDs) != len(img.Manifest.Layers) {
+		return nil, fmt.Errorf("image %s has %d layers but %d diff ids", img.Name,
+			len(img.Manifest.Layers), len(img.Config.RootFS.DiffIDs))
+	}
+	var layerDirs []string
+	for i, layer := range img.Manifest.Layers {
+		diffID := img.Config.RootFS.DiffIDs[i]
+		layerDir := LayerPath(diffID)
+		if _, err := os.Stat(layerDir); err != nil {
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+			if err := extractLayer(layer, diffID, layerDir); err != nil {
+				return nil, fmt.Errorf("extract layer %s error %v", layer.Digest, err)
+			}
+		}
+		layerDirs = append(layerDirs, layerDir)
+	}
+	return layerDirs, nil
+}
+
+// extractLayer 先解压到临时目录，完整解压之后再rename，保证layer目录要么完整要么不存在
+// 解压的同时计算blob和解压后内容的摘要，任何一个与镜像中记录的不一致都会拒绝使用这一层
+func extractLayer(layer Descriptor, diffID, layerDir string) error {
+	if err := os.MkdirAll(path.Dir(layerDir), 0755); err != nil {
+		return err
+	}
+	//每次解压使用不同的临时目录，同时准备同一层的进程不会删除彼此解压了一半的内容
+	tmpDir, err := ioutil.TempDir(path.Dir(layerDir), "."+path.Base(layerDir)+".tmp-")
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	if err := untarLayer(layer, diffID, tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	if err := os.Rename(tmpDir, layerDir); err != nil {
+		os.RemoveAll(tmpDir)
+		//其他进程已经先完成了同一层的解压，内容由diffID校验过，直接使用
+		if _, statErr := os.Stat(layerDir); statErr == nil {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// untarLayer 流式解压blob并在进程内解包，blob -> (digest) -> 解压 -> (diffID) -> Unpack
+func untarLayer(layer Descriptor, diffID, dir string) error {
+	blob, err := os.Open(BlobPath(layer.Digest))
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	blobHash := sha256.New()
+	counter := &countWriter{w: blobHash}
+	blobReader := io.TeeReader(blob, counter)
+	reader, compression, err := Decompress(blobReader)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	diffHash := sha256.New()
+	tarReader := io.TeeReader(reader, diffHash)
+
+	//whiteout在解包时直接转换成overlayfs能识别的格式
+	opts := ArchiveOptions{Whiteouts: true, Progress: LogProgress("Extracting", layer.Digest)}
+	if err := Unpack(tarReader, dir, opts); err != nil {
+		return fmt.Errorf("untar %s layer %s error %v", compression, layer.Digest, err)
+	}
+	//tar的结束标记之后可能还有填充的内容，同样参与摘要计算
+	if _, err := io.Copy(ioutil.Discard, tarReader); err != nil {
+		return fmt.Errorf("read %s layer %s error %v", compression, layer.Digest, err)
+	}
+	if _, err := io.Copy(ioutil.Discard, blobReader); err != nil {
+		return err
+	}
+
+	if layer.Size > 0 && counter.n != layer.Size {
+		return fmt.Errorf("layer %s size mismatch, expected %d got %d", layer.Digest, layer.Size, counter.n)
+	}
+	if got := "sha256:" + hex.EncodeToString(blobHash.Sum(nil)); got != layer.Digest {
+		return fmt.Errorf("layer digest mismatch, expected %s got %s", layer.Digest, got)
+	}
+	if got := "sha256:" + hex.EncodeToString(diffHash.Sum(nil)); got != diffID {
+		return fmt.Errorf("layer %s diff id mismatch, expected %s got %s", layer.Digest, diffID, got)
+	}
+	return nil
+}
+
+// countWriter 统计写入的字节数
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
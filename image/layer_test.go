@@ -0,0 +1,126 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func TestCreateLayerWhiteout(t *testing.T) {
+	ImagePath = t.TempDir()
+	upper := t.TempDir()
+	if err := os.WriteFile(filepath.Join(upper, "hello"), []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	//模拟overlay删除了下层的/etc/passwd
+	if err := os.Mkdir(filepath.Join(upper, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mknod(filepath.Join(upper, "etc", "passwd"), syscall.S_IFCHR, 0); err != nil {
+		t.Skipf("mknod whiteout %v", err)
+	}
+
+	layer, diffID, err := CreateLayer(upper)
+	if err != nil {
+		t.Fatalf("create layer %v", err)
+	}
+	config := NewConfig()
+	config.RootFS.DiffIDs = []string{diffID}
+	img, err := Save("test", config, []Descriptor{layer})
+	if err != nil {
+		t.Fatalf("save image %v", err)
+	}
+
+	loaded, err := Get("test:latest")
+	if err != nil {
+		t.Fatalf("get image %v", err)
+	}
+	if loaded.ID() != img.ID() {
+		t.Fatalf("image id %s, want %s", loaded.ID(), img.ID())
+	}
+
+	layerDirs, err := PrepareLayers(loaded)
+	if err != nil {
+		t.Fatalf("prepare layers %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(layerDirs[0], "hello"))
+	if err != nil || string(content) != "world" {
+		t.Fatalf("read hello %q %v", content, err)
+	}
+	info, err := os.Lstat(filepath.Join(layerDirs[0], "etc", "passwd"))
+	if err != nil || !isOverlayWhiteout(info) {
+		t.Fatalf("etc/passwd should be a whiteout %v", err)
+	}
+}
+
+func TestApplyChange(t *testing.T) {
+	config := &ContainerConfig{}
+	changes := []string{
+		`CMD ["/bin/sh", "-c", "echo hi"]`,
+		`ENTRYPOINT top -b`,
+		`ENV A=1 B="x y"`,
+		`EXPOSE 80 53/udp`,
+	}
+	for _, change := range changes {
+		if err := ApplyChange(config, change); err != nil {
+			t.Fatalf("apply %s %v", change, err)
+		}
+	}
+	if len(config.Cmd) != 3 || config.Cmd[2] != "echo hi" {
+		t.Fatalf("cmd %v", config.Cmd)
+	}
+	if len(config.Entrypoint) != 3 || config.Entrypoint[2] != "top -b" {
+		t.Fatalf("entrypoint %v", config.Entrypoint)
+	}
+	if len(config.Env) != 2 || config.Env[1] != "B=x y" {
+		t.Fatalf("env %v", config.Env)
+	}
+	if _, ok := config.ExposedPorts["80/tcp"]; !ok {
+		t.Fatalf("exposed ports %v", config.ExposedPorts)
+	}
+	if err := ApplyChange(config, "RUN ls"); err == nil {
+		t.Fatalf("RUN should not be supported")
+	}
+}
+
+func TestConcurrentPrepareLayers(t *testing.T) {
+	ImagePath = t.TempDir()
+	content := strings.Repeat("base", 1<<20)
+	img := saveTestImage(t, "base", content)
+	layerDir := LayerPath(img.Config.RootFS.DiffIDs[0])
+	if err := os.RemoveAll(layerDir); err != nil {
+		t.Fatal(err)
+	}
+
+	//同时解压同一层的进程互不干扰，后完成的直接使用先完成的结果
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := PrepareLayers(img)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("prepare layers %v", err)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(layerDir, "file")); err != nil || string(data) != content {
+		t.Fatalf("layer content %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(layerDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temporary directories left %v", entries)
+	}
+}
@@ -0,0 +1,55 @@
+package image
+
+import (
+	"os"
+	"path"
+	"syscall"
+)
+
+const (
+	storeLockFile = "lock"
+	// repositories.json会被rename替换，不能直接对它加锁，使用单独的锁文件
+	repositoriesLockFile = "repositories.lock"
+)
+
+// StoreLock 镜像存储的文件锁
+// 使用镜像的操作(run、build、commit、pull等)持有共享锁，垃圾回收持有排他锁，
+// 保证回收时不会删除其他进程刚写入但还没有被引用的blob，也不会删除正在准备的镜像层
+type StoreLock struct {
+	file *os.File
+}
+
+// LockStore 获取镜像存储的锁，exclusive为true时获取排他锁，会阻塞直到获取成功
+func LockStore(exclusive bool) (*StoreLock, error) {
+	return LockFile(storeLockFile, exclusive)
+}
+
+// LockFile 对镜像存储目录下的某个锁文件加锁
+func LockFile(name string, exclusive bool) (*StoreLock, error) {
+	if err := os.MkdirAll(ImagePath, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path.Join(ImagePath, name), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(file.Fd()), how); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &StoreLock{file: file}, nil
+}
+
+// Unlock 释放锁，可以重复调用
+func (l *StoreLock) Unlock() {
+	if l == nil || l.file == nil {
+		return
+	}
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+	l.file = nil
+}
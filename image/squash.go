@@ -0,0 +1,135 @@
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mydocker/utils"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Squash 把镜像从第from层(从0开始)到最上层的所有层合并成一层，返回新镜像的配置和层
+// 区间内先创建后删除的文件不会出现在合并后的层中，删除区间之下文件的whiteout会被保留
+func Squash(img *Image, from int) (*Config, []Descriptor, error) {
+	layerCount := len(img.Manifest.Layers)
+	if from < 0 || from >= layerCount {
+		return nil, nil, fmt.Errorf("layer index %d out of range, image has %d layers", from, layerCount)
+	}
+	layerDirs, err := PrepareLayers(img)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	squashDir, err := ioutil.TempDir(path.Join(ImagePath, "layers"), "squash-")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(squashDir)
+
+	//按照从下到上的顺序把每一层按overlay的语义叠加到squashDir上
+	for _, layerDir := range layerDirs[from:] {
+		if err := ApplyLayer(squashDir, layerDir, layerDirs[:from]); err != nil {
+			return nil, nil, fmt.Errorf("apply layer %s error %v", layerDir, err)
+		}
+	}
+	layer, diffID, err := CreateLayer(squashDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := img.Config
+	config.Created = time.Now().UTC().Format(timeFormat)
+	config.RootFS.DiffIDs = append(append([]string{}, img.Config.RootFS.DiffIDs[:from]...), diffID)
+	config.History = append(historyBelow(img.Config.History, from), History{
+		Created:   config.Created,
+		CreatedBy: fmt.Sprintf("mydocker image squash --from %d", from),
+		Comment:   fmt.Sprintf("squash of %d layers from %s", layerCount-from, img.Name),
+	})
+	layers := append(append([]Descriptor{}, img.Manifest.Layers[:from]...), layer)
+	return &config, layers, nil
+}
+
+// historyBelow 保留第from层之前的历史记录
+func historyBelow(history []History, from int) []History {
+	var kept []History
+	layerIndex := 0
+	for _, h := range history {
+		if !h.EmptyLayer {
+			if layerIndex == from {
+				break
+			}
+			layerIndex++
+		}
+		kept = append(kept, h)
+	}
+	return kept
+}
+
+// ApplyLayer 把一个解压后的镜像层按照overlay的语义叠加到target上
+// whiteout删除target中的文件，只有lowerDirs中存在同名文件时才在target中保留whiteout
+func ApplyLayer(target, layerDir string, lowerDirs []string) error {
+	return filepath.Walk(layerDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(layerDir, filePath)
+		if err != nil || relPath == "." {
+			return err
+		}
+		targetPath := filepath.Join(target, relPath)
+		existing, statErr := os.Lstat(targetPath)
+		replacesWhiteout := statErr == nil && isOverlayWhiteout(existing)
+
+		switch {
+		case isOverlayWhiteout(info):
+			//删除区间内产生的文件，只有下面的层中存在时才需要保留whiteout
+			if err := os.RemoveAll(targetPath); err != nil {
+				return err
+			}
+			if existsBelow(relPath, lowerDirs) {
+				return syscall.Mknod(targetPath, syscall.S_IFCHR, 0)
+			}
+			return nil
+		case info.IsDir():
+			opaque := isOverlayOpaque(filePath)
+			if statErr == nil && (!existing.IsDir() || opaque) {
+				if err := os.RemoveAll(targetPath); err != nil {
+					return err
+				}
+			}
+			if err := os.MkdirAll(targetPath, info.Mode().Perm()); err != nil {
+				return err
+			}
+			//目录替换了之前的whiteout或者本身是opaque的，下面层中的同名目录都不可见
+			if (opaque || replacesWhiteout) && existsBelow(relPath, lowerDirs) {
+				if err := syscall.Setxattr(targetPath, overlayOpaqueXattr, []byte("y"), 0); err != nil {
+					return err
+				}
+			}
+			stat := info.Sys().(*syscall.Stat_t)
+			if err := os.Lchown(targetPath, int(stat.Uid), int(stat.Gid)); err != nil {
+				return err
+			}
+			return os.Chmod(targetPath, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+		default:
+			if statErr == nil {
+				if err := os.RemoveAll(targetPath); err != nil {
+					return err
+				}
+			}
+			return utils.CopyPath(filePath, targetPath)
+		}
+	})
+}
+
+func existsBelow(relPath string, lowerDirs []string) bool {
+	for _, lowerDir := range lowerDirs {
+		if _, err := os.Lstat(filepath.Join(lowerDir, relPath)); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestSquash(t *testing.T) {
+	ImagePath = t.TempDir()
+	//第0层: /a /keep；第1层: 创建/secret并删除/a；第2层: 删除/secret
+	uppers := []map[string]string{
+		{"a": "a", "keep": "keep"},
+		{"secret": "secret", "a": ""},
+		{"secret": ""},
+	}
+	config := NewConfig()
+	var layers []Descriptor
+	for _, files := range uppers {
+		upper := t.TempDir()
+		for name, content := range files {
+			filePath := filepath.Join(upper, name)
+			if content == "" {
+				if err := syscall.Mknod(filePath, syscall.S_IFCHR, 0); err != nil {
+					t.Skipf("mknod whiteout %v", err)
+				}
+				continue
+			}
+			if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		layer, diffID, err := CreateLayer(upper)
+		if err != nil {
+			t.Fatalf("create layer %v", err)
+		}
+		layers = append(layers, layer)
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+		config.History = append(config.History, History{CreatedBy: "layer"})
+	}
+	img, err := Save("squash", config, layers)
+	if err != nil {
+		t.Fatalf("save image %v", err)
+	}
+
+	squashedConfig, squashedLayers, err := Squash(img, 1)
+	if err != nil {
+		t.Fatalf("squash %v", err)
+	}
+	if len(squashedLayers) != 2 || len(squashedConfig.RootFS.DiffIDs) != 2 || len(squashedConfig.History) != 2 {
+		t.Fatalf("squashed layers %d diffIDs %d history %d", len(squashedLayers),
+			len(squashedConfig.RootFS.DiffIDs), len(squashedConfig.History))
+	}
+	squashed, err := Save("squashed", squashedConfig, squashedLayers)
+	if err != nil {
+		t.Fatalf("save squashed image %v", err)
+	}
+	layerDirs, err := PrepareLayers(squashed)
+	if err != nil {
+		t.Fatalf("prepare layers %v", err)
+	}
+	//区间内创建又删除的/secret不应该留下任何痕迹
+	if _, err := os.Lstat(filepath.Join(layerDirs[1], "secret")); !os.IsNotExist(err) {
+		t.Fatalf("secret should not exist in squashed layer %v", err)
+	}
+	info, err := os.Lstat(filepath.Join(layerDirs[1], "a"))
+	if err != nil || !isOverlayWhiteout(info) {
+		t.Fatalf("a should be a whiteout %v", err)
+	}
+}
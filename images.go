@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"mydocker/builder"
+	"mydocker/container"
+	"mydocker/image"
+	"mydocker/utils"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// imageHistory 从最上层开始打印镜像每一步的指令、层大小和创建时间
+// LAYER列是层的序号(从最下层的0开始)，可以作为squash的--from参数
+func imageHistory(name string) error {
+	img, err := image.Get(name)
+	if err != nil {
+		return err
+	}
+
+	type historyRow struct {
+		layer, created, createdBy, size, comment string
+	}
+	var rows []historyRow
+	layerIndex := 0
+	for _, h := range img.Config.History {
+		row := historyRow{layer: "-", size: "0B", created: h.Created, createdBy: h.CreatedBy, comment: h.Comment}
+		if created, err := time.Parse(time.RFC3339Nano, h.Created); err == nil {
+			row.created = created.Local().Format("2006-01-02 15:04:05")
+		}
+		if !h.EmptyLayer && layerIndex < len(img.Manifest.Layers) {
+			row.layer = strconv.Itoa(layerIndex)
+			row.size = utils.HumanSize(img.Manifest.Layers[layerIndex].Size)
+			layerIndex++
+		}
+		rows = append(rows, row)
+	}
+	//没有历史记录的层(例如导入的镜像)也要显示出来
+	for ; layerIndex < len(img.Manifest.Layers); layerIndex++ {
+		rows = append(rows, historyRow{
+			layer:     strconv.Itoa(layerIndex),
+			created:   "<missing>",
+			createdBy: "<missing>",
+			size:      utils.HumanSize(img.Manifest.Layers[layerIndex].Size),
+		})
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprintf(w, "LAYER\tCREATED\tCREATED BY\tSIZE\tCOMMENT\n")
+	for i := len(rows) - 1; i >= 0; i-- {
+		row := rows[i]
+		createdBy := strings.Join(strings.Fields(row.createdBy), " ")
+		if len(createdBy) > 60 {
+			createdBy = createdBy[:57] + "..."
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", row.layer, row.created, createdBy, row.size, row.comment)
+	}
+	if err := w.Flush(); err != nil {
+		logrus.Errorf("Flush error %v", err)
+	}
+	return nil
+}
+
+// squashImage 把镜像从第from层开始的所有层合并成一层，保存为新镜像
+func squashImage(name string, from int, tag string) error {
+	storeLock, err := image.LockStore(false)
+	if err != nil {
+		return err
+	}
+	defer storeLock.Unlock()
+	img, err := image.Get(name)
+	if err != nil {
+		return err
+	}
+	config, layers, err := image.Squash(img, from)
+	if err != nil {
+		return fmt.Errorf("squash image %s error %v", name, err)
+	}
+	squashed, err := image.Save(tag, config, layers)
+	if err != nil {
+		return err
+	}
+	fmt.Println(squashed.ID())
+	return nil
+}
+
+// pruneImages 删除没有名字的镜像，all为true时删除所有没有被容器使用的镜像
+// 回收期间持有镜像存储的排他锁，会等待正在进行的run、build、pull等操作结束
+func pruneImages(all bool) error {
+	storeLock, err := image.LockStore(true)
+	if err != nil {
+		return err
+	}
+	defer storeLock.Unlock()
+
+	inUse, err := imagesInUse()
+	if err != nil {
+		return err
+	}
+	report, err := image.Prune(all, inUse, false)
+	if err != nil {
+		return fmt.Errorf("prune images error %v", err)
+	}
+	//btrfs为镜像层创建的子卷和旧版本容器留下的镜像副本也属于镜像占用的空间
+	layerReport, lowerReport, err := pruneImageStorage(report.Layers, false)
+	if err != nil {
+		return err
+	}
+	//中间镜像被删除之后对应的构建缓存也就失效了
+	cache, err := builder.LoadCache()
+	if err != nil {
+		return err
+	}
+	if err := cache.Prune(); err != nil {
+		return err
+	}
+
+	for _, name := range report.Untagged {
+		fmt.Printf("Untagged: %s\n", name)
+	}
+	for _, digest := range report.Deleted {
+		fmt.Printf("Deleted: %s\n", digest)
+	}
+	for _, storageReport := range []*container.PruneReport{layerReport, lowerReport} {
+		for _, dir := range storageReport.Deleted {
+			fmt.Printf("Deleted: %s\n", dir)
+		}
+		report.SpaceReclaimed += storageReport.SpaceReclaimed
+	}
+	fmt.Printf("Total reclaimed space: %s\n", utils.HumanSize(report.SpaceReclaimed))
+	return nil
+}
+
+// pruneImageStorage 删除不属于layers中任何镜像的btrfs镜像层子卷，以及容器已经不存在的旧版本lower目录
+// 分别返回两者的结果，调用者需要持有镜像存储的排他锁
+func pruneImageStorage(layers [][]string, dryRun bool) (*container.PruneReport, *container.PruneReport, error) {
+	layerReport, err := container.PruneBtrfsLayers(layers, dryRun)
+	if err != nil {
+		return nil, nil, fmt.Errorf("prune btrfs layers error %v", err)
+	}
+	containers, err := listContainerInfos()
+	if err != nil {
+		return nil, nil, err
+	}
+	names := map[string]bool{}
+	for _, containerInfo := range containers {
+		names[containerInfo.Name] = true
+	}
+	lowerReport, err := container.PruneLegacyLowerDirs(names, dryRun)
+	if err != nil {
+		return nil, nil, fmt.Errorf("prune legacy lower dirs error %v", err)
+	}
+	return layerReport, lowerReport, nil
+}
+
+// imagesInUse 所有容器使用的镜像
+func imagesInUse() ([]string, error) {
+	containers, err := listContainerInfos()
+	if err != nil {
+		return nil, err
+	}
+	var inUse []string
+	for _, containerInfo := range containers {
+		if containerInfo.ImageDigest != "" {
+			inUse = append(inUse, containerInfo.ImageDigest)
+		} else if containerInfo.Image != "" {
+			inUse = append(inUse, containerInfo.Image)
+		}
+	}
+	return inUse, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"mydocker/container"
+)
+
+// containerStorage 容器根文件系统的存储驱动、可写层大小和大小限制
+type containerStorage struct {
+	Driver    string `json:"driver"`
+	SizeRw    int64  `json:"size_rw"`              //可写层已经使用的空间
+	SizeLimit int64  `json:"size_limit,omitempty"` //--storage-opt size设置的限制
+}
+
+// containerInspect inspect输出的容器信息
+type containerInspect struct {
+	*container.ContainerInfo
+	Storage containerStorage `json:"storage"`
+}
+
+// getContainerStorage 有大小限制时按照限制的方式统计已经使用的空间，这样和限制是可比的
+func getContainerStorage(containerName string) (containerStorage, error) {
+	sn := container.LookupSnapshotter(containerName)
+	storage := containerStorage{Driver: sn.Name()}
+	if quota, ok := sn.(container.Quota); ok {
+		used, limit, err := quota.QuotaUsage(containerName)
+		if err != nil {
+			return storage, err
+		}
+		if limit > 0 {
+			storage.SizeRw, storage.SizeLimit = used, limit
+			return storage, nil
+		}
+	}
+	size, err := sn.Usage(containerName)
+	storage.SizeRw = size
+	return storage, err
+}
+
+func inspectContainers(names []string) error {
+	var result []containerInspect
+	for _, name := range names {
+		containerInfo, err := getContainerInfoByName(name)
+		if err != nil {
+			return err
+		}
+		storage, err := getContainerStorage(name)
+		if err != nil {
+			logrus.Errorf("Get storage usage of container %s error %v", name, err)
+		}
+		result = append(result, containerInspect{ContainerInfo: containerInfo, Storage: storage})
+	}
+	content, err := json.MarshalIndent(result, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(content))
+	return nil
+}
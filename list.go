@@ -11,6 +11,29 @@ import (
 )
 
 func ListContainers() {
+	containers, err := listContainerInfos()
+	if err != nil {
+		return
+	}
+
+	//使用tabwriter.NewWrite在控制台打印出容器信息
+	//tabwriter是引用的text/tabwrite类库，用于在控制台打印对齐的表格
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	//控制台输出的信息列
+	fmt.Fprintf(w, "ID\tNAME\tPID\tSTATUS\tCOMMAND\tCREATED\n")
+	for _, item := range containers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", item.ID, item.Name, item.Pid, item.Status, item.Command, item.CreatedTime)
+	}
+
+	//刷新标准输入流缓存区，将容器列表打印出来
+	if err := w.Flush(); err != nil {
+		logrus.Errorf("Flush error %v", err)
+		return
+	}
+}
+
+// listContainerInfos 读取所有容器的信息
+func listContainerInfos() ([]*container.ContainerInfo, error) {
 	//找到存储容器信息的路径/var/run/mydocker
 	dirURL := fmt.Sprintf(container.DefaultInfoLocation, "")
 	dirURL = dirURL[:len(dirURL)-1]
@@ -18,13 +41,24 @@ func ListContainers() {
 	//读取该文件下的所有文件
 	files, err := ioutil.ReadDir(dirURL)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
 		logrus.Errorf("Read dir %s error %v", dirURL, err)
-		return
+		return nil, err
 	}
 
 	var containers []*container.ContainerInfo
 	//遍历该文件夹下的所有文件
 	for _, file := range files {
+		//网络配置和事件也保存在这个目录下，没有config.json的目录不是容器
+		if !file.IsDir() {
+			continue
+		}
+		configFile := fmt.Sprintf(container.DefaultInfoLocation, file.Name()) + container.ConfigName
+		if _, err := os.Stat(configFile); os.IsNotExist(err) {
+			continue
+		}
 		//根据容器配置文件获取对应的信息，然后转换成容器信息的对象
 		tmpContainer, err := getContainerInfo(file)
 		if err != nil {
@@ -34,21 +68,7 @@ func ListContainers() {
 
 		containers = append(containers, tmpContainer)
 	}
-
-	//使用tabwriter.NewWrite在控制台打印出容器信息
-	//tabwriter是引用的text/tabwrite类库，用于在控制台打印对齐的表格
-	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
-	//控制台输出的信息列
-	fmt.Fprintf(w, "ID\tNAME\tPID\tSTATUS\tCOMMAND\tCREATED\n")
-	for _, item := range containers {
-		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", item.ID, item.Name, item.Pid, item.Status, item.Command, item.CreatedTime)
-	}
-
-	//刷新标准输入流缓存区，将容器列表打印出来
-	if err := w.Flush(); err != nil {
-		logrus.Errorf("Flush error %v", err)
-		return
-	}
+	return containers, nil
 }
 
 func getContainerInfo(file os.FileInfo) (*container.ContainerInfo, error) {
@@ -60,7 +80,7 @@ func getContainerInfo(file os.FileInfo) (*container.ContainerInfo, error) {
 	//读取config.json文件内的容器信息
 	content, err := ioutil.ReadFile(configFileDir)
 	if err != nil {
-		logrus.Errorf("Read file %s error %v", configFileDir)
+		logrus.Errorf("Read file %s error %v", configFileDir, err)
 		return nil, err
 	}
 
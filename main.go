@@ -20,12 +20,24 @@ func main() {
 		initCommand,
 		runCommand,
 		commitCommand,
+		exportCommand,
+		importCommand,
 		listCommand,
+		inspectCommand,
+		statsCommand,
+		eventsCommand,
 		logCommand,
 		execCommand,
 		stopCommand,
 		removeCommand,
 		networkCommand,
+		volumeCommand,
+		pullCommand,
+		pushCommand,
+		tagCommand,
+		buildCommand,
+		imageCommand,
+		systemCommand,
 	}
 
 	app.Before = func(context *cli.Context) error {
@@ -4,10 +4,13 @@ import (
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+	"math"
 	"mydocker/cgroups/subsystems"
 	"mydocker/container"
 	"mydocker/network"
+	"mydocker/utils"
 	"os"
+	"path"
 )
 
 // 这里定义了runCommand的Flags，其作用类似于运行命令时使用--来指定参数
@@ -25,13 +28,93 @@ var runCommand = cli.Command{
 			Usage: "detach container",
 		},
 		cli.StringFlag{ //限制内存
-			Name:  "m",
-			Usage: "memory limit",
+			Name:  "m, memory",
+			Usage: "memory limit, e.g. 512m",
+		},
+		cli.StringFlag{
+			Name:  "memory-swap",
+			Usage: "total of memory and swap, -1 for unlimited swap",
+		},
+		cli.StringFlag{
+			Name:  "memory-reservation",
+			Usage: "memory soft limit, kept when the host is short of memory",
+		},
+		cli.StringFlag{
+			Name:  "kernel-memory",
+			Usage: "kernel memory limit, ignored on cgroup v2",
+		},
+		cli.BoolFlag{
+			Name:  "oom-kill-disable",
+			Usage: "disable OOM killer, not supported on cgroup v2",
+		},
+		cli.Float64Flag{ //限制cpu
+			Name:  "cpus",
+			Usage: "number of cpus, e.g. 1.5",
+		},
+		cli.Int64Flag{
+			Name:  "cpu-quota",
+			Usage: "limit cpu time per period in microseconds, -1 for unlimited",
+		},
+		cli.Uint64Flag{
+			Name:  "cpu-period",
+			Usage: "cpu period in microseconds, 1000 - 1000000 (default 100000)",
+		},
+		cli.Uint64Flag{
+			Name:  "cpu-shares",
+			Usage: "cpu shares (relative weight), 2 - 262144",
+		},
+		cli.Int64Flag{
+			Name:  "pids-limit",
+			Usage: "limit the number of processes, -1 for unlimited",
+		},
+		cli.StringFlag{
+			Name:  "cpuset-cpus",
+			Usage: "cpus in which to allow execution, e.g. 0-3,5",
+		},
+		cli.StringFlag{
+			Name:  "cpuset-mems",
+			Usage: "memory nodes in which to allow execution, e.g. 0-1",
+		},
+		cli.UintFlag{
+			Name:  "blkio-weight",
+			Usage: "block IO weight (relative weight), 10 - 1000",
+		},
+		cli.StringSliceFlag{
+			Name:  "device-read-bps",
+			Usage: "limit read rate from a device, device-path:rate, e.g. /dev/sda:1mb",
+		},
+		cli.StringSliceFlag{
+			Name:  "device-write-bps",
+			Usage: "limit write rate to a device, device-path:rate, e.g. /dev/sda:1mb",
+		},
+		cli.StringSliceFlag{
+			Name:  "device-read-iops",
+			Usage: "limit read operations per second from a device, device-path:count",
+		},
+		cli.StringSliceFlag{
+			Name:  "device-write-iops",
+			Usage: "limit write operations per second to a device, device-path:count",
 		},
 
-		cli.StringFlag{ //挂存储
+		cli.StringSliceFlag{ //挂存储，可以指定多个
 			Name:  "v",
-			Usage: "volume",
+			Usage: "bind mount a volume, host-dir|volume-name:container-dir[:ro,rw,nocopy,rprivate,rshared,rslave] or container-dir for an anonymous volume",
+		},
+		cli.StringSliceFlag{
+			Name:  "tmpfs",
+			Usage: "mount a tmpfs directory, container-dir[:ro,rw,size=...,mode=...]",
+		},
+		cli.BoolFlag{
+			Name:  "read-only",
+			Usage: "mount the container's root filesystem as read only",
+		},
+		cli.StringSliceFlag{
+			Name:  "volumes-from",
+			Usage: "mount volumes from the specified container, container[:ro|rw]",
+		},
+		cli.StringSliceFlag{
+			Name:  "mount",
+			Usage: "attach a filesystem mount, type=bind|volume|tmpfs,source=...,target=...[,readonly,bind-propagation=...,volume-nocopy,tmpfs-size=...,tmpfs-mode=...]",
 		},
 
 		//提供run后面的-name指定容器名字参数
@@ -57,6 +140,24 @@ var runCommand = cli.Command{
 			Name:  "p",
 			Usage: "set port mapping",
 		},
+
+		//存储驱动
+		cli.StringFlag{
+			Name:  "storage-driver",
+			Usage: "storage driver of the container rootfs, overlay2, btrfs or vfs, detect automatically if not set",
+		},
+		cli.StringSliceFlag{
+			Name:  "storage-opt",
+			Usage: "storage driver options, size=10G limits the writable layer of the container",
+		},
+		cli.StringFlag{
+			Name:  "rootfs",
+			Usage: "run on an unpacked rootfs directory instead of an image, the directory is the read-only lower layer",
+		},
+		cli.BoolFlag{
+			Name:  "rootfs-rw",
+			Usage: "with --rootfs, use the directory as the container root directly, changes are written into it",
+		},
 	},
 
 	/**
@@ -75,9 +176,18 @@ var runCommand = cli.Command{
 			cmdArray = append(cmdArray, arg)
 		}
 
-		//获取镜像名
-		imageName := cmdArray[0]
-		cmdArray = cmdArray[1:]
+		//获取镜像名，指定了--rootfs时没有镜像，所有参数都是命令
+		imageName := ""
+		rootfs := context.String("rootfs")
+		if rootfs == "" {
+			if context.Bool("rootfs-rw") {
+				return fmt.Errorf("--rootfs-rw requires --rootfs")
+			}
+			imageName = cmdArray[0]
+			cmdArray = cmdArray[1:]
+		} else if !path.IsAbs(rootfs) {
+			return fmt.Errorf("rootfs %s must be an absolute path", rootfs)
+		}
 
 		createTty := context.Bool("it")
 		detach := context.Bool("d")
@@ -92,11 +202,101 @@ var runCommand = cli.Command{
 		//tty := context.Bool("ti")
 
 		resConf := &subsystems.ResourceConfig{
-			MemoryLimit: context.String("m"),
+			OomKillDisable: context.Bool("oom-kill-disable"),
+			CpuShare:       context.Uint64("cpu-shares"),
+			CpuQuota:       context.Int64("cpu-quota"),
+			CpuPeriod:      context.Uint64("cpu-period"),
+			NanoCpus:       int64(math.Round(context.Float64("cpus") * 1e9)),
+			CpuSet:         context.String("cpuset-cpus"),
+			CpuSetMems:     context.String("cpuset-mems"),
+			PidsLimit:      context.Int64("pids-limit"),
+		}
+		//内存大小支持512m、1.5g这样的写法
+		for _, item := range []struct {
+			flag  string
+			value *int64
+		}{
+			{"memory", &resConf.MemoryLimit},
+			{"memory-swap", &resConf.MemorySwap},
+			{"memory-reservation", &resConf.MemoryReservation},
+			{"kernel-memory", &resConf.KernelMemory},
+		} {
+			value := context.String(item.flag)
+			if value == "" {
+				continue
+			}
+			if item.flag == "memory-swap" && value == "-1" {
+				*item.value = -1
+				continue
+			}
+			size, err := utils.ParseSize(value)
+			if err != nil {
+				return fmt.Errorf("invalid --%s: %v", item.flag, err)
+			}
+			*item.value = size
+		}
+		if weight := context.Uint("blkio-weight"); weight > 0 {
+			//超出uint16的值交给Validate报错
+			if weight > math.MaxUint16 {
+				weight = math.MaxUint16
+			}
+			resConf.BlkioWeight = uint16(weight)
+		}
+		for _, item := range []struct {
+			flag    string
+			size    bool
+			devices *[]subsystems.ThrottleDevice
+		}{
+			{"device-read-bps", true, &resConf.DeviceReadBps},
+			{"device-write-bps", true, &resConf.DeviceWriteBps},
+			{"device-read-iops", false, &resConf.DeviceReadIOps},
+			{"device-write-iops", false, &resConf.DeviceWriteIOps},
+		} {
+			for _, spec := range context.StringSlice(item.flag) {
+				device, err := subsystems.ParseThrottleDevice(spec, item.size)
+				if err != nil {
+					return fmt.Errorf("invalid --%s: %v", item.flag, err)
+				}
+				*item.devices = append(*item.devices, device)
+			}
+		}
+		if err := resConf.Validate(); err != nil {
+			return err
+		}
+		for _, warning := range resConf.Warnings() {
+			logrus.Warn(warning)
 		}
 
-		//把volume参数传给Run函数
-		volume := context.String("v")
+		//解析所有的volume参数传给Run函数
+		var mounts []container.Mount
+		for _, spec := range context.StringSlice("v") {
+			mount, err := container.ParseVolume(spec)
+			if err != nil {
+				return err
+			}
+			mounts = append(mounts, *mount)
+		}
+		for _, spec := range context.StringSlice("tmpfs") {
+			mount, err := container.ParseTmpfs(spec)
+			if err != nil {
+				return err
+			}
+			mounts = append(mounts, *mount)
+		}
+		for _, spec := range context.StringSlice("mount") {
+			mount, err := container.ParseMount(spec)
+			if err != nil {
+				return err
+			}
+			mounts = append(mounts, *mount)
+		}
+		if err := container.ValidateMounts(mounts); err != nil {
+			return err
+		}
+		mounts, err := volumesFrom(context.StringSlice("volumes-from"), mounts)
+		if err != nil {
+			return err
+		}
 
 		//将取到的容器名称传递辖区，如果没有则取到的值为空
 		containerName := context.String("name")
@@ -105,7 +305,14 @@ var runCommand = cli.Command{
 
 		network := context.String("net")
 		portMapping := context.StringSlice("p")
-		Run(createTty, volume, containerName, imageName, network, &cmdArray, &envSlice, &portMapping, resConf)
+		storage, err := container.ParseStorageOpts(context.String("storage-driver"), context.StringSlice("storage-opt"))
+		if err != nil {
+			return err
+		}
+		storage.Rootfs = rootfs
+		storage.RootfsRW = context.Bool("rootfs-rw")
+		readOnly := context.Bool("read-only")
+		Run(createTty, readOnly, mounts, containerName, imageName, network, storage, &cmdArray, &envSlice, &portMapping, resConf)
 		return nil
 	},
 }
@@ -132,14 +339,38 @@ var initCommand = cli.Command{
 var commitCommand = cli.Command{
 	Name:  "commit",
 	Usage: "commit a container into image",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "author, a",
+			Usage: "author of the image",
+		},
+		cli.StringFlag{
+			Name:  "message, m",
+			Usage: "commit message",
+		},
+		//例如 --change 'CMD ["/bin/sh"]'
+		cli.StringSliceFlag{
+			Name:  "change, c",
+			Usage: "apply Dockerfile instruction to the created image",
+		},
+		cli.BoolFlag{
+			Name:  "pause, p",
+			Usage: "pause container during commit",
+		},
+	},
 	Action: func(context *cli.Context) error {
-		if len(context.Args()) < 1 {
-			return fmt.Errorf("missing container name")
+		if len(context.Args()) < 2 {
+			return fmt.Errorf("missing container name and image name")
 		}
 		containerName := context.Args().Get(0)
 		imageName := context.Args().Get(1)
-		CommitContainer(containerName, imageName)
-		return nil
+		opts := &CommitOptions{
+			Author:  context.String("author"),
+			Message: context.String("message"),
+			Changes: context.StringSlice("change"),
+			Pause:   context.Bool("pause"),
+		}
+		return CommitContainer(containerName, imageName, opts)
 	},
 }
 
@@ -153,6 +384,18 @@ var listCommand = cli.Command{
 	},
 }
 
+// docker inspect 查看容器的详细信息，包括可写层的大小和限制
+var inspectCommand = cli.Command{
+	Name:  "inspect",
+	Usage: "display detailed information on one or more containers",
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("missing container name")
+		}
+		return inspectContainers(context.Args())
+	},
+}
+
 // docker logs 查看容器日志
 var logCommand = cli.Command{
 	Name:  "logs",
@@ -174,7 +417,7 @@ var execCommand = cli.Command{
 	Action: func(context *cli.Context) error {
 		//非常重要如果是exec的命令并且设置了环境变量，说明是上一次exec调用的，就是为了触发c语言的那个senns
 		if os.Getenv(ENV_EXEC_PID) != "" {
-			logrus.Infof("pid callback pid %s", os.Getegid())
+			logrus.Infof("pid callback pid %d", os.Getpid())
 			return nil
 		}
 
@@ -223,6 +466,321 @@ var removeCommand = cli.Command{
 	},
 }
 
+// docker build 根据Dockerfile构建镜像
+// mydocker build -t name -f Dockerfile CONTEXT
+var buildCommand = cli.Command{
+	Name:  "build",
+	Usage: "build an image from a Dockerfile",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "t",
+			Usage: "name of the image",
+		},
+		cli.StringFlag{
+			Name:  "f",
+			Usage: "path of the Dockerfile, default is CONTEXT/Dockerfile",
+		},
+		cli.StringSliceFlag{
+			Name:  "build-arg",
+			Usage: "set build-time variables",
+		},
+		cli.BoolFlag{
+			Name:  "no-cache",
+			Usage: "do not use cache when building the image",
+		},
+		cli.StringFlag{
+			Name:  "storage-driver",
+			Usage: "storage driver of build containers, overlay2, btrfs or vfs",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("missing build context")
+		}
+		opts := &BuildOptions{
+			Tag:           context.String("t"),
+			Dockerfile:    context.String("f"),
+			Context:       context.Args().Get(0),
+			BuildArgs:     context.StringSlice("build-arg"),
+			NoCache:       context.Bool("no-cache"),
+			StorageDriver: context.String("storage-driver"),
+		}
+		return buildImage(opts)
+	},
+}
+
+// 访问镜像仓库的认证参数
+var registryFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "username, u",
+		Usage: "registry username",
+	},
+	cli.StringFlag{
+		Name:  "password, p",
+		Usage: "registry password",
+	},
+	cli.BoolFlag{
+		Name:  "insecure",
+		Usage: "access registry over http",
+	},
+}
+
+// docker export 把容器的根文件系统导出成tar包
+var exportCommand = cli.Command{
+	Name:  "export",
+	Usage: "export a container's filesystem as a tar archive",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "write to a file instead of STDOUT",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("missing container name")
+		}
+		return exportContainer(context.Args().Get(0), context.String("output"))
+	},
+}
+
+// docker import 把rootfs的tar包导入成单层镜像
+var importCommand = cli.Command{
+	Name:  "import",
+	Usage: "import the contents from a tarball to create a filesystem image, file|- repo[:tag]",
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "change, c",
+			Usage: "apply Dockerfile instruction to the created image",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 2 {
+			return fmt.Errorf("missing tar file and image name")
+		}
+		return importImage(context.Args().Get(0), context.Args().Get(1), context.StringSlice("change"))
+	},
+}
+
+// docker pull 从镜像仓库拉取镜像
+var pullCommand = cli.Command{
+	Name:  "pull",
+	Usage: "pull an image from a registry",
+	Flags: registryFlags,
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("missing image name")
+		}
+		return pullImage(context.Args().Get(0), context.String("username"),
+			context.String("password"), context.Bool("insecure"))
+	},
+}
+
+// docker push 推送镜像到镜像仓库
+var pushCommand = cli.Command{
+	Name:  "push",
+	Usage: "push an image to a registry",
+	Flags: registryFlags,
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("missing image name")
+		}
+		return pushImage(context.Args().Get(0), context.String("username"),
+			context.String("password"), context.Bool("insecure"))
+	},
+}
+
+// docker tag 给镜像增加一个名字
+var tagCommand = cli.Command{
+	Name:  "tag",
+	Usage: "create a tag TARGET_IMAGE that refers to SOURCE_IMAGE",
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 2 {
+			return fmt.Errorf("missing source image and target image")
+		}
+		return tagImage(context.Args().Get(0), context.Args().Get(1))
+	},
+}
+
+// docker image 镜像相关的命令
+var imageCommand = cli.Command{
+	Name:  "image",
+	Usage: "image commands",
+	Subcommands: []cli.Command{
+		{
+			// docker image history 查看镜像每一层的构建历史
+			Name:  "history",
+			Usage: "show the history of an image",
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("missing image name")
+				}
+				return imageHistory(context.Args().Get(0))
+			},
+		},
+		{
+			// docker image squash 合并镜像的若干层
+			// mydocker image squash IMAGE --from 1 -t new
+			Name:  "squash",
+			Usage: "squash layers of an image from the given layer to the top into one layer",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "from",
+					Usage: "index of the first layer to squash, see image history",
+				},
+				cli.StringFlag{
+					Name:  "t",
+					Usage: "name of the new image",
+				},
+			},
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("missing image name")
+				}
+				if context.String("t") == "" {
+					return fmt.Errorf("missing new image name")
+				}
+				return squashImage(context.Args().Get(0), context.Int("from"), context.String("t"))
+			},
+		},
+		{
+			// docker image prune 删除不再需要的镜像
+			Name:  "prune",
+			Usage: "remove dangling images, or all unused images with -a",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "all, a",
+					Usage: "remove all images not used by any container",
+				},
+			},
+			Action: func(context *cli.Context) error {
+				return pruneImages(context.Bool("all"))
+			},
+		},
+	},
+}
+
+// docker stats 查看容器的资源使用情况
+var statsCommand = cli.Command{
+	Name:  "stats",
+	Usage: "display resource usage of containers, mydocker stats [container...]",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "no-stream",
+			Usage: "print the first result only",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		return containerStats(context.Args(), context.Bool("no-stream"))
+	},
+}
+
+// docker events 查看容器的事件
+var eventsCommand = cli.Command{
+	Name:  "events",
+	Usage: "show recorded container events, mydocker events [container...]",
+	Action: func(context *cli.Context) error {
+		return listEvents(context.Args())
+	},
+}
+
+// docker system
+var systemCommand = cli.Command{
+	Name:  "system",
+	Usage: "manage mydocker",
+	Subcommands: []cli.Command{
+		{
+			// docker system df 查看磁盘占用
+			Name:  "df",
+			Usage: "show mydocker disk usage",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "verbose, v",
+					Usage: "show disk usage and size limit of each container",
+				},
+			},
+			Action: func(context *cli.Context) error {
+				return systemDiskUsage(context.Bool("verbose"))
+			},
+		},
+		{
+			// 崩溃或者重启之后清理泄漏的挂载、网络设备、iptables规则、IP地址和cgroup
+			Name:  "recover",
+			Usage: "find and repair resources leaked by dead containers",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only report what would be repaired",
+				},
+			},
+			Action: func(context *cli.Context) error {
+				return systemRecover(context.Bool("dry-run"))
+			},
+		},
+	},
+}
+
+// docker volume 数据卷相关的命令
+var volumeCommand = cli.Command{
+	Name:  "volume",
+	Usage: "manage volumes",
+	Subcommands: []cli.Command{
+		{
+			// docker volume create 创建一个命名数据卷，不指定名字时创建匿名数据卷
+			Name:  "create",
+			Usage: "create a volume",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "label",
+					Usage: "set metadata for a volume, key=value",
+				},
+			},
+			Action: func(context *cli.Context) error {
+				return createVolume(context.Args().Get(0), context.StringSlice("label"))
+			},
+		},
+		{
+			// docker volume ls 查看所有数据卷
+			Name:    "list",
+			Aliases: []string{"ls"},
+			Usage:   "list volumes",
+			Action: func(context *cli.Context) error {
+				return listVolumes()
+			},
+		},
+		{
+			// docker volume inspect 查看数据卷的详细信息
+			Name:  "inspect",
+			Usage: "display detailed information on one or more volumes",
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("missing volume name")
+				}
+				return inspectVolumes(context.Args())
+			},
+		},
+		{
+			// docker volume rm 删除数据卷，正在被容器使用的数据卷不能删除
+			Name:    "remove",
+			Aliases: []string{"rm"},
+			Usage:   "remove one or more volumes",
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("missing volume name")
+				}
+				return removeVolumes(context.Args())
+			},
+		},
+		{
+			// docker volume prune 删除所有没有被使用的数据卷
+			Name:  "prune",
+			Usage: "remove all unused volumes",
+			Action: func(context *cli.Context) error {
+				return pruneVolumes()
+			},
+		},
+	},
+}
+
 // docker network
 var networkCommand = cli.Command{
 	Name:  "network",
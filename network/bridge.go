@@ -117,7 +117,9 @@ func setInterfaceUp(name string) error {
 func setupIPTables(bridgeName string, subNet *net.IPNet) error {
 	//由于go语言没有直接操控iptables操作的库，所以需要通过调用iptables命令来设置iptables规则
 	//iptables -t nat -A POSTROUTING -s <bridgeName> ! -o <bridgeName> -j MASQUERADE
-	iptablesCmd := fmt.Sprintf("-t nat -A POSTROUTING -s %s ! -o %s -j MASQUERADE", subNet.String(), bridgeName)
+	//注释记录规则所属的网络，system recover据此清理已经删除的网络的规则
+	iptablesCmd := fmt.Sprintf("-t nat -A POSTROUTING -s %s ! -o %s -m comment --comment %s%s -j MASQUERADE",
+		subNet.String(), bridgeName, networkRuleComment, bridgeName)
 
 	cmd := exec.Command("iptables", strings.Split(iptablesCmd, " ")...)
 	if err := cmd.Run(); err != nil {
@@ -175,6 +175,8 @@ func Content(networkName string, cinfo *container.ContainerInfo) error {
 	if err != nil {
 		return err
 	}
+	cinfo.Network = networkName
+	cinfo.IPAddress = ip.String()
 
 	//创建网络端点
 	ep := &Endpoint{
@@ -408,8 +410,9 @@ func configPortMapping(ep *Endpoint, cinfo *container.ContainerInfo) error {
 		//由于iptables没有Go语言版本的实现，所以采用exec.Command的方式直接调用命令配置
 		//在iptables的PREROUTING中添加DNAT规则
 		//将宿主机的端口请求转发到容器的地址和端口上
-		iptablesCmd := fmt.Sprintf("-t nat -A PREROUTING -p tcp -m tcp --dport %s -j DNAR --to-destination %s:%s",
-			portMapping[0], ep.IPAddress.String(), portMapping[1])
+		//注释记录规则所属的容器，system recover据此清理已经不在运行的容器的规则
+		iptablesCmd := fmt.Sprintf("-t nat -A PREROUTING -p tcp -m tcp --dport %s -m comment --comment %s%s -j DNAT --to-destination %s:%s",
+			portMapping[0], containerRuleComment, cinfo.ID, ep.IPAddress.String(), portMapping[1])
 		//执行iptables命令，添加端口映射转发规则
 		cmd := exec.Command("iptables", strings.Split(iptablesCmd, " ")...)
 		output, err := cmd.Output()
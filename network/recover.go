@@ -0,0 +1,327 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"mydocker/utils"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// iptables规则的注释，recover根据注释判断规则属于哪个网络或者哪个容器
+	networkRuleComment   = "mydocker-network:"
+	containerRuleComment = "mydocker-container:"
+	// 宿主机上容器一端的veth名字的前缀，另一端的名字是容器ID的前5位
+	peerPrefix = "cif-"
+)
+
+// ContainerEndpoint 仍在运行的容器在网络上的端点
+// 旧版本启动的容器没有记录网络，Network为空，这样的容器的veth、规则和地址都不能当作泄漏处理
+type ContainerEndpoint struct {
+	ContainerID string
+	Network     string
+	IP          net.IP
+}
+
+// Recover 对照保存的网络和仍在运行的容器，检查网桥、veth、iptables规则和IPAM中的分配
+// endpoints需要包含所有仍在运行的容器，没有记录网络的容器也要传入
+func Recover(endpoints []ContainerEndpoint) ([]utils.Repair, error) {
+	liveIDs := map[string]bool{}
+	for _, ep := range endpoints {
+		liveIDs[ep.ContainerID] = true
+	}
+
+	repairs, missing := recoverBridges()
+	linkRepairs, err := recoverLinks(endpoints)
+	if err != nil {
+		return repairs, err
+	}
+	repairs = append(repairs, linkRepairs...)
+	ruleRepairs, err := recoverRules(liveIDs, missing)
+	if err != nil {
+		return repairs, err
+	}
+	repairs = append(repairs, ruleRepairs...)
+	ipamRepairs, err := recoverIPAM(endpoints, unknownEndpoints(endpoints))
+	if err != nil {
+		return repairs, err
+	}
+	return append(repairs, ipamRepairs...), nil
+}
+
+// recoverBridges 网络的配置还在但是网桥不存在(比如重启之后)，重新创建网桥，同时会加上MASQUERADE规则
+func recoverBridges() ([]utils.Repair, map[string]bool) {
+	var repairs []utils.Repair
+	missing := map[string]bool{}
+	for _, nw := range networks {
+		if nw.IpRange == nil {
+			continue
+		}
+		if _, err := netlink.LinkByName(nw.Name); err == nil {
+			continue
+		}
+		missing[nw.Name] = true
+		nw := nw
+		repairs = append(repairs, utils.Repair{
+			Description: fmt.Sprintf("recreate missing bridge %s of network %s", nw.Name, nw.IpRange),
+			Fix: func() error {
+				return (&BridgeNetworkDriver{}).initBridge(nw)
+			},
+		})
+	}
+	return repairs, missing
+}
+
+// recoverLinks 连接在网络网桥上、但容器已经不在运行的veth，以及没能移动到容器中的cif-一端
+func recoverLinks(endpoints []ContainerEndpoint) ([]utils.Repair, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("list links error %v", err)
+	}
+	bridges := map[int]bool{}
+	for _, link := range links {
+		if _, ok := networks[link.Attrs().Name]; ok && link.Type() == "bridge" {
+			bridges[link.Attrs().Index] = true
+		}
+	}
+	liveNames := map[string]bool{}
+	for _, ep := range endpoints {
+		liveNames[vethName(ep.ContainerID)] = true
+	}
+
+	var repairs []utils.Repair
+	for _, link := range links {
+		attrs := link.Attrs()
+		if link.Type() != "veth" {
+			continue
+		}
+		stale := bridges[attrs.MasterIndex] && !liveNames[attrs.Name]
+		if strings.HasPrefix(attrs.Name, peerPrefix) && !liveNames[strings.TrimPrefix(attrs.Name, peerPrefix)] {
+			stale = true
+		}
+		if !stale {
+			continue
+		}
+		link := link
+		repairs = append(repairs, utils.Repair{
+			Description: fmt.Sprintf("delete veth %s of a dead container", attrs.Name),
+			Fix: func() error {
+				return netlink.LinkDel(link)
+			},
+		})
+	}
+	return repairs, nil
+}
+
+// vethName 和Connect中一样，取端点ID也就是容器ID的前5位
+func vethName(containerID string) string {
+	if len(containerID) > 5 {
+		return containerID[:5]
+	}
+	return containerID
+}
+
+// recoverRules 删除已经删除的网络的MASQUERADE规则和已经不在运行的容器的DNAT规则，
+// 补上缺失的MASQUERADE规则，重复的规则只保留一条
+func recoverRules(liveIDs, missingBridges map[string]bool) ([]utils.Repair, error) {
+	if _, err := exec.LookPath("iptables"); err != nil {
+		return nil, nil
+	}
+	var rules []string
+	for _, chain := range []string{"PREROUTING", "POSTROUTING"} {
+		output, err := exec.Command("iptables", "-t", "nat", "-S", chain).Output()
+		if err != nil {
+			return nil, fmt.Errorf("list iptables chain %s error %v", chain, err)
+		}
+		rules = append(rules, strings.Split(strings.TrimSpace(string(output)), "\n")...)
+	}
+
+	var repairs []utils.Repair
+	masquerade := map[string]int{}
+	for _, rule := range rules {
+		args := strings.Fields(rule)
+		if len(args) == 0 || args[0] != "-A" {
+			continue
+		}
+		stale := false
+		if name, ok := ruleNetwork(args); ok {
+			masquerade[name]++
+			_, exists := networks[name]
+			stale = !exists || masquerade[name] > 1
+		}
+		if id, ok := ruleOwner(args, containerRuleComment); ok {
+			stale = !liveIDs[id]
+		}
+		if !stale {
+			continue
+		}
+		args[0] = "-D"
+		deleteArgs := append([]string{"-t", "nat"}, args...)
+		repairs = append(repairs, utils.Repair{
+			Description: fmt.Sprintf("delete stale iptables rule %s", rule),
+			Fix: func() error {
+				if output, err := exec.Command("iptables", deleteArgs...).CombinedOutput(); err != nil {
+					return fmt.Errorf("%v %s", err, output)
+				}
+				return nil
+			},
+		})
+	}
+
+	//重新创建网桥时会一起加上规则
+	for _, nw := range networks {
+		if nw.IpRange == nil || masquerade[nw.Name] > 0 || missingBridges[nw.Name] {
+			continue
+		}
+		nw := nw
+		repairs = append(repairs, utils.Repair{
+			Description: fmt.Sprintf("add missing MASQUERADE rule of network %s", nw.Name),
+			Fix: func() error {
+				return setupIPTables(nw.Name, nw.IpRange)
+			},
+		})
+	}
+	return repairs, nil
+}
+
+// ruleOwner 从规则的注释中取出网络名或者容器ID
+func ruleOwner(args []string, prefix string) (string, bool) {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] != "--comment" {
+			continue
+		}
+		comment := strings.Trim(args[i+1], `"`)
+		if strings.HasPrefix(comment, prefix) {
+			return strings.TrimPrefix(comment, prefix), true
+		}
+	}
+	return "", false
+}
+
+// ruleNetwork 网络的MASQUERADE规则，旧版本创建的规则没有注释，按照 -s 网段 ! -o 网桥 -j MASQUERADE 匹配已有的网络
+func ruleNetwork(args []string) (string, bool) {
+	if name, ok := ruleOwner(args, networkRuleComment); ok {
+		return name, true
+	}
+	if len(args) != 9 || args[1] != "POSTROUTING" || args[2] != "-s" || args[4] != "!" || args[5] != "-o" || args[8] != "MASQUERADE" {
+		return "", false
+	}
+	nw, ok := networks[args[6]]
+	if !ok || nw.IpRange == nil {
+		return "", false
+	}
+	_, subnet, _ := net.ParseCIDR(nw.IpRange.String())
+	return nw.Name, subnet.String() == args[3]
+}
+
+// unknownEndpoints 没有记录网络、但是宿主机上有它的veth的容器，它们的地址无法确定
+func unknownEndpoints(endpoints []ContainerEndpoint) []string {
+	var unknown []string
+	for _, ep := range endpoints {
+		if ep.Network != "" {
+			continue
+		}
+		if _, err := netlink.LinkByName(vethName(ep.ContainerID)); err == nil {
+			unknown = append(unknown, ep.ContainerID)
+		}
+	}
+	return unknown
+}
+
+// recoverIPAM 分配出去的地址只应该是网关和仍在运行的容器的地址，已经删除的网络的网段整个去掉
+// 有地址无法确定的容器时不释放仍然存在的网络中的地址，否则可能把它的地址再分配给新的容器
+func recoverIPAM(endpoints []ContainerEndpoint, unknown []string) ([]utils.Repair, error) {
+	ipam := &IPAM{SubnetAllocatorPath: ipAllocator.SubnetAllocatorPath, Subnets: &map[string]*utils.BitMap{}}
+	if err := ipam.load(); err != nil {
+		return nil, fmt.Errorf("load ipam error %v", err)
+	}
+	if ipam.Subnets == nil {
+		return nil, nil
+	}
+	if len(unknown) > 0 {
+		logrus.Warnf("Skip releasing addresses, the network of running containers %s was not recorded", strings.Join(unknown, ", "))
+	}
+
+	used := map[string]map[int]bool{}
+	for _, nw := range networks {
+		if nw.IpRange == nil {
+			continue
+		}
+		_, subnet, _ := net.ParseCIDR(nw.IpRange.String())
+		used[subnet.String()] = map[int]bool{ipIndex(subnet, nw.IpRange.IP): true}
+	}
+	for _, ep := range endpoints {
+		nw, ok := networks[ep.Network]
+		if !ok || nw.IpRange == nil || ep.IP == nil {
+			continue
+		}
+		_, subnet, _ := net.ParseCIDR(nw.IpRange.String())
+		used[subnet.String()][ipIndex(subnet, ep.IP)] = true
+	}
+
+	var repairs []utils.Repair
+	for key, bitmap := range *ipam.Subnets {
+		key := key
+		inUse, ok := used[key]
+		if !ok {
+			repairs = append(repairs, utils.Repair{
+				Description: fmt.Sprintf("release subnet %s of a deleted network", key),
+				Fix: func() error {
+					return updateIPAM(func(subnets map[string]*utils.BitMap) {
+						delete(subnets, key)
+					})
+				},
+			})
+			continue
+		}
+		if len(unknown) > 0 {
+			continue
+		}
+		_, subnet, _ := net.ParseCIDR(key)
+		for i := 0; i < bitmap.Size(); i++ {
+			if bitmap.IsClear(i) || inUse[i] {
+				continue
+			}
+			i := i
+			repairs = append(repairs, utils.Repair{
+				Description: fmt.Sprintf("release leaked address %s in subnet %s", indexIP(subnet, i), key),
+				Fix: func() error {
+					return updateIPAM(func(subnets map[string]*utils.BitMap) {
+						if bitmap, ok := subnets[key]; ok {
+							bitmap.Clear(i)
+						}
+					})
+				},
+			})
+		}
+	}
+	return repairs, nil
+}
+
+// updateIPAM 重新加载分配信息，修改之后保存
+func updateIPAM(update func(subnets map[string]*utils.BitMap)) error {
+	ipam := &IPAM{SubnetAllocatorPath: ipAllocator.SubnetAllocatorPath, Subnets: &map[string]*utils.BitMap{}}
+	if err := ipam.load(); err != nil {
+		return err
+	}
+	if ipam.Subnets == nil {
+		return fmt.Errorf("decode %s error", ipam.SubnetAllocatorPath)
+	}
+	update(*ipam.Subnets)
+	return ipam.dump()
+}
+
+// ipIndex 地址在网段位图中的位置，和Allocate一样从网段地址的下一个地址开始
+func ipIndex(subnet *net.IPNet, ip net.IP) int {
+	return int(binary.BigEndian.Uint32(ip.To4()) - binary.BigEndian.Uint32(subnet.IP.To4()) - 1)
+}
+
+func indexIP(subnet *net.IPNet, index int) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(subnet.IP.To4())+uint32(index)+1)
+	return ip
+}
@@ -0,0 +1,82 @@
+package network
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRuleOwner(t *testing.T) {
+	_, ipRange, _ := net.ParseCIDR("10.88.0.1/24")
+	ipRange.IP = net.ParseIP("10.88.0.1").To4()
+	networks["recovernet"] = &Network{Name: "recovernet", IpRange: ipRange, Driver: "bridge"}
+	defer delete(networks, "recovernet")
+
+	cases := []struct {
+		rule    string
+		network string
+		owner   string
+	}{
+		{"-A POSTROUTING -s 10.88.0.0/24 ! -o recovernet -m comment --comment mydocker-network:recovernet -j MASQUERADE", "recovernet", ""},
+		//旧版本创建的没有注释的规则
+		{"-A POSTROUTING -s 10.88.0.0/24 ! -o recovernet -j MASQUERADE", "recovernet", ""},
+		{"-A POSTROUTING -s 172.17.0.0/16 ! -o docker0 -j MASQUERADE", "", ""},
+		{"-A PREROUTING -p tcp -m tcp --dport 8080 -m comment --comment mydocker-container:abcdefghij -j DNAT --to-destination 10.88.0.2:80", "", "abcdefghij"},
+	}
+	for _, c := range cases {
+		args := strings.Fields(c.rule)
+		network, _ := ruleNetwork(args)
+		owner, _ := ruleOwner(args, containerRuleComment)
+		if network != c.network || owner != c.owner {
+			t.Errorf("%s: network %q owner %q, want %q %q", c.rule, network, owner, c.network, c.owner)
+		}
+	}
+}
+
+func TestIPIndex(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.88.0.0/16")
+	for _, ip := range []string{"10.88.0.1", "10.88.1.7", "10.88.255.254"} {
+		index := ipIndex(subnet, net.ParseIP(ip))
+		if got := indexIP(subnet, index); got.String() != ip {
+			t.Errorf("index %d of %s maps back to %s", index, ip, got)
+		}
+	}
+	if index := ipIndex(subnet, net.ParseIP("10.88.0.1")); index != 0 {
+		t.Errorf("gateway index %d, want 0", index)
+	}
+}
+
+func TestRecoverIPAMUnknown(t *testing.T) {
+	oldPath := ipAllocator.SubnetAllocatorPath
+	ipAllocator.SubnetAllocatorPath = filepath.Join(t.TempDir(), "subnet.gob")
+	defer func() { ipAllocator.SubnetAllocatorPath = oldPath }()
+
+	_, ipRange, _ := net.ParseCIDR("10.89.0.0/24")
+	ipam := &IPAM{SubnetAllocatorPath: ipAllocator.SubnetAllocatorPath}
+	gateway, err := ipam.Allocate(ipRange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//一个容器的地址，这个容器是旧版本启动的，没有记录网络
+	if _, err := ipam.Allocate(ipRange); err != nil {
+		t.Fatal(err)
+	}
+	networks["recoveripam"] = &Network{Name: "recoveripam", IpRange: &net.IPNet{IP: gateway, Mask: ipRange.Mask}, Driver: "bridge"}
+	defer delete(networks, "recoveripam")
+
+	repairs, err := recoverIPAM(nil, []string{"oldcontainer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repairs) != 0 {
+		t.Errorf("addresses released while a container's network is unknown: %v", repairs[0].Description)
+	}
+	repairs, err = recoverIPAM(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repairs) != 1 || !strings.Contains(repairs[0].Description, "10.89.0.2") {
+		t.Errorf("repairs %+v", repairs)
+	}
+}
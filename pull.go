@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"mydocker/image"
+	"mydocker/registry"
+)
+
+// pullImage 从镜像仓库拉取镜像，本地镜像名与引用相同
+func pullImage(name, username, password string, insecure bool) error {
+	storeLock, err := image.LockStore(false)
+	if err != nil {
+		return err
+	}
+	defer storeLock.Unlock()
+	ref, err := registry.ParseReference(name)
+	if err != nil {
+		return err
+	}
+	client := registry.NewClient(ref.Registry, username, password, insecure)
+	img, err := client.Pull(ref, name)
+	if err != nil {
+		return fmt.Errorf("pull %s error %v", name, err)
+	}
+	fmt.Printf("%s: %s\n", img.Name, img.Digest)
+	return nil
+}
+
+// pushImage 推送本地镜像，镜像名中需要包含镜像仓库地址，可以先通过tag命名
+func pushImage(name, username, password string, insecure bool) error {
+	storeLock, err := image.LockStore(false)
+	if err != nil {
+		return err
+	}
+	defer storeLock.Unlock()
+	img, err := image.Get(name)
+	if err != nil {
+		return err
+	}
+	ref, err := registry.ParseReference(name)
+	if err != nil {
+		return err
+	}
+	client := registry.NewClient(ref.Registry, username, password, insecure)
+	if err := client.Push(img, ref); err != nil {
+		return fmt.Errorf("push %s error %v", name, err)
+	}
+	fmt.Printf("%s: %s\n", img.Name, img.Digest)
+	return nil
+}
+
+// tagImage 给已有镜像增加一个名字
+func tagImage(source, target string) error {
+	storeLock, err := image.LockStore(false)
+	if err != nil {
+		return err
+	}
+	defer storeLock.Unlock()
+	img, err := image.Get(source)
+	if err != nil {
+		return err
+	}
+	return image.Tag(target, img.Digest)
+}
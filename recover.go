@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"mydocker/cgroups"
+	"mydocker/container"
+	"mydocker/image"
+	"mydocker/network"
+	"mydocker/utils"
+	"net"
+	"strings"
+)
+
+// systemRecover 崩溃或者重启之后，对照保存的容器和网络，检查泄漏的挂载、孤立的根文件系统、veth、
+// iptables规则、IPAM中的地址和空的cgroup，dryRun时只报告不修复
+func systemRecover(dryRun bool) error {
+	//排他锁保证没有正在创建的容器和正在进行的构建，它们的挂载和目录还没有记录到容器信息中
+	storeLock, err := image.LockStore(true)
+	if err != nil {
+		return err
+	}
+	defer storeLock.Unlock()
+
+	containers, err := listContainerInfos()
+	if err != nil {
+		return err
+	}
+	var repairs []utils.Repair
+	keep := map[string]bool{}
+	inUse := map[string]bool{}
+	var endpoints []network.ContainerEndpoint
+	for _, containerInfo := range containers {
+		//停止的容器在删除之前保留根文件系统
+		keep[containerInfo.Name] = true
+		if containerInfo.Status != container.RUNNING {
+			continue
+		}
+		if !containerAlive(containerInfo) {
+			containerInfo := containerInfo
+			repairs = append(repairs, utils.Repair{
+				Description: fmt.Sprintf("mark container %s stopped, its process %s has exited", containerInfo.Name, containerInfo.Pid),
+				Fix: func() error {
+					containerInfo.Status = container.STOP
+					containerInfo.Pid = " "
+					return writeContainerInfo(containerInfo)
+				},
+			})
+			continue
+		}
+		inUse[containerInfo.CgroupPath] = true
+		//旧版本启动的容器没有记录网络，也要传入，它们的veth和地址不能被当作泄漏
+		endpoints = append(endpoints, network.ContainerEndpoint{
+			ContainerID: containerInfo.ID,
+			Network:     containerInfo.Network,
+			IP:          net.ParseIP(containerInfo.IPAddress),
+		})
+	}
+
+	//某一类检查失败不影响其他的检查
+	storageRepairs, err := container.RecoverStorage(keep)
+	if err != nil {
+		logrus.Errorf("Check container storage error %v", err)
+	}
+	repairs = append(repairs, storageRepairs...)
+	networkRepairs, err := network.Recover(endpoints)
+	if err != nil {
+		logrus.Errorf("Check network error %v", err)
+	}
+	repairs = append(repairs, networkRepairs...)
+	cgroupRepairs, err := cgroups.StaleCgroups(inUse)
+	if err != nil {
+		logrus.Errorf("Check cgroups error %v", err)
+	}
+	repairs = append(repairs, cgroupRepairs...)
+
+	if len(repairs) == 0 {
+		fmt.Println("Nothing to recover")
+		return nil
+	}
+	if dryRun {
+		for _, repair := range repairs {
+			fmt.Printf("would %s\n", repair.Description)
+		}
+		return nil
+	}
+	var failed int
+	for _, repair := range repairs {
+		if err := repair.Fix(); err != nil {
+			failed++
+			logrus.Errorf("Failed to %s: %v", repair.Description, err)
+			continue
+		}
+		fmt.Println(repair.Description)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d repairs failed", failed, len(repairs))
+	}
+	return nil
+}
+
+// containerAlive 容器的init进程还存在，并且仍然在容器的cgroup中(重启之后pid可能已经被其他进程使用)
+func containerAlive(containerInfo *container.ContainerInfo) bool {
+	pid := strings.TrimSpace(containerInfo.Pid)
+	if pid == "" {
+		return false
+	}
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%s/cgroup", pid))
+	if err != nil {
+		return false
+	}
+	if containerInfo.CgroupPath == "" {
+		return true
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) == 3 && strings.TrimPrefix(fields[2], "/") == containerInfo.CgroupPath {
+			return true
+		}
+	}
+	return false
+}
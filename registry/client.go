@@ -0,0 +1,242 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultConcurrency = 3
+	defaultChunkSize   = 5 << 20
+)
+
+// Client 遵循OCI Distribution规范的镜像仓库客户端
+type Client struct {
+	Registry    string //镜像仓库地址 host[:port]
+	Username    string
+	Password    string
+	Insecure    bool  //使用http访问镜像仓库
+	Concurrency int   //同时下载/上传的blob数
+	ChunkSize   int64 //分块上传时每一块的大小
+
+	HTTPClient *http.Client
+
+	mu     sync.Mutex
+	token  string //bearer token
+	basic  bool   //镜像仓库要求basic认证
+	scheme string
+}
+
+// NewClient 创建镜像仓库客户端，localhost和127.0.0.1默认使用http
+func NewClient(registry, username, password string, insecure bool) *Client {
+	if isLocalRegistry(registry) {
+		insecure = true
+	}
+	return &Client{
+		Registry:    registry,
+		Username:    username,
+		Password:    password,
+		Insecure:    insecure,
+		Concurrency: defaultConcurrency,
+		ChunkSize:   defaultChunkSize,
+		HTTPClient:  http.DefaultClient,
+	}
+}
+
+// isLocalRegistry 只有localhost、127.0.0.1本身或者带端口时才是本机，localhost.example.com不是
+func isLocalRegistry(registry string) bool {
+	host := registry
+	if i := strings.LastIndex(registry, ":"); i >= 0 {
+		if _, err := strconv.Atoi(registry[i+1:]); err != nil {
+			return false
+		}
+		host = registry[:i]
+	}
+	return host == "localhost" || host == "127.0.0.1"
+}
+
+func (c *Client) baseURL() string {
+	scheme := "https"
+	if c.Insecure {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s", scheme, c.Registry)
+}
+
+// url 拼接 /v2/<repository>/<path> 形式的接口地址
+func (c *Client) url(repository, format string, args ...interface{}) string {
+	return fmt.Sprintf("%s/v2/%s/%s", c.baseURL(), repository, fmt.Sprintf(format, args...))
+}
+
+// do 发送请求，遇到401时按照WWW-Authenticate的要求认证之后重试一次
+func (c *Client) do(method, rawURL string, header http.Header, body []byte) (*http.Response, error) {
+	resp, err := c.send(method, rawURL, header, body)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	if err := c.authenticate(challenge); err != nil {
+		return nil, err
+	}
+	return c.send(method, rawURL, header, body)
+}
+
+func (c *Client) send(method, rawURL string, header http.Header, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, rawURL, reader)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	c.mu.Lock()
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if c.basic {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	c.mu.Unlock()
+	return c.HTTPClient.Do(req)
+}
+
+var challengeParamRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// authenticate 处理认证质询
+// Basic: 直接在之后的请求中带上用户名密码
+// Bearer: 到realm指定的认证服务换取token，scope和service由质询给出
+func (c *Client) authenticate(challenge string) error {
+	fields := strings.SplitN(challenge, " ", 2)
+	scheme := strings.ToLower(fields[0])
+	params := map[string]string{}
+	if len(fields) == 2 {
+		for _, match := range challengeParamRegexp.FindAllStringSubmatch(fields[1], -1) {
+			params[match[1]] = match[2]
+		}
+	}
+
+	switch scheme {
+	case "basic":
+		if c.Username == "" {
+			return fmt.Errorf("registry %s requires username and password", c.Registry)
+		}
+		c.mu.Lock()
+		c.basic = true
+		c.mu.Unlock()
+		return nil
+	case "bearer":
+		token, err := c.fetchToken(params)
+		if err != nil {
+			return fmt.Errorf("fetch token error %v", err)
+		}
+		c.mu.Lock()
+		c.token = token
+		c.mu.Unlock()
+		return nil
+	default:
+		return fmt.Errorf("unsupported auth challenge %q", challenge)
+	}
+}
+
+func (c *Client) fetchToken(params map[string]string) (string, error) {
+	realm, ok := params["realm"]
+	if !ok {
+		return "", fmt.Errorf("bearer challenge without realm")
+	}
+	tokenURL, err := url.Parse(realm)
+	if err != nil {
+		return "", err
+	}
+	query := tokenURL.Query()
+	for _, key := range []string{"service", "scope"} {
+		if value := params[key]; value != "" {
+			query.Set(key, value)
+		}
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token server returned %s", resp.Status)
+	}
+
+	//不同的认证服务返回token或access_token
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", err
+	}
+	if tokenResp.Token != "" {
+		return tokenResp.Token, nil
+	}
+	if tokenResp.AccessToken != "" {
+		return tokenResp.AccessToken, nil
+	}
+	return "", fmt.Errorf("token server returned empty token")
+}
+
+// checkStatus 状态码不符合预期时读取错误信息
+func checkStatus(resp *http.Response, expected ...int) error {
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("%s %s returned %s: %s", resp.Request.Method, resp.Request.URL.Path,
+		resp.Status, strings.TrimSpace(string(body)))
+}
+
+// parallel 最多同时执行Concurrency个任务，返回第一个错误
+func (c *Client) parallel(n int, task func(i int) error) error {
+	concurrency := c.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = task(i)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"mydocker/image"
+	"net/http"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+)
+
+const (
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// 单个blob下载中断后的重试次数，每次从已下载的位置继续
+	downloadRetries = 3
+	// manifest和index的大小上限，和docker一致
+	maxManifestSize = 4 * 1024 * 1024
+)
+
+// 请求manifest时声明可以接受的格式，镜像仓库据此返回单平台manifest或多平台index
+var manifestAccept = []string{
+	image.MediaTypeManifest,
+	mediaTypeOCIIndex,
+	mediaTypeDockerManifest,
+	mediaTypeDockerManifestList,
+}
+
+// index 多平台镜像的索引
+type index struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	MediaType     string `json:"mediaType,omitempty"`
+	Manifests     []struct {
+		image.Descriptor
+		Platform struct {
+			Architecture string `json:"architecture"`
+			OS           string `json:"os"`
+			Variant      string `json:"variant,omitempty"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+// Pull 拉取镜像到本地镜像存储，并以localName命名
+func (c *Client) Pull(ref *Reference, localName string) (*image.Image, error) {
+	manifestBytes, mediaType, err := c.fetchManifest(ref.Repository, ref.Reference())
+	if err != nil {
+		return nil, err
+	}
+
+	//多平台镜像需要再根据当前平台选择具体的manifest
+	if mediaType == mediaTypeOCIIndex || mediaType == mediaTypeDockerManifestList {
+		digest, err := selectPlatform(manifestBytes)
+		if err != nil {
+			return nil, err
+		}
+		logrus.Infof("Select manifest %s for %s/%s", digest, runtime.GOOS, runtime.GOARCH)
+		if manifestBytes, _, err = c.fetchManifest(ref.Repository, digest); err != nil {
+			return nil, err
+		}
+	}
+
+	var manifest image.Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, fmt.Errorf("unmarshal manifest error %v", err)
+	}
+	blobs := append([]image.Descriptor{manifest.Config}, manifest.Layers...)
+	//摘要会被用作本地存储的路径，大小用来限制下载的字节数
+	for _, desc := range blobs {
+		if err := image.ValidateDigest(desc.Digest); err != nil {
+			return nil, fmt.Errorf("manifest: %v", err)
+		}
+		if desc.Size <= 0 {
+			return nil, fmt.Errorf("manifest: invalid size %d of blob %s", desc.Size, desc.Digest)
+		}
+	}
+	err = c.parallel(len(blobs), func(i int) error {
+		return c.fetchBlob(ref.Repository, blobs[i])
+	})
+	if err != nil {
+		return nil, err
+	}
+	return image.SaveManifest(localName, manifestBytes)
+}
+
+// fetchManifest 获取manifest并校验摘要，返回内容和媒体类型
+func (c *Client) fetchManifest(repository, reference string) ([]byte, string, error) {
+	header := http.Header{"Accept": {strings.Join(manifestAccept, ", ")}}
+	resp, err := c.do(http.MethodGet, c.url(repository, "manifests/%s", reference), header, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, http.StatusOK); err != nil {
+		return nil, "", err
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(content) > maxManifestSize {
+		return nil, "", fmt.Errorf("manifest is larger than %d bytes", maxManifestSize)
+	}
+
+	digest := image.Digest(content)
+	if strings.HasPrefix(reference, "sha256:") && digest != reference {
+		return nil, "", fmt.Errorf("manifest digest mismatch, expected %s got %s", reference, digest)
+	}
+	if expected := resp.Header.Get("Docker-Content-Digest"); expected != "" && expected != digest {
+		return nil, "", fmt.Errorf("manifest digest mismatch, expected %s got %s", expected, digest)
+	}
+
+	//Content-Type可能带有参数，媒体类型以manifest中记录的为准
+	mediaType := strings.Split(resp.Header.Get("Content-Type"), ";")[0]
+	var versioned struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(content, &versioned); err == nil && versioned.MediaType != "" {
+		mediaType = versioned.MediaType
+	}
+	return content, mediaType, nil
+}
+
+// selectPlatform 从index中选出当前系统和架构对应的manifest
+func selectPlatform(indexBytes []byte) (string, error) {
+	var idx index
+	if err := json.Unmarshal(indexBytes, &idx); err != nil {
+		return "", fmt.Errorf("unmarshal index error %v", err)
+	}
+	for _, m := range idx.Manifests {
+		if m.Platform.OS == runtime.GOOS && m.Platform.Architecture == runtime.GOARCH {
+			if err := image.ValidateDigest(m.Digest); err != nil {
+				return "", fmt.Errorf("index: %v", err)
+			}
+			return m.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("no manifest for platform %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+// fetchBlob 下载blob到本地存储
+// 下载的内容先写入.partial文件，中断之后通过Range请求从已下载的位置继续，全部下载完成后校验摘要
+func (c *Client) fetchBlob(repository string, desc image.Descriptor) error {
+	blobPath := image.BlobPath(desc.Digest)
+	if verifyFile(blobPath, desc.Digest) == nil {
+		logrus.Infof("Blob %s already exists", desc.Digest)
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(blobPath), 0755); err != nil {
+		return err
+	}
+
+	partialPath := blobPath + ".partial"
+	var err error
+	for i := 0; i < downloadRetries; i++ {
+		if err = c.download(repository, desc, partialPath); err == nil {
+			break
+		}
+		logrus.Warnf("Download blob %s error %v, retrying", desc.Digest, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := verifyFile(partialPath, desc.Digest); err != nil {
+		os.Remove(partialPath)
+		return err
+	}
+	logrus.Infof("Pull blob %s complete", desc.Digest)
+	return os.Rename(partialPath, blobPath)
+}
+
+func (c *Client) download(repository string, desc image.Descriptor, partialPath string) error {
+	file, err := os.OpenFile(partialPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if desc.Size > 0 && offset >= desc.Size {
+		return nil
+	}
+
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		logrus.Infof("Resume blob %s from %d", desc.Digest, offset)
+	}
+	resp, err := c.do(http.MethodGet, c.url(repository, "blobs/%s", desc.Digest), header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, http.StatusOK, http.StatusPartialContent); err != nil {
+		return err
+	}
+
+	//镜像仓库不支持Range请求时会返回全部内容，需要从头写
+	if offset > 0 && resp.StatusCode == http.StatusOK {
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	//最多只接收manifest中记录的大小，恶意的镜像仓库不能无限写入
+	written, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, io.LimitReader(resp.Body, desc.Size-written))
+	return err
+}
+
+// verifyFile 校验文件内容的摘要
+func verifyFile(filePath, digest string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+	if actual := "sha256:" + hex.EncodeToString(hash.Sum(nil)); actual != digest {
+		return fmt.Errorf("blob digest mismatch, expected %s got %s", digest, actual)
+	}
+	return nil
+}
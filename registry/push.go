@@ -0,0 +1,145 @@
+package registry
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"mydocker/image"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// Push 推送本地镜像，先上传config和各层blob，最后上传manifest
+func (c *Client) Push(img *image.Image, ref *Reference) error {
+	//直接使用本地保存的manifest原文，保证仓库中的摘要和本地一致
+	manifestBytes, err := ioutil.ReadFile(image.BlobPath(img.Digest))
+	if err != nil {
+		return err
+	}
+
+	blobs := append([]image.Descriptor{img.Manifest.Config}, img.Manifest.Layers...)
+	err = c.parallel(len(blobs), func(i int) error {
+		return c.pushBlob(ref.Repository, blobs[i])
+	})
+	if err != nil {
+		return err
+	}
+
+	mediaType := img.Manifest.MediaType
+	if mediaType == "" {
+		mediaType = image.MediaTypeManifest
+	}
+	header := http.Header{"Content-Type": {mediaType}}
+	resp, err := c.do(http.MethodPut, c.url(ref.Repository, "manifests/%s", ref.Reference()), header, manifestBytes)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, http.StatusCreated, http.StatusOK); err != nil {
+		return err
+	}
+	logrus.Infof("Push %s digest %s", ref, img.Digest)
+	return nil
+}
+
+// pushBlob 上传一个blob，仓库中已经存在的直接跳过
+func (c *Client) pushBlob(repository string, desc image.Descriptor) error {
+	resp, err := c.do(http.MethodHead, c.url(repository, "blobs/%s", desc.Digest), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		logrus.Infof("Blob %s already exists", desc.Digest)
+		return nil
+	}
+
+	//开始一次上传会话，仓库在Location中返回之后上传使用的地址
+	resp, err = c.do(http.MethodPost, c.url(repository, "blobs/uploads/"), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if err := checkStatus(resp, http.StatusAccepted); err != nil {
+		return err
+	}
+	location, err := c.resolveLocation(resp)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(image.BlobPath(desc.Digest))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	//分块上传，每一块通过Content-Range说明在blob中的位置
+	chunk := make([]byte, c.ChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(file, chunk)
+		if n > 0 {
+			header := http.Header{
+				"Content-Type":  {"application/octet-stream"},
+				"Content-Range": {fmt.Sprintf("%d-%d", offset, offset+int64(n)-1)},
+			}
+			resp, err := c.do(http.MethodPatch, location, header, chunk[:n])
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if err := checkStatus(resp, http.StatusAccepted); err != nil {
+				return err
+			}
+			if location, err = c.resolveLocation(resp); err != nil {
+				return err
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	//完成上传，仓库会校验digest
+	completeURL, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	query := completeURL.Query()
+	query.Set("digest", desc.Digest)
+	completeURL.RawQuery = query.Encode()
+	resp, err = c.do(http.MethodPut, completeURL.String(), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, http.StatusCreated); err != nil {
+		return err
+	}
+	logrus.Infof("Push blob %s complete", desc.Digest)
+	return nil
+}
+
+// resolveLocation Location可能是相对地址，需要基于仓库地址解析
+func (c *Client) resolveLocation(resp *http.Response) (string, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("%s %s returned no location", resp.Request.Method, resp.Request.URL.Path)
+	}
+	base, err := url.Parse(c.baseURL())
+	if err != nil {
+		return "", err
+	}
+	locationURL, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(locationURL).String(), nil
+}
@@ -0,0 +1,72 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	defaultRegistry = "registry-1.docker.io"
+	defaultTag      = "latest"
+)
+
+// Reference 镜像引用，例如 localhost:5000/library/busybox:1.36 或者 xxx/busybox@sha256:...
+type Reference struct {
+	Registry   string //镜像仓库地址
+	Repository string //仓库中的镜像名
+	Tag        string
+	Digest     string
+}
+
+// ParseReference 解析镜像引用
+// 第一段中包含.或:或者是localhost时被认为是镜像仓库地址，否则使用默认仓库
+func ParseReference(name string) (*Reference, error) {
+	ref := &Reference{}
+	if i := strings.Index(name, "@"); i >= 0 {
+		ref.Digest = name[i+1:]
+		name = name[:i]
+		if !strings.HasPrefix(ref.Digest, "sha256:") {
+			return nil, fmt.Errorf("unsupported digest %s", ref.Digest)
+		}
+	}
+	if i := strings.LastIndex(name, ":"); i >= 0 && !strings.Contains(name[i+1:], "/") {
+		ref.Tag = name[i+1:]
+		name = name[:i]
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = defaultTag
+	}
+
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.Registry = parts[0]
+		ref.Repository = parts[1]
+	} else {
+		ref.Registry = defaultRegistry
+		ref.Repository = name
+		//docker hub上的官方镜像都在library下
+		if !strings.Contains(name, "/") {
+			ref.Repository = "library/" + name
+		}
+	}
+	if ref.Repository == "" {
+		return nil, fmt.Errorf("invalid reference %s", name)
+	}
+	return ref, nil
+}
+
+// Reference 返回manifest接口中使用的tag或digest，digest优先
+func (r *Reference) Reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+func (r *Reference) String() string {
+	name := r.Registry + "/" + r.Repository
+	if r.Digest != "" {
+		return name + "@" + r.Digest
+	}
+	return name + ":" + r.Tag
+}
@@ -0,0 +1,343 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mydocker/image"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testUser     = "admin"
+	testPassword = "secret"
+	testToken    = "token-for-test"
+)
+
+// fakeRegistry 一个内存中的OCI Distribution仓库，使用bearer认证
+type fakeRegistry struct {
+	mu        sync.Mutex
+	server    *httptest.Server
+	blobs     map[string][]byte
+	manifests map[string][]byte //repository@reference -> manifest
+	types     map[string]string //manifest摘要 -> 媒体类型
+	uploads   map[string][]byte
+	patches   int
+	ranges    int
+	corrupt   bool //返回错误的blob内容
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	r := &fakeRegistry{
+		blobs:     map[string][]byte{},
+		manifests: map[string][]byte{},
+		types:     map[string]string{},
+		uploads:   map[string][]byte{},
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *fakeRegistry) host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+func (r *fakeRegistry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.URL.Path == "/token" {
+		if user, password, ok := req.BasicAuth(); !ok || user != testUser || password != testPassword {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": testToken})
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer "+testToken {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake",scope="repository:test:pull,push"`, r.server.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	urlPath := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case strings.Contains(urlPath, "/blobs/uploads/"):
+		r.serveUpload(w, req, urlPath)
+	case strings.Contains(urlPath, "/blobs/"):
+		digest := urlPath[strings.Index(urlPath, "/blobs/")+len("/blobs/"):]
+		content, ok := r.blobs[digest]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.corrupt {
+			content = append([]byte("corrupt"), content...)
+		}
+		if req.Header.Get("Range") != "" {
+			r.ranges++
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+	case strings.Contains(urlPath, "/manifests/"):
+		i := strings.Index(urlPath, "/manifests/")
+		key := urlPath[:i] + "@" + urlPath[i+len("/manifests/"):]
+		if req.Method == http.MethodPut {
+			content, _ := ioutil.ReadAll(req.Body)
+			digest := image.Digest(content)
+			r.manifests[key] = content
+			r.manifests[urlPath[:i]+"@"+digest] = content
+			r.types[digest] = req.Header.Get("Content-Type")
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		content, ok := r.manifests[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		digest := image.Digest(content)
+		w.Header().Set("Content-Type", r.types[digest])
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Write(content)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *fakeRegistry) serveUpload(w http.ResponseWriter, req *http.Request, urlPath string) {
+	i := strings.Index(urlPath, "/blobs/uploads/")
+	repository, id := urlPath[:i], urlPath[i+len("/blobs/uploads/"):]
+	switch req.Method {
+	case http.MethodPost:
+		id = fmt.Sprintf("upload-%d", len(r.uploads))
+		r.uploads[id] = []byte{}
+	case http.MethodPatch:
+		content, _ := ioutil.ReadAll(req.Body)
+		var start, end int
+		fmt.Sscanf(req.Header.Get("Content-Range"), "%d-%d", &start, &end)
+		if start != len(r.uploads[id]) || end != start+len(content)-1 {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		r.uploads[id] = append(r.uploads[id], content...)
+		r.patches++
+	case http.MethodPut:
+		content := r.uploads[id]
+		if image.Digest(content) != req.URL.Query().Get("digest") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.blobs[image.Digest(content)] = content
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	//返回相对地址，检验客户端能正确解析
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repository, id))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// createTestImage 在当前镜像存储中创建一个两层的镜像
+func createTestImage(t *testing.T, name string) *image.Image {
+	config := image.NewConfig()
+	var layers []image.Descriptor
+	for i := 0; i < 2; i++ {
+		dir := t.TempDir()
+		content := bytes.Repeat([]byte(fmt.Sprintf("layer %d ", i)), 100)
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", i)), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		layer, diffID, err := image.CreateLayer(dir)
+		if err != nil {
+			t.Fatalf("create layer %v", err)
+		}
+		layers = append(layers, layer)
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+	}
+	config.Config.Cmd = []string{"/bin/sh"}
+	img, err := image.Save(name, config, layers)
+	if err != nil {
+		t.Fatalf("save image %v", err)
+	}
+	return img
+}
+
+func newTestClient(r *fakeRegistry) *Client {
+	client := NewClient(r.host(), testUser, testPassword, false)
+	client.ChunkSize = 64
+	return client
+}
+
+func TestPushPull(t *testing.T) {
+	r := newFakeRegistry(t)
+	image.ImagePath = t.TempDir()
+	img := createTestImage(t, "app")
+
+	ref, err := ParseReference(r.host() + "/test/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestClient(r).Push(img, ref); err != nil {
+		t.Fatalf("push %v", err)
+	}
+	if r.patches < 2 {
+		t.Fatalf("expected chunked upload, got %d patches", r.patches)
+	}
+
+	//切换到一个空的本地存储再拉取
+	image.ImagePath = t.TempDir()
+	pulled, err := newTestClient(r).Pull(ref, ref.String())
+	if err != nil {
+		t.Fatalf("pull %v", err)
+	}
+	if pulled.ID() != img.ID() || pulled.Digest != img.Digest {
+		t.Fatalf("pulled %s/%s, pushed %s/%s", pulled.ID(), pulled.Digest, img.ID(), img.Digest)
+	}
+	if _, err := image.Get(ref.String()); err != nil {
+		t.Fatalf("get pulled image %v", err)
+	}
+}
+
+func TestPullIndex(t *testing.T) {
+	r := newFakeRegistry(t)
+	image.ImagePath = t.TempDir()
+	img := createTestImage(t, "app")
+	ref, _ := ParseReference(r.host() + "/test/app@" + img.Digest)
+	if err := newTestClient(r).Push(img, ref); err != nil {
+		t.Fatalf("push %v", err)
+	}
+
+	idx := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s","manifests":[`+
+		`{"mediaType":"%s","digest":"sha256:0000","size":1,"platform":{"architecture":"s390x","os":"linux"}},`+
+		`{"mediaType":"%s","digest":"%s","size":%d,"platform":{"architecture":"%s","os":"%s"}}]}`,
+		mediaTypeOCIIndex, image.MediaTypeManifest, image.MediaTypeManifest, img.Digest,
+		img.Manifest.Config.Size, runtime.GOARCH, runtime.GOOS)
+	r.manifests["test/app@multi"] = []byte(idx)
+	r.types[image.Digest([]byte(idx))] = mediaTypeOCIIndex
+
+	image.ImagePath = t.TempDir()
+	multiRef, _ := ParseReference(r.host() + "/test/app:multi")
+	pulled, err := newTestClient(r).Pull(multiRef, "app:multi")
+	if err != nil {
+		t.Fatalf("pull index %v", err)
+	}
+	if pulled.Digest != img.Digest {
+		t.Fatalf("selected manifest %s, want %s", pulled.Digest, img.Digest)
+	}
+}
+
+func TestPullResume(t *testing.T) {
+	r := newFakeRegistry(t)
+	image.ImagePath = t.TempDir()
+	img := createTestImage(t, "app")
+	ref, _ := ParseReference(r.host() + "/test/app:v1")
+	if err := newTestClient(r).Push(img, ref); err != nil {
+		t.Fatalf("push %v", err)
+	}
+
+	//模拟上一次下载中断，只留下了一半的内容
+	image.ImagePath = t.TempDir()
+	layer := img.Manifest.Layers[0]
+	content := r.blobs[layer.Digest]
+	partialPath := image.BlobPath(layer.Digest) + ".partial"
+	os.MkdirAll(filepath.Dir(partialPath), 0755)
+	if err := ioutil.WriteFile(partialPath, content[:len(content)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newTestClient(r).Pull(ref, "app"); err != nil {
+		t.Fatalf("pull %v", err)
+	}
+	if r.ranges != 1 {
+		t.Fatalf("expected 1 range request, got %d", r.ranges)
+	}
+}
+
+func TestPullDigestMismatch(t *testing.T) {
+	r := newFakeRegistry(t)
+	image.ImagePath = t.TempDir()
+	img := createTestImage(t, "app")
+	ref, _ := ParseReference(r.host() + "/test/app:v1")
+	if err := newTestClient(r).Push(img, ref); err != nil {
+		t.Fatalf("push %v", err)
+	}
+
+	image.ImagePath = t.TempDir()
+	r.corrupt = true
+	if _, err := newTestClient(r).Pull(ref, "app"); err == nil {
+		t.Fatalf("pull of corrupted blobs should fail")
+	}
+	if _, err := image.Get("app"); err == nil {
+		t.Fatalf("corrupted image should not be saved")
+	}
+}
+
+func TestPullInvalidDigest(t *testing.T) {
+	r := newFakeRegistry(t)
+	root := t.TempDir()
+	image.ImagePath = filepath.Join(root, "store")
+	evil := "sha256:../../../evil"
+	manifest, _ := json.Marshal(image.Manifest{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeManifest,
+		Config:        image.Descriptor{MediaType: image.MediaTypeConfig, Digest: evil, Size: 10},
+	})
+	r.manifests["test/app@v1"] = manifest
+	r.types[image.Digest(manifest)] = image.MediaTypeManifest
+	r.blobs[evil] = []byte("0123456789")
+
+	ref, _ := ParseReference(r.host() + "/test/app:v1")
+	if _, err := newTestClient(r).Pull(ref, "app"); err == nil {
+		t.Fatalf("pull of a manifest with an invalid digest should fail")
+	}
+	entries, _ := ioutil.ReadDir(root)
+	for _, entry := range entries {
+		if entry.Name() != "store" {
+			t.Fatalf("%s created outside of the image store", entry.Name())
+		}
+	}
+}
+
+func TestIsLocalRegistry(t *testing.T) {
+	cases := map[string]bool{
+		"localhost":              true,
+		"localhost:5000":         true,
+		"127.0.0.1:5000":         true,
+		"localhost.evil.com":     false,
+		"localhost.evil.com:443": false,
+		"127.0.0.1.evil.com":     false,
+		"registry.io":            false,
+	}
+	for registry, want := range cases {
+		if got := isLocalRegistry(registry); got != want {
+			t.Errorf("isLocalRegistry(%s) = %v", registry, got)
+		}
+	}
+}
+
+func TestParseReference(t *testing.T) {
+	cases := map[string]Reference{
+		"busybox":                {Registry: defaultRegistry, Repository: "library/busybox", Tag: "latest"},
+		"localhost:5000/a/b:1.0": {Registry: "localhost:5000", Repository: "a/b", Tag: "1.0"},
+		"reg.io/app@sha256:abc":  {Registry: "reg.io", Repository: "app", Digest: "sha256:abc"},
+		"user/app:dev":           {Registry: defaultRegistry, Repository: "user/app", Tag: "dev"},
+	}
+	for name, want := range cases {
+		ref, err := ParseReference(name)
+		if err != nil {
+			t.Fatalf("parse %s %v", name, err)
+		}
+		if *ref != want {
+			t.Fatalf("parse %s got %+v want %+v", name, *ref, want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"mydocker/cgroups"
 	"mydocker/container"
 	"os"
 )
@@ -30,6 +31,13 @@ func removeContainer(containerName string) {
 	}
 
 	//卸载和解绑
-	container.DeleteWorkSpace(containerInfo.Volume, containerName)
+	mounts := containerMounts(containerInfo)
+	container.DeleteWorkSpace(mounts, containerName)
+	releaseVolumes(mounts, containerName)
+	//删除容器自己的cgroup，删除之前记录最后的限制事件
+	checkCgroupEvents(containerInfo)
+	if err := cgroups.NewCgroupManager(containerInfo.CgroupPath).Destroy(); err != nil {
+		logrus.Errorf("%v", err)
+	}
 
 }
@@ -7,6 +7,7 @@ import (
 	"mydocker/cgroups"
 	"mydocker/cgroups/subsystems"
 	"mydocker/container"
+	"mydocker/image"
 	"mydocker/network"
 	"mydocker/utils"
 	"os"
@@ -29,39 +30,107 @@ import (
 *这里的Start方法是真正开始前面创建好的command的调用，它首先会clone出来一个namespace隔离的
 进程，然后再子进程中，调用/proc/self/exe，也就是调用自己，发送init参数，调用我们写的init方法，去初始化容器的一些资源。
 */
-func Run(tty bool, volume, containerName, imageName, net string, comArray, envSlice, portMapping *[]string, res *subsystems.ResourceConfig) {
+func Run(tty, readOnly bool, mounts []container.Mount, containerName, imageName, net string, storage container.StorageOpts, comArray, envSlice, portMapping *[]string, res *subsystems.ResourceConfig) {
 	//首先生成10位容器ID
 	containerId := utils.RanStringBytes(10)
 	//如果用户不指定容器名，那么就以容器id当作容器名
 	if containerName == "" {
 		containerName = containerId
 	}
+
+	//从读取镜像到记录容器信息期间持有镜像存储的共享锁，防止镜像被垃圾回收
+	storeLock, err := image.LockStore(false)
+	if err != nil {
+		logrus.Errorf("Lock image store error %v", err)
+		return
+	}
+	defer storeLock.Unlock()
+	//--rootfs不使用镜像，也就没有镜像中的默认命令和环境变量
+	img := &image.Image{}
+	if storage.Rootfs == "" {
+		if img, err = image.Get(imageName); err != nil {
+			logrus.Errorf("Get image %s error %v", imageName, err)
+			return
+		}
+	}
+
+	//用户没有指定命令时使用镜像中的默认命令，同时带上镜像中的环境变量
+	initConfig, err := applyImageConfig(img, comArray, envSlice)
+	if err != nil {
+		logrus.Errorf("Apply image %s config error %v", imageName, err)
+		return
+	}
+	initConfig.ReadOnly = readOnly
+	for _, mount := range mounts {
+		if mount.Type == container.MountTypeTmpfs {
+			initConfig.Mounts = append(initConfig.Mounts, mount)
+		}
+	}
+
+	//命名数据卷不存在时自动创建，并记录容器对数据卷的引用
+	if err := acquireVolumes(mounts, containerName); err != nil {
+		logrus.Errorf("Acquire volume error %v", err)
+		return
+	}
+
 	//logrus.Infof("Run command %s", command)
-	parent, wirtePipe := container.NewParentProcess(tty, volume, containerName, imageName, envSlice)
+	parent, wirtePipe := container.NewParentProcess(tty, mounts, containerName, img.Digest, storage, envSlice)
 	if parent == nil {
 		logrus.Errorf("New parent process error")
+		releaseVolumes(mounts, containerName)
+		return
+	}
+	//hosts和resolv.conf单独挂载，根文件系统只读时也可以修改
+	if err := container.SetUpEtcFiles(parent.Dir, containerName, mounts); err != nil {
+		logrus.Errorf("Set up etc files error %v", err)
+		container.DeleteWorkSpace(mounts, containerName)
+		releaseVolumes(mounts, containerName)
+		return
+	}
+	//每个容器有自己的cgroup，资源限制只作用于这个容器
+	cgroupPath := cgroups.ContainerCgroupPath(containerId)
+	cgroupManager := cgroups.NewCgroupManager(cgroupPath)
+	//启动失败时清理已经准备好的文件系统、hosts等文件、数据卷引用和cgroup
+	cleanup := func() {
+		wirtePipe.Close()
+		container.DeleteWorkSpace(mounts, containerName)
+		releaseVolumes(mounts, containerName)
+		if err := cgroupManager.Destroy(); err != nil {
+			logrus.Errorf("%v", err)
+		}
+	}
+	//在启动容器进程之前设置资源限制，任何一项限制无法设置时都不启动容器，避免容器在没有限制的情况下运行
+	if err := cgroupManager.Set(res); err != nil {
+		logrus.Errorf("Set cgroup %s error %v", cgroupPath, err)
+		cleanup()
 		return
 	}
 	if err := parent.Start(); err != nil {
-		logrus.Error("start parent process error %v", err)
+		logrus.Errorf("start parent process error %v", err)
+		cleanup()
+		return
+	}
+	//容器进程还在等待管道中的启动参数，没有执行任何命令，失败时直接杀死
+	kill := func() {
+		parent.Process.Kill()
+		parent.Wait()
+		cleanup()
+	}
+	//将容器进程加入到cgroup中，之后再发送启动参数
+	if err := cgroupManager.Apply(parent.Process.Pid); err != nil {
+		logrus.Errorf("Apply cgroup %s error %v", cgroupPath, err)
+		kill()
+		return
 	}
 
 	//记录容器信息
-	containerInfo, err := recordContainerInfo(parent.Process.Pid, containerId, containerName, volume, comArray, portMapping)
+	containerInfo, err := recordContainerInfo(parent.Process.Pid, containerId, containerName, mounts, readOnly, imageName, img.Digest, storage.Rootfs, cgroupPath, comArray, portMapping)
 	if err != nil {
 		logrus.Errorf("record container info error %v", err)
+		kill()
 		return
 	}
-
-	//创建cgroup manager，并通过调用set和apply设置资源限制并使限制在容器上生效
-	cgroupManager := cgroups.NewCgroupManager("mydocker-cgroup")
-
-	//defer cgroupManager.Destroy()
-
-	//设置资源限制
-	cgroupManager.Set(res)
-	//将容器进程加入到各个subsystem挂载对应的cgroup中
-	cgroupManager.Apply(parent.Process.Pid)
+	storeLock.Unlock()
 
 	//如果指定了网络信息则进行配置
 	if net != "" {
@@ -78,10 +147,14 @@ func Run(tty bool, volume, containerName, imageName, net string, comArray, envSl
 			logrus.Errorf("Error Connect Network %v", err)
 			return
 		}
+		//记录容器的网络和地址，system recover据此判断地址和规则是否还在使用
+		if err := writeContainerInfo(containerInfo); err != nil {
+			logrus.Errorf("%v", err)
+		}
 	}
 
 	//对容器设置完限制之后初始化容器
-	sendInitCommand(comArray, wirtePipe)
+	sendInitCommand(initConfig, wirtePipe)
 
 	if tty {
 		parent.Wait()
@@ -93,7 +166,12 @@ func Run(tty bool, volume, containerName, imageName, net string, comArray, envSl
 		//workURL := "/root/worker"
 		//rootURL := "/root"
 
-		container.DeleteWorkSpace(volume, containerName)
+		container.DeleteWorkSpace(mounts, containerName)
+		releaseVolumes(mounts, containerName)
+		checkCgroupEvents(containerInfo)
+		if err := cgroupManager.Destroy(); err != nil {
+			logrus.Errorf("%v", err)
+		}
 
 		os.Exit(0)
 	}
@@ -101,18 +179,45 @@ func Run(tty bool, volume, containerName, imageName, net string, comArray, envSl
 	//time.Sleep(2 * time.Minute)
 }
 
-func sendInitCommand(comArray *[]string, writePipe *os.File) {
-	command := strings.Join(*comArray, " ")
-	writePipe.WriteString(command)
-	writePipe.Close()
+// applyImageConfig 镜像中的ENTRYPOINT始终在最前面，用户指定的命令会替换镜像中的CMD
+// 返回传给容器init进程的启动参数
+func applyImageConfig(img *image.Image, comArray, envSlice *[]string) (*container.InitConfig, error) {
+	imageConfig := img.Config.Config
+
+	command := *comArray
+	if len(command) == 0 {
+		command = imageConfig.Cmd
+	}
+	command = append(append([]string{}, imageConfig.Entrypoint...), command...)
+	if len(command) == 0 {
+		return nil, fmt.Errorf("no command specified")
+	}
+	*comArray = command
+	*envSlice = append(append([]string{}, imageConfig.Env...), *envSlice...)
+	return &container.InitConfig{
+		Args:       command,
+		WorkingDir: imageConfig.WorkingDir,
+		User:       imageConfig.User,
+	}, nil
+}
+
+// sendInitCommand 将启动参数序列化之后写入管道，容器内的init进程读取之后执行
+func sendInitCommand(initConfig *container.InitConfig, writePipe *os.File) {
+	defer writePipe.Close()
+	content, err := json.Marshal(initConfig)
+	if err != nil {
+		logrus.Errorf("Marshal init config error %v", err)
+		return
+	}
+	writePipe.Write(content)
 }
 
-func recordContainerInfo(containerPID int, containerId, containerName, volume string, commandArray, portMapping *[]string) (*container.ContainerInfo, error) {
+func recordContainerInfo(containerPID int, containerId, containerName string, mounts []container.Mount, readOnly bool, imageName, imageDigest, rootfs, cgroupPath string, commandArray, portMapping *[]string) (*container.ContainerInfo, error) {
 	////首先生成10位容器ID
 	//id := utils.RanStringBytes(10)
 	//以当前时间为容器创建时间
 	currentTime := time.Now().Format("2006-01-02 15:04:05")
-	command := strings.Join(*commandArray, "")
+	command := strings.Join(*commandArray, " ")
 	////如果用户不指定容器名，那么就以容器id当作容器名
 	//if containerName == "" {
 	//	containerName = id
@@ -126,8 +231,13 @@ func recordContainerInfo(containerPID int, containerId, containerName, volume st
 		CreatedTime: currentTime,
 		Status:      container.RUNNING,
 		Name:        containerName,
-		Volume:      volume,
+		Mounts:      mounts,
 		PortMapping: *portMapping,
+		Image:       imageName,
+		ImageDigest: imageDigest,
+		CgroupPath:  cgroupPath,
+		ReadOnly:    readOnly,
+		Rootfs:      rootfs,
 	}
 
 	//将容器信息的对象json序列化成字符串
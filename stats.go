@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"mydocker/cgroups"
+	"mydocker/cgroups/subsystems"
+	"mydocker/container"
+	"mydocker/utils"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// containerStats 输出容器的资源使用情况，没有指定容器时输出所有运行中的容器
+// noStream为false时每隔两秒刷新一次，直到被中断
+func containerStats(names []string, noStream bool) error {
+	for {
+		containers, err := statsContainers(names)
+		if err != nil {
+			return err
+		}
+		if !noStream {
+			//清屏并回到左上角
+			fmt.Print("\033[2J\033[H")
+		}
+		w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+		fmt.Fprintf(w, "ID\tNAME\tPIDS\tBLOCK I/O\n")
+		for _, containerInfo := range containers {
+			stats, err := cgroups.NewCgroupManager(containerInfo.CgroupPath).GetStats()
+			if err != nil {
+				logrus.Errorf("Get stats of container %s error %v", containerInfo.Name, err)
+				continue
+			}
+			recordCgroupEvents(containerInfo, stats)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", containerInfo.ID, containerInfo.Name, formatPids(stats.Pids), formatBlockIo(stats.Io))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if noStream {
+			return nil
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func statsContainers(names []string) ([]*container.ContainerInfo, error) {
+	if len(names) == 0 {
+		containers, err := listContainerInfos()
+		if err != nil {
+			return nil, err
+		}
+		var running []*container.ContainerInfo
+		for _, containerInfo := range containers {
+			if containerInfo.Status == container.RUNNING {
+				running = append(running, containerInfo)
+			}
+		}
+		return running, nil
+	}
+	var containers []*container.ContainerInfo
+	for _, name := range names {
+		containerInfo, err := getContainerInfoByName(name)
+		if err != nil {
+			return nil, err
+		}
+		containers = append(containers, containerInfo)
+	}
+	return containers, nil
+}
+
+// formatPids 有限制时显示为 当前/限制
+func formatPids(pids subsystems.PidsStats) string {
+	if pids.Limit == 0 {
+		return strconv.FormatUint(pids.Current, 10)
+	}
+	return fmt.Sprintf("%d / %d", pids.Current, pids.Limit)
+}
+
+// formatBlockIo 所有块设备 读取/写入 的字节数
+func formatBlockIo(io subsystems.IoStats) string {
+	read, write := io.Total()
+	return fmt.Sprintf("%s / %s", utils.HumanSize(int64(read)), utils.HumanSize(int64(write)))
+}
+
+// recordCgroupEvents 把cgroup中新出现的限制事件记录下来，比如进程数达到了--pids-limit
+// 内核中的计数只增不减，和上一次记录的计数比较得到是否有新的事件
+func recordCgroupEvents(containerInfo *container.ContainerInfo, stats *subsystems.Stats) {
+	if containerInfo.CgroupPath == cgroups.LegacyCgroupPath {
+		//旧版本所有容器共用cgroup，计数不属于某一个容器
+		return
+	}
+	if stats.Pids.MaxEvents == 0 {
+		return
+	}
+	events, err := container.ReadEvents()
+	if err != nil {
+		logrus.Errorf("Read events error %v", err)
+		return
+	}
+	var recorded uint64
+	for _, event := range events {
+		if event.Container == containerInfo.ID && event.Action == "pids-limit" {
+			recorded, _ = strconv.ParseUint(event.Attributes["count"], 10, 64)
+		}
+	}
+	if stats.Pids.MaxEvents <= recorded {
+		return
+	}
+	err = container.RecordEvent(container.Event{
+		Container: containerInfo.ID,
+		Name:      containerInfo.Name,
+		Action:    "pids-limit",
+		Attributes: map[string]string{
+			"count": strconv.FormatUint(stats.Pids.MaxEvents, 10),
+			"limit": strconv.FormatUint(stats.Pids.Limit, 10),
+		},
+	})
+	if err != nil {
+		logrus.Errorf("Record event error %v", err)
+	}
+}
+
+// checkCgroupEvents 删除容器的cgroup之前最后检查一次事件
+func checkCgroupEvents(containerInfo *container.ContainerInfo) {
+	stats, err := cgroups.NewCgroupManager(containerInfo.CgroupPath).GetStats()
+	if err != nil {
+		return
+	}
+	recordCgroupEvents(containerInfo, stats)
+}
+
+// listEvents 输出记录的事件，指定了容器名时只输出这些容器的
+func listEvents(names []string) error {
+	events, err := container.ReadEvents()
+	if err != nil {
+		return err
+	}
+	filter := map[string]bool{}
+	for _, name := range names {
+		filter[name] = true
+	}
+	for _, event := range events {
+		if len(filter) > 0 && !filter[event.Name] && !filter[event.Container] {
+			continue
+		}
+		var keys []string
+		for key := range event.Attributes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		attributes := []string{"name=" + event.Name}
+		for _, key := range keys {
+			attributes = append(attributes, key+"="+event.Attributes[key])
+		}
+		fmt.Printf("%s container %s %s (%s)\n", event.Time.Format(time.RFC3339), event.Action, event.Container, strings.Join(attributes, ", "))
+	}
+	return nil
+}
@@ -40,19 +40,26 @@ func stopContainer(containerName string) {
 	//至此容器进程已经被kill，所以下面需要修改容器状态，PID可以置为空
 	containerInfo.Status = container.STOP
 	containerInfo.Pid = " "
+	if err := writeContainerInfo(containerInfo); err != nil {
+		logrus.Errorf("%v", err)
+	}
+}
+
+// writeContainerInfo 把修改后的容器信息写回config.json
+func writeContainerInfo(containerInfo *container.ContainerInfo) error {
 	//将修改后的信息序列化成json字符串
 	newContentBytes, err := json.Marshal(containerInfo)
 	if err != nil {
-		logrus.Errorf("get container info by name %s error %v", containerName, err)
-		return
+		return fmt.Errorf("marshal container info %s error %v", containerInfo.Name, err)
 	}
 
-	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
+	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerInfo.Name)
 	configFilePath := dirURL + container.ConfigName
 	//重新写入新的数据覆盖原来的信息
 	if err := ioutil.WriteFile(configFilePath, newContentBytes, 0622); err != nil {
-		logrus.Errorf("write file %s error %v", configFilePath, err)
+		return fmt.Errorf("write file %s error %v", configFilePath, err)
 	}
+	return nil
 }
 
 // 根据容器名或获取对应的struct结构
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"mydocker/container"
+	"mydocker/image"
+	"mydocker/utils"
+	"mydocker/volume"
+	"os"
+	"text/tabwriter"
+)
+
+// systemDiskUsage 统计镜像、容器可写层、数据卷和容器日志占用的空间，verbose时列出每个容器
+func systemDiskUsage(verbose bool) error {
+	storeLock, err := image.LockStore(false)
+	if err != nil {
+		return err
+	}
+	inUse, err := imagesInUse()
+	if err != nil {
+		storeLock.Unlock()
+		return err
+	}
+	imageUsage, err := image.Usage(inUse)
+	if err != nil {
+		storeLock.Unlock()
+		return fmt.Errorf("get image disk usage error %v", err)
+	}
+	//btrfs的镜像层子卷和容器已经不存在的旧版本lower目录，image prune -a可以回收
+	btrfsLayersSize, err := container.BtrfsLayersUsage()
+	if err != nil {
+		storeLock.Unlock()
+		return fmt.Errorf("get btrfs layers disk usage error %v", err)
+	}
+	layerReport, lowerReport, err := pruneImageStorage(imageUsage.Layers, true)
+	storeLock.Unlock()
+	if err != nil {
+		return err
+	}
+	imageSize := imageUsage.Size + btrfsLayersSize + lowerReport.SpaceReclaimed
+	imageReclaimable := imageUsage.Reclaimable + layerReport.SpaceReclaimed + lowerReport.SpaceReclaimed
+
+	containers, err := listContainerInfos()
+	if err != nil {
+		return err
+	}
+	var running, logs int
+	var containerSize, containerReclaimable, logSize int64
+	storages := map[string]containerStorage{}
+	for _, containerInfo := range containers {
+		storage, err := getContainerStorage(containerInfo.Name)
+		if err != nil {
+			logrus.Errorf("Get size of container %s error %v", containerInfo.Name, err)
+		}
+		storages[containerInfo.Name] = storage
+		//旧版本的容器有自己的一份镜像副本，删除容器时一起删除
+		lowerSize, err := container.LegacyLowerUsage(containerInfo.Name)
+		if err != nil {
+			logrus.Errorf("Get size of lower dir of container %s error %v", containerInfo.Name, err)
+		}
+		size := storage.SizeRw + lowerSize
+		containerSize += size
+		if containerInfo.Status == container.RUNNING {
+			running++
+		} else {
+			containerReclaimable += size
+		}
+		logFile := fmt.Sprintf(container.DefaultInfoLocation, containerInfo.Name) + container.ContainerLogFile
+		if info, err := os.Stat(logFile); err == nil {
+			logs++
+			logSize += info.Size()
+		}
+	}
+
+	volumes, err := volume.List()
+	if err != nil {
+		return err
+	}
+	var activeVolumes int
+	var volumeSize, volumeReclaimable int64
+	for _, vol := range volumes {
+		size, err := utils.DirSize(vol.Mountpoint)
+		if err != nil {
+			logrus.Errorf("Get size of volume %s error %v", vol.Name, err)
+		}
+		volumeSize += size
+		if len(vol.UsedBy) > 0 {
+			activeVolumes++
+		} else {
+			volumeReclaimable += size
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprintf(w, "TYPE\tTOTAL\tACTIVE\tSIZE\tRECLAIMABLE\n")
+	fmt.Fprintf(w, "Images\t%d\t%d\t%s\t%s\n", imageUsage.Images, imageUsage.Active,
+		utils.HumanSize(imageSize), reclaimable(imageReclaimable, imageSize))
+	fmt.Fprintf(w, "Containers\t%d\t%d\t%s\t%s\n", len(containers), running,
+		utils.HumanSize(containerSize), reclaimable(containerReclaimable, containerSize))
+	fmt.Fprintf(w, "Local Volumes\t%d\t%d\t%s\t%s\n", len(volumes), activeVolumes,
+		utils.HumanSize(volumeSize), reclaimable(volumeReclaimable, volumeSize))
+	fmt.Fprintf(w, "Logs\t%d\t-\t%s\t-\n", logs, utils.HumanSize(logSize))
+	if err := w.Flush(); err != nil {
+		logrus.Errorf("Flush error %v", err)
+	}
+	if !verbose {
+		return nil
+	}
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprintf(w, "CONTAINER\tSTATUS\tDRIVER\tSIZE\tLIMIT\n")
+	for _, containerInfo := range containers {
+		storage := storages[containerInfo.Name]
+		limit := "-"
+		if storage.SizeLimit > 0 {
+			limit = fmt.Sprintf("%s (%d%%)", utils.HumanSize(storage.SizeLimit), storage.SizeRw*100/storage.SizeLimit)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", containerInfo.Name, containerInfo.Status, storage.Driver,
+			utils.HumanSize(storage.SizeRw), limit)
+	}
+	if err := w.Flush(); err != nil {
+		logrus.Errorf("Flush error %v", err)
+	}
+	return nil
+}
+
+func reclaimable(size, total int64) string {
+	if total == 0 {
+		return utils.HumanSize(size)
+	}
+	return fmt.Sprintf("%s (%d%%)", utils.HumanSize(size), size*100/total)
+}
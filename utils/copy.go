@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// CopyPath 复制文件或目录，保留权限、属主和修改时间，符号链接按原样复制而不跟随
+// dst已经存在的目录会与src合并，已经存在的文件会被覆盖
+func CopyPath(src, dst string) error {
+	return filepath.Walk(src, func(srcPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, srcPath)
+		if err != nil {
+			return err
+		}
+		return copyEntry(srcPath, filepath.Join(dst, relPath), info)
+	})
+}
+
+func copyEntry(srcPath, dstPath string, info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("unsupported file info of %s", srcPath)
+	}
+
+	switch mode := info.Mode(); {
+	case mode.IsDir():
+		if err := os.Mkdir(dstPath, mode.Perm()); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case mode&os.ModeSymlink != 0:
+		link, err := os.Readlink(srcPath)
+		if err != nil {
+			return err
+		}
+		os.Remove(dstPath)
+		if err := os.Symlink(link, dstPath); err != nil {
+			return err
+		}
+		//符号链接只修改自身的属主，时间不做处理
+		if err := os.Lchown(dstPath, int(stat.Uid), int(stat.Gid)); err != nil {
+			return err
+		}
+		return copyXattrs(srcPath, dstPath)
+	case mode.IsRegular():
+		if err := copyFile(srcPath, dstPath, mode.Perm()); err != nil {
+			return err
+		}
+	default:
+		//设备文件、管道和socket按原设备号重新创建
+		os.Remove(dstPath)
+		if err := syscall.Mknod(dstPath, stat.Mode, int(stat.Rdev)); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Lchown(dstPath, int(stat.Uid), int(stat.Gid)); err != nil {
+		return err
+	}
+	//chown会清掉setuid位，所以放在chown之后设置权限
+	if err := os.Chmod(dstPath, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	//chown同样会清掉security.capability，扩展属性也要在chown之后复制
+	if err := copyXattrs(srcPath, dstPath); err != nil {
+		return err
+	}
+	return os.Chtimes(dstPath, info.ModTime(), info.ModTime())
+}
+
+// copyXattrs 复制扩展属性，overlay自己使用的trusted.overlay.*不复制
+// 源或目标文件系统不支持扩展属性时忽略
+func copyXattrs(srcPath, dstPath string) error {
+	size, err := unix.Llistxattr(srcPath, nil)
+	if err != nil || size == 0 {
+		if err == unix.ENOTSUP {
+			return nil
+		}
+		return err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(srcPath, buf)
+	if err != nil {
+		return err
+	}
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		attr := string(name)
+		if attr == "" || strings.HasPrefix(attr, "trusted.overlay.") {
+			continue
+		}
+		value, err := lgetxattr(srcPath, attr)
+		if err != nil {
+			return err
+		}
+		if err := unix.Lsetxattr(dstPath, attr, value, 0); err != nil {
+			if err == unix.ENOTSUP {
+				continue
+			}
+			return fmt.Errorf("set xattr %s on %s error %v", attr, dstPath, err)
+		}
+	}
+	return nil
+}
+
+func lgetxattr(filePath, attr string) ([]byte, error) {
+	size, err := unix.Lgetxattr(filePath, attr, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	size, err = unix.Lgetxattr(filePath, attr, value)
+	if err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
+
+func copyFile(srcPath, dstPath string, perm os.FileMode) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	_, err = io.Copy(dst, src)
+	return err
+}
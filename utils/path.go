@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// 解析路径时最多跟随的符号链接数量，和内核的限制一致
+const maxSymlinks = 40
+
+// SecureJoin 把unsafePath当作root之内的路径解析，得到宿主机上的路径
+// 路径中的符号链接按照以root为根的视角解析，绝对路径的符号链接从root开始，
+// 通过..跳出root的返回错误，这样符号链接不会把路径指到root之外。不存在的部分原样保留
+func SecureJoin(root, unsafePath string) (string, error) {
+	remaining := strings.Split(unsafePath, "/")
+	current := "/"
+	links := 0
+	for len(remaining) > 0 {
+		part := remaining[0]
+		remaining = remaining[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if current == "/" {
+				return "", fmt.Errorf("path %s escapes %s", unsafePath, root)
+			}
+			current = path.Dir(current)
+			continue
+		}
+
+		next := path.Join(current, part)
+		info, err := os.Lstat(path.Join(root, next))
+		if err != nil {
+			if os.IsNotExist(err) {
+				current = next
+				continue
+			}
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("path %s: too many levels of symbolic links", unsafePath)
+		}
+		link, err := os.Readlink(path.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(link) {
+			current = "/"
+		}
+		remaining = append(strings.Split(link, "/"), remaining...)
+	}
+	return path.Join(root, current), nil
+}
@@ -0,0 +1,8 @@
+package utils
+
+// Repair system recover发现的一处不一致，Description描述问题和修复的方式，Fix执行修复
+// 检查和修复分开，--dry-run时只输出Description
+type Repair struct {
+	Description string
+	Fix         func() error
+}
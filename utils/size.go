@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// HumanSize 把字节数转换成方便阅读的形式，例如 1.5MB
+func HumanSize(size int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	value := float64(size)
+	i := 0
+	for value >= 1000 && i < len(units)-1 {
+		value /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", size)
+	}
+	return fmt.Sprintf("%.3g%s", value, units[i])
+}
+
+// DirSize 统计目录下所有文件的大小，目录不存在时返回0
+func DirSize(root string) (int64, error) {
+	var size int64
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// ParseSize 解析以1024为进制的大小，例如 512、64k、1.5g、100MiB，不带单位时是字节
+func ParseSize(s string) (int64, error) {
+	value := strings.ToLower(strings.TrimSpace(s))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "ib"), "b")
+	multiplier := int64(1)
+	if value != "" {
+		if i := strings.IndexByte("kmgtp", value[len(value)-1]); i >= 0 {
+			multiplier = int64(1) << (10 * uint(i+1))
+			value = value[:len(value)-1]
+		}
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	//ParseFloat接受nan、inf和指数，转换成int64之前需要排除
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	size := number * float64(multiplier)
+	//float64(math.MaxInt64)会进位成2^63，相等时同样溢出
+	if size >= math.MaxInt64 {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return int64(size), nil
+}
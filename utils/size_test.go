@@ -0,0 +1,23 @@
+package utils
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	valid := map[string]int64{
+		"512":    512,
+		"64k":    64 << 10,
+		"1.5g":   3 << 29,
+		"100MiB": 100 << 20,
+		"8191p":  8191 << 50,
+	}
+	for s, want := range valid {
+		if size, err := ParseSize(s); err != nil || size != want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", s, size, err, want)
+		}
+	}
+	for _, s := range []string{"", "-1m", "nan", "inf", "-inf", "1e400", "9223372036854775807", "8192p", "1x"} {
+		if size, err := ParseSize(s); err == nil {
+			t.Errorf("ParseSize(%q) = %d should be invalid", s, size)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"mydocker/container"
+	"mydocker/utils"
+	"mydocker/volume"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// acquireVolumes 为命名数据卷和匿名数据卷记录容器的引用，数据卷不存在时自动创建
+// 匿名数据卷的Source会被设置成生成的名字，删除容器时据此释放引用
+func acquireVolumes(mounts []container.Mount, containerName string) error {
+	for i := range mounts {
+		if mounts[i].Type != container.MountTypeVolume {
+			continue
+		}
+		vol, err := volume.Acquire(mounts[i].Source, containerName)
+		if err != nil {
+			releaseVolumes(mounts[:i], containerName)
+			return err
+		}
+		mounts[i].Source = vol.Name
+	}
+	return nil
+}
+
+// volumesFrom 把--volumes-from CONTAINER[:ro|rw]指定的容器的挂载复制给新容器
+// tmpfs属于原来的容器，不复制；新容器自己用-v等参数挂载了同一个路径时以自己的为准
+func volumesFrom(specs []string, mounts []container.Mount) ([]container.Mount, error) {
+	targets := map[string]bool{}
+	for _, mount := range mounts {
+		targets[mount.Target] = true
+	}
+	var result []container.Mount
+	for _, spec := range specs {
+		parts := strings.Split(spec, ":")
+		if len(parts) > 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid volumes-from specification %q", spec)
+		}
+		mode := ""
+		if len(parts) == 2 {
+			mode = parts[1]
+			if mode != "ro" && mode != "rw" {
+				return nil, fmt.Errorf("invalid volumes-from specification %q, mode must be ro or rw", spec)
+			}
+		}
+		containerInfo, err := getContainerInfoByName(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("get container %s error %v", parts[0], err)
+		}
+		for _, mount := range containerMounts(containerInfo) {
+			if mount.Type == container.MountTypeTmpfs || targets[mount.Target] {
+				continue
+			}
+			if mode != "" {
+				mount.ReadOnly = mode == "ro"
+			}
+			targets[mount.Target] = true
+			result = append(result, mount)
+		}
+	}
+	return append(result, mounts...), nil
+}
+
+// containerMounts 容器记录的挂载，旧版本的容器只记录了一个volume参数
+func containerMounts(containerInfo *container.ContainerInfo) []container.Mount {
+	if len(containerInfo.Mounts) == 0 && containerInfo.Volume != "" {
+		if mount, err := container.ParseVolume(containerInfo.Volume); err == nil {
+			return []container.Mount{*mount}
+		}
+	}
+	return containerInfo.Mounts
+}
+
+// releaseVolumes 容器删除时释放它对数据卷的引用
+func releaseVolumes(mounts []container.Mount, containerName string) {
+	for _, mount := range mounts {
+		if mount.Type != container.MountTypeVolume {
+			continue
+		}
+		if err := volume.Release(mount.Source, containerName); err != nil {
+			logrus.Errorf("Release volume %s error %v", mount.Source, err)
+		}
+	}
+}
+
+// createVolume 创建命名数据卷，labels的格式是key=value
+func createVolume(name string, labels []string) error {
+	labelMap := map[string]string{}
+	for _, label := range labels {
+		kv := strings.SplitN(label, "=", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "")
+		}
+		labelMap[kv[0]] = kv[1]
+	}
+	if len(labelMap) == 0 {
+		labelMap = nil
+	}
+	vol, err := volume.Create(name, labelMap)
+	if err != nil {
+		return err
+	}
+	fmt.Println(vol.Name)
+	return nil
+}
+
+func listVolumes() error {
+	volumes, err := volume.List()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprintf(w, "DRIVER\tVOLUME NAME\tLABELS\tCONTAINERS\n")
+	for _, vol := range volumes {
+		var labels []string
+		for key, value := range vol.Labels {
+			labels = append(labels, key+"="+value)
+		}
+		sort.Strings(labels)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", vol.Driver, vol.Name, strings.Join(labels, ","), len(vol.UsedBy))
+	}
+	if err := w.Flush(); err != nil {
+		logrus.Errorf("Flush error %v", err)
+	}
+	return nil
+}
+
+func inspectVolumes(names []string) error {
+	var volumes []*volume.Volume
+	for _, name := range names {
+		vol, err := volume.Get(name)
+		if err != nil {
+			return err
+		}
+		volumes = append(volumes, vol)
+	}
+	content, err := json.MarshalIndent(volumes, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(content))
+	return nil
+}
+
+func removeVolumes(names []string) error {
+	var failed bool
+	for _, name := range names {
+		if err := volume.Remove(name); err != nil {
+			logrus.Errorf("Remove volume %s error %v", name, err)
+			failed = true
+			continue
+		}
+		fmt.Println(name)
+	}
+	if failed {
+		return fmt.Errorf("failed to remove some volumes")
+	}
+	return nil
+}
+
+func pruneVolumes() error {
+	removed, reclaimed, err := volume.Prune()
+	if err != nil {
+		return err
+	}
+	for _, name := range removed {
+		fmt.Printf("Deleted: %s\n", name)
+	}
+	fmt.Printf("Total reclaimed space: %s\n", utils.HumanSize(reclaimed))
+	return nil
+}
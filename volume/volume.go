@@ -0,0 +1,261 @@
+package volume
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mydocker/utils"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// 每个数据卷一个目录，数据在_data中，元数据在volume.json中
+var VolumePath = "/var/lib/mydocker/volumes/"
+
+const (
+	DefaultDriver = "local"
+	dataDir       = "_data"
+	metaFile      = "volume.json"
+	lockFile      = ".lock"
+)
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+// Volume 数据卷
+type Volume struct {
+	Name       string            `json:"name"`
+	Driver     string            `json:"driver"`
+	Mountpoint string            `json:"mountpoint"`          //宿主机上的数据目录
+	Labels     map[string]string `json:"labels,omitempty"`    //用户指定的标签
+	CreatedAt  string            `json:"created_at"`          //创建时间
+	Anonymous  bool              `json:"anonymous,omitempty"` //匿名数据卷在最后一个使用它的容器删除时一起删除
+	UsedBy     []string          `json:"used_by,omitempty"`   //正在使用该数据卷的容器
+}
+
+// Path 数据卷在宿主机上的数据目录
+func Path(name string) string {
+	return path.Join(VolumePath, name, dataDir)
+}
+
+// IsName 判断-v的源是数据卷名还是宿主机路径，宿主机路径必须是绝对路径
+func IsName(source string) bool {
+	return source != "" && source[0] != '/'
+}
+
+// Create 创建数据卷，名字为空时创建匿名数据卷，已经存在同名数据卷时直接返回
+func Create(name string, labels map[string]string) (*Volume, error) {
+	var vol *Volume
+	err := withLock(func() error {
+		var err error
+		vol, err = create(name, labels)
+		return err
+	})
+	return vol, err
+}
+
+func create(name string, labels map[string]string) (*Volume, error) {
+	anonymous := name == ""
+	if anonymous {
+		name = randomName()
+	}
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+	if vol, err := load(name); err == nil {
+		return vol, nil
+	}
+
+	vol := &Volume{
+		Name:       name,
+		Driver:     DefaultDriver,
+		Mountpoint: Path(name),
+		Labels:     labels,
+		CreatedAt:  time.Now().Format("2006-01-02 15:04:05"),
+		Anonymous:  anonymous,
+	}
+	if err := os.MkdirAll(vol.Mountpoint, 0755); err != nil {
+		return nil, err
+	}
+	if err := save(vol); err != nil {
+		os.RemoveAll(path.Join(VolumePath, name))
+		return nil, err
+	}
+	return vol, nil
+}
+
+// Get 获取数据卷
+func Get(name string) (*Volume, error) {
+	return load(name)
+}
+
+// List 列出所有数据卷，按名字排序
+func List() ([]*Volume, error) {
+	entries, err := ioutil.ReadDir(VolumePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var volumes []*Volume
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		vol, err := load(entry.Name())
+		if err != nil {
+			continue
+		}
+		volumes = append(volumes, vol)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Name < volumes[j].Name })
+	return volumes, nil
+}
+
+// Remove 删除数据卷，有容器正在使用时拒绝删除
+func Remove(name string) error {
+	return withLock(func() error {
+		vol, err := load(name)
+		if err != nil {
+			return err
+		}
+		if len(vol.UsedBy) > 0 {
+			return fmt.Errorf("volume %s is in use by %v", name, vol.UsedBy)
+		}
+		return os.RemoveAll(path.Join(VolumePath, name))
+	})
+}
+
+// Prune 删除所有没有被容器使用的数据卷，返回删除的数据卷和回收的空间
+func Prune() ([]string, int64, error) {
+	var removed []string
+	var reclaimed int64
+	err := withLock(func() error {
+		volumes, err := List()
+		if err != nil {
+			return err
+		}
+		for _, vol := range volumes {
+			if len(vol.UsedBy) > 0 {
+				continue
+			}
+			size, _ := utils.DirSize(vol.Mountpoint)
+			if err := os.RemoveAll(path.Join(VolumePath, vol.Name)); err != nil {
+				return err
+			}
+			removed = append(removed, vol.Name)
+			reclaimed += size
+		}
+		return nil
+	})
+	return removed, reclaimed, err
+}
+
+// Acquire 记录容器使用了数据卷，数据卷不存在时自动创建，名字为空时创建匿名数据卷
+func Acquire(name, containerName string) (*Volume, error) {
+	var vol *Volume
+	err := withLock(func() error {
+		var err error
+		if vol, err = create(name, nil); err != nil {
+			return err
+		}
+		for _, user := range vol.UsedBy {
+			if user == containerName {
+				return nil
+			}
+		}
+		vol.UsedBy = append(vol.UsedBy, containerName)
+		return save(vol)
+	})
+	return vol, err
+}
+
+// Release 容器不再使用数据卷，匿名数据卷没有容器使用之后会被删除
+func Release(name, containerName string) error {
+	return withLock(func() error {
+		vol, err := load(name)
+		if err != nil {
+			return err
+		}
+		var usedBy []string
+		for _, user := range vol.UsedBy {
+			if user != containerName {
+				usedBy = append(usedBy, user)
+			}
+		}
+		vol.UsedBy = usedBy
+		if vol.Anonymous && len(vol.UsedBy) == 0 {
+			return os.RemoveAll(path.Join(VolumePath, name))
+		}
+		return save(vol)
+	})
+}
+
+// validateName 数据卷名是VolumePath下的一级目录，..或者带/的名字会指向VolumePath之外
+func validateName(name string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid volume name %q, only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", name)
+	}
+	return nil
+}
+
+// load 读取数据卷的元数据，Get、Remove以及引用计数都经过这里，名字在拼接路径之前校验
+func load(name string) (*Volume, error) {
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(path.Join(VolumePath, name, metaFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no such volume: %s", name)
+		}
+		return nil, err
+	}
+	var vol Volume
+	if err := json.Unmarshal(content, &vol); err != nil {
+		return nil, fmt.Errorf("unmarshal volume %s error %v", name, err)
+	}
+	return &vol, nil
+}
+
+func save(vol *Volume) error {
+	content, err := json.Marshal(vol)
+	if err != nil {
+		return err
+	}
+	metaPath := path.Join(VolumePath, vol.Name, metaFile)
+	if err := ioutil.WriteFile(metaPath+".tmp", content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(metaPath+".tmp", metaPath)
+}
+
+// withLock 修改数据卷的元数据时持有文件锁，多个mydocker进程同时运行时引用计数不会丢失
+func withLock(fn func() error) error {
+	if err := os.MkdirAll(VolumePath, 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path.Join(VolumePath, lockFile), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	return fn()
+}
+
+// randomName 匿名数据卷使用64位十六进制的随机名字
+func randomName() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,66 @@
+package volume
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVolumeReference(t *testing.T) {
+	VolumePath = t.TempDir()
+	vol, err := Acquire("data", "c1")
+	if err != nil {
+		t.Fatalf("acquire %v", err)
+	}
+	if _, err := os.Stat(vol.Mountpoint); err != nil {
+		t.Fatalf("volume should be created automatically %v", err)
+	}
+	if err := Remove("data"); err == nil {
+		t.Fatalf("remove volume in use should fail")
+	}
+	if err := Release("data", "c1"); err != nil {
+		t.Fatalf("release %v", err)
+	}
+	if err := Remove("data"); err != nil {
+		t.Fatalf("remove %v", err)
+	}
+
+	anonymous, err := Acquire("", "c2")
+	if err != nil || !anonymous.Anonymous {
+		t.Fatalf("acquire anonymous volume %+v %v", anonymous, err)
+	}
+	if err := Release(anonymous.Name, "c2"); err != nil {
+		t.Fatalf("release %v", err)
+	}
+	if _, err := Get(anonymous.Name); err == nil {
+		t.Fatalf("anonymous volume should be removed with its last container")
+	}
+
+	if _, err := Create("../escape", nil); err == nil {
+		t.Fatalf("invalid volume name should be rejected")
+	}
+}
+
+func TestVolumeNameTraversal(t *testing.T) {
+	root := t.TempDir()
+	VolumePath = filepath.Join(root, "volumes")
+	//VolumePath之外一个看起来像数据卷的目录
+	outside := filepath.Join(root, "outside")
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, metaFile), []byte(`{"name":"outside"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"..", "../outside", "a/b", "/etc"} {
+		if _, err := Get(name); err == nil {
+			t.Errorf("get %q should be rejected", name)
+		}
+		if err := Remove(name); err == nil {
+			t.Errorf("remove %q should be rejected", name)
+		}
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Fatalf("directory outside of volumes removed %v", err)
+	}
+}